@@ -0,0 +1,301 @@
+package alerts
+
+import (
+	"conf"
+	"fmt"
+	"gsm"
+	"log/slog"
+	"metrics"
+	"mod_io"
+	"portmap"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	stat_sent = metrics.New_counter("module_io_alerts_sent_total",
+	                                "SMS alerts delivered")
+	stat_failed = metrics.New_counter("module_io_alerts_failed_total",
+	                                  "SMS alerts not delivered to any number of a list")
+	stat_suppressed = metrics.New_counter("module_io_alerts_suppressed_total",
+	                                      "SMS alerts suppressed by rate limit or dedupe")
+)
+
+const QUEUE_SIZE = 64
+
+type alert struct {
+	name string
+	port int // 0 for event alerts
+	state int // -1 means any state
+	event string
+	recipients []string
+	text string
+	min_interval time.Duration
+	last_sent time.Time
+	sent int
+	suppressed int
+}
+
+// Alert description for control socket
+type Alert_info struct {
+	Name string
+	Trigger string
+	Last_sent time.Time
+	Sent int
+	Suppressed int
+}
+
+// Message waiting for delivery to one recipients list
+type pending struct {
+	alert string
+	list string
+	text string
+}
+
+type Alerts struct {
+	sync.Mutex
+	gsm *gsm.Gsm
+	ports *portmap.Map
+	mio *mod_io.Mod_io
+	alerts []*alert
+	recipients map[string][]string
+	delivery_timeout time.Duration
+	dedupe_window time.Duration
+	link_timeout time.Duration
+	recent map[string]time.Time // alert text -> last time it was queued
+	queue chan pending
+}
+
+func parse_duration(name string, value string) (time.Duration, error) {
+	if value == "" {
+		return 0, nil
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		return 0, fmt.Errorf("alerts: incorrect %s: %v", name, err)
+	}
+	return d, nil
+}
+
+func New(mio *mod_io.Mod_io, ports *portmap.Map, g *gsm.Gsm,
+         alerts_cfg []conf.Alert_cfg, acfg *conf.Alerting_cfg) (*Alerts, error) {
+	var err error
+	a := new(Alerts)
+	a.mio = mio
+	a.ports = ports
+	a.gsm = g
+	a.recipients = acfg.Recipients
+	a.recent = make(map[string]time.Time)
+	a.queue = make(chan pending, QUEUE_SIZE)
+
+	a.delivery_timeout, err = parse_duration("delivery_timeout", acfg.Delivery_timeout)
+	if err != nil {
+		return nil, err
+	}
+	a.dedupe_window, err = parse_duration("dedupe_window", acfg.Dedupe_window)
+	if err != nil {
+		return nil, err
+	}
+	a.link_timeout, err = parse_duration("link_timeout", acfg.Link_timeout)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, cfg := range alerts_cfg {
+		al := &alert{name: cfg.Name,
+		             state: -1,
+		             event: cfg.Event,
+		             recipients: cfg.Recipients,
+		             text: cfg.Text}
+		if cfg.Port != "" {
+			al.port, err = ports.Resolve(portmap.INPUT, cfg.Port)
+			if err != nil {
+				return nil, fmt.Errorf("alerts: alert %s: %v", cfg.Name, err)
+			}
+		}
+		if cfg.State == "0" || cfg.State == "1" {
+			al.state, _ = strconv.Atoi(cfg.State)
+		}
+		al.min_interval, err = parse_duration("min_interval", cfg.Min_interval)
+		if err != nil {
+			return nil, fmt.Errorf("alerts: alert %s: %v", cfg.Name, err)
+		}
+		for _, list := range al.recipients {
+			if _, ok := a.recipients[list]; !ok {
+				return nil, fmt.Errorf("alerts: alert %s: unknown recipients list %s",
+				                       cfg.Name, list)
+			}
+		}
+		if al.text == "" {
+			if al.port != 0 {
+				al.text = "{name}: {port}={state} at {time}"
+			} else {
+				al.text = "{name}: {event} {details} at {time}"
+			}
+		}
+		a.alerts = append(a.alerts, al)
+	}
+	return a, nil
+}
+
+// Start delivery and board link monitor
+func (a *Alerts) Run() {
+	go a.sender_thread()
+	if a.link_timeout > 0 {
+		go a.link_thread()
+	}
+}
+
+// Handle input change, state is physical board state
+func (a *Alerts) Input_changed(port int, state int) {
+	if a == nil {
+		return
+	}
+	state = a.ports.Logical(portmap.INPUT, port, state)
+	for _, al := range a.alerts {
+		if al.port == port && (al.state < 0 || al.state == state) {
+			a.fire(al, port, state, "", "")
+		}
+	}
+}
+
+// Handle daemon event like "board_restart" or "host_lost"
+func (a *Alerts) Event(event string, details string) {
+	if a == nil {
+		return
+	}
+	for _, al := range a.alerts {
+		if al.event == event {
+			a.fire(al, 0, 0, event, details)
+		}
+	}
+}
+
+func (a *Alerts) fire(al *alert, port int, state int, event string, details string) {
+	now := time.Now()
+	template := al.text
+	if details == "" {
+		template = strings.Replace(template, " {details}", "", -1)
+	}
+	text := strings.NewReplacer("{name}", al.name,
+	                            "{details}", details,
+	                            "{port}", a.ports.Label(portmap.INPUT, port),
+	                            "{state}", strconv.Itoa(state),
+	                            "{event}", event,
+	                            "{time}", now.Format("2006-01-02 15:04:05")).Replace(template)
+	// dedupe ignores time in text
+	key := al.name + "\x00" + strings.Replace(al.text, "{time}", "", -1) +
+	       "\x00" + strconv.Itoa(port) + "\x00" + strconv.Itoa(state) + "\x00" + event
+
+	a.Lock()
+	reason := ""
+	switch {
+	case al.min_interval > 0 && now.Sub(al.last_sent) < al.min_interval:
+		reason = "rate limit"
+	case a.dedupe_window > 0 && now.Sub(a.recent[key]) < a.dedupe_window:
+		reason = "duplicate"
+	}
+	if reason != "" {
+		al.suppressed++
+		a.Unlock()
+		stat_suppressed.Inc()
+		slog.Info("alert suppressed", "module", "alerts", "alert", al.name,
+		          "reason", reason)
+		return
+	}
+	al.last_sent = now
+	al.sent++
+	a.recent[key] = now
+	for k, t := range a.recent {
+		if now.Sub(t) > a.dedupe_window {
+			delete(a.recent, k)
+		}
+	}
+	a.Unlock()
+
+	slog.Warn("alert", "module", "alerts", "alert", al.name, "text", text)
+	for _, list := range al.recipients {
+		select {
+		case a.queue <- pending{al.name, list, text}:
+		default:
+			stat_failed.Inc()
+			slog.Error("alert queue is full", "module", "alerts", "alert", al.name,
+			           "list", list)
+		}
+	}
+}
+
+// Deliver alerts one by one, trying next numbers of a list on failure
+func (a *Alerts) sender_thread() {
+	for p := range a.queue {
+		delivered := false
+		for _, phone := range a.recipients[p.list] {
+			err := a.gsm.Send_sms_confirmed(phone, p.text, a.delivery_timeout)
+			if err == nil {
+				delivered = true
+				slog.Info("alert delivered", "module", "alerts", "alert", p.alert,
+				          "list", p.list, "phone", phone)
+				break
+			}
+			slog.Warn("alert delivery failed", "module", "alerts", "alert", p.alert,
+			          "list", p.list, "phone", phone, "err", err)
+		}
+		if delivered {
+			stat_sent.Inc()
+		} else {
+			stat_failed.Inc()
+			slog.Error("alert is not delivered", "module", "alerts", "alert", p.alert,
+			           "list", p.list)
+		}
+	}
+}
+
+// Report board link loss and recovery by UART silence
+func (a *Alerts) link_thread() {
+	down := false
+	for {
+		time.Sleep(a.link_timeout / 4)
+		silent := time.Since(a.mio.Last_rx()) > a.link_timeout
+		if silent && !down {
+			down = true
+			a.Event("board_link_down", "")
+		}
+		if !silent && down {
+			down = false
+			a.Event("board_link_up", "")
+		}
+	}
+}
+
+// Return alerts description sorted by name
+func (a *Alerts) List() []Alert_info {
+	if a == nil {
+		return nil
+	}
+	a.Lock()
+	defer a.Unlock()
+
+	var list []Alert_info
+	for _, al := range a.alerts {
+		trigger := "event " + al.event
+		if al.port != 0 {
+			state := "any"
+			if al.state >= 0 {
+				state = strconv.Itoa(al.state)
+			}
+			trigger = fmt.Sprintf("input %s=%s", a.ports.Label(portmap.INPUT, al.port), state)
+		}
+		list = append(list, Alert_info{Name: al.name,
+		                               Trigger: trigger,
+		                               Last_sent: al.last_sent,
+		                               Sent: al.sent,
+		                               Suppressed: al.suppressed})
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Name < list[j].Name
+	})
+	return list
+}
@@ -0,0 +1,487 @@
+package at_modem
+
+import (
+	"conf"
+	"context"
+	"fmt"
+	"log/slog"
+	"modem"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Max wait for SMS submission result, network may be slow
+const SEND_TIMEOUT = 60 * time.Second
+
+// Received lines waiting for command
+const LINES_QUEUE = 64
+
+// Message end and cancel characters of AT+CMGS
+const (
+	CTRL_Z = "\x1a"
+	ESC = "\x1b"
+)
+
+// Modem controlled by AT commands over serial port, like SIM800 or
+// Quectel modules. SMS are sent and read in text mode with UCS2
+// character set, so any text is transferred as hex of UTF-16
+type Modem struct {
+	sync.Mutex // one command at a time
+	dev *os.File
+	timeout time.Duration
+	lines chan string // command responses
+	cusd chan string // unsolicited USSD replies
+	ready bool // echo and SMS mode are set up
+	last_sent modem.Sent_sms_stat
+}
+
+func New(mcfg *conf.Modem_cfg) (*Modem, error) {
+	var err error
+	m := new(Modem)
+	m.timeout, err = time.ParseDuration(mcfg.At_timeout)
+	if err != nil || m.timeout <= 0 {
+		return nil, fmt.Errorf("at_modem: incorrect at_timeout '%s'", mcfg.At_timeout)
+	}
+	m.lines = make(chan string, LINES_QUEUE)
+	m.cusd = make(chan string, 1)
+
+	m.dev, err = os.OpenFile(mcfg.Device, os.O_RDWR, 0660)
+	if err != nil {
+		return nil, fmt.Errorf("at_modem: can't open %s: %v", mcfg.Device, err)
+	}
+
+	err = exec.Command("stty", "-F", mcfg.Device, mcfg.Speed, "raw", "-echo").Run()
+	if err != nil {
+		m.dev.Close()
+		return nil, fmt.Errorf("at_modem: can't set tty params: %v", err)
+	}
+
+	go m.receiver_thread()
+	return m, nil
+}
+
+// Split modem output into lines. Unsolicited USSD replies go to
+// cusd channel, SMS prompt "> " is passed as ">" line
+func (m *Modem) receiver_thread() {
+	var buf [256]byte
+	var line []byte
+	var cusd string // USSD reply spanning several lines
+
+	for {
+		count, err := m.dev.Read(buf[:])
+		if err != nil || count <= 0 {
+			time.Sleep(100 * time.Millisecond)
+			continue
+		}
+
+		for _, b := range buf[:count] {
+			if b != '\n' {
+				line = append(line, b)
+				if string(line) == "> " {
+					m.lines <- ">"
+					line = line[:0]
+				}
+				continue
+			}
+			str := strings.TrimRight(string(line), "\r")
+			line = line[:0]
+
+			if cusd != "" {
+				str = cusd + "\n" + str
+				cusd = ""
+			}
+			switch {
+			case str == "":
+			case strings.HasPrefix(str, "+CUSD:"):
+				if strings.Count(str, "\"") == 1 {
+					cusd = str // reply text has line breaks
+					continue
+				}
+				select {
+				case <- m.cusd:
+				default:
+				}
+				m.cusd <- str
+			case strings.HasPrefix(str, "+CMTI:"), str == "RING":
+				// inbox is polled
+			default:
+				select {
+				case m.lines <- str:
+				default:
+					slog.Warn("response queue is full", "module", "at_modem", "line", str)
+				}
+			}
+		}
+	}
+}
+
+// Drop lines left from previous command
+func (m *Modem) flush() {
+	for {
+		select {
+		case <- m.lines:
+		default:
+			return
+		}
+	}
+}
+
+// Wait for final result of command, return intermediate lines
+func (m *Modem) result(cmd string, timeout time.Duration) ([]string, error) {
+	var resp []string
+	deadline := time.After(timeout)
+	for {
+		select {
+		case line := <- m.lines:
+			switch {
+			case line == "OK":
+				return resp, nil
+			case line == "ERROR", strings.HasPrefix(line, "+CME ERROR:"),
+			     strings.HasPrefix(line, "+CMS ERROR:"):
+				return nil, fmt.Errorf("at_modem: %s: %s", cmd, line)
+			case line == cmd:
+				// echo before ATE0
+			default:
+				resp = append(resp, line)
+			}
+		case <- deadline:
+			m.ready = false
+			return nil, fmt.Errorf("at_modem: %s: no response within %v", cmd, timeout)
+		}
+	}
+}
+
+func (m *Modem) write(data string) error {
+	_, err := m.dev.Write([]byte(data))
+	if err != nil {
+		m.ready = false
+		return fmt.Errorf("at_modem: write failed: %v", err)
+	}
+	return nil
+}
+
+// Execute command and return response lines without final result
+func (m *Modem) command(cmd string) ([]string, error) {
+	m.flush()
+	err := m.write(cmd + "\r")
+	if err != nil {
+		return nil, err
+	}
+	return m.result(cmd, m.timeout)
+}
+
+// Set up modem after start or lost communication
+func (m *Modem) init() error {
+	if m.ready {
+		return nil
+	}
+	for _, cmd := range []string{"ATE0", "AT+CMGF=1", "AT+CSCS=\"UCS2\""} {
+		_, err := m.command(cmd)
+		if err != nil {
+			return err
+		}
+	}
+	m.ready = true
+	return nil
+}
+
+// Return value of "+CMD: value" response line
+func find_response(resp []string, prefix string) (string, error) {
+	for _, line := range resp {
+		if strings.HasPrefix(line, prefix) {
+			return strings.TrimSpace(line[len(prefix):]), nil
+		}
+	}
+	return "", fmt.Errorf("at_modem: no %s in response", prefix)
+}
+
+// Submit one SMS part
+func (m *Modem) send_part(phone string, text string) error {
+	dcs := 0
+	encoding, _ := modem.Sms_encoding(text)
+	if encoding == modem.UCS2 {
+		dcs = 8
+	}
+	_, err := m.command(fmt.Sprintf("AT+CSMP=17,167,0,%d", dcs))
+	if err != nil {
+		return err
+	}
+
+	cmd := fmt.Sprintf("AT+CMGS=\"%s\"", ucs2_encode(phone))
+	m.flush()
+	err = m.write(cmd + "\r")
+	if err != nil {
+		return err
+	}
+	select {
+	case line := <- m.lines:
+		if line != ">" {
+			return fmt.Errorf("at_modem: %s: %s", cmd, line)
+		}
+	case <- time.After(m.timeout):
+		m.write(ESC)
+		m.ready = false
+		return fmt.Errorf("at_modem: %s: no prompt within %v", cmd, m.timeout)
+	}
+
+	err = m.write(ucs2_encode(text) + CTRL_Z)
+	if err != nil {
+		return err
+	}
+	resp, err := m.result(cmd, SEND_TIMEOUT)
+	if err != nil {
+		return err
+	}
+	_, err = find_response(resp, "+CMGS:")
+	return err
+}
+
+func (m *Modem) Send_sms_to(phones []string, text string) error {
+	m.Lock()
+	defer m.Unlock()
+
+	m.last_sent = modem.Sent_sms_stat{Phone: strings.Join(phones, ";"),
+	                                  TotalCount: len(phones)}
+	err := m.init()
+	if err != nil {
+		return err
+	}
+
+	var failed error
+	for i, phone := range phones {
+		m.last_sent.CurIndex = i
+		var err error
+		for _, part := range modem.Split_sms(text) {
+			err = m.send_part(phone, part)
+			if err != nil {
+				break
+			}
+		}
+		if err != nil {
+			m.last_sent.FailPhone += phone + ";"
+			failed = err
+			continue
+		}
+		m.last_sent.SucPhone += phone + ";"
+	}
+	return failed
+}
+
+// Send_sms_to waits for +CMGS reply of every part
+func (m *Modem) Sync_send() {}
+
+
+// Result of last Send_sms_to, every number is already final
+func (m *Modem) Check_sended_sms_status() (*modem.Sent_sms_stat, error) {
+	m.Lock()
+	defer m.Unlock()
+	st := m.last_sent
+	return &st, nil
+}
+
+// Convert "yy/MM/dd,hh:mm:ss+zz" to HiLink "yyyy-MM-dd hh:mm:ss"
+func convert_date(scts string) string {
+	t, err := time.Parse("06/01/02,15:04:05", strings.SplitN(scts, "+", 2)[0])
+	if err != nil {
+		t, err = time.Parse("06/01/02,15:04:05", strings.SplitN(scts, "-", 2)[0])
+	}
+	if err != nil {
+		return scts
+	}
+	return t.Format("2006-01-02 15:04:05")
+}
+
+// Return all received messages
+func (m *Modem) Check_for_new_sms() ([]modem.Sms_message, error) {
+	m.Lock()
+	defer m.Unlock()
+
+	err := m.init()
+	if err != nil {
+		return nil, err
+	}
+	resp, err := m.command("AT+CMGL=\"ALL\"")
+	if err != nil {
+		return nil, err
+	}
+
+	// +CMGL: <index>,<stat>,<oa>,[<alpha>],[<scts>] followed by text line
+	var msgs []modem.Sms_message
+	for i := 0; i < len(resp); i++ {
+		if !strings.HasPrefix(resp[i], "+CMGL:") {
+			continue
+		}
+		fields := split_fields(strings.TrimSpace(resp[i][len("+CMGL:"):]))
+		var text string
+		if i + 1 < len(resp) && !strings.HasPrefix(resp[i + 1], "+CMGL:") {
+			i++
+			text = resp[i]
+		}
+		if len(fields) < 3 || !strings.HasPrefix(fields[1], "REC ") {
+			continue // sent or unsent message
+		}
+		index, err := strconv.Atoi(fields[0])
+		if err != nil {
+			return nil, fmt.Errorf("at_modem: incorrect message index '%s'", fields[0])
+		}
+
+		msg := modem.Sms_message{Index: index,
+		                         Phone: ucs2_decode(fields[2]),
+		                         Content: ucs2_decode(text)}
+		if fields[1] == "REC READ" {
+			msg.Smstat = 1
+		}
+		if len(fields) > 4 {
+			msg.Date = convert_date(fields[4])
+		}
+		msgs = append(msgs, msg)
+	}
+	return msgs, nil
+}
+
+func (m *Modem) Remove_sms(sms_index int) error {
+	m.Lock()
+	defer m.Unlock()
+
+	err := m.init()
+	if err != nil {
+		return err
+	}
+	_, err = m.command(fmt.Sprintf("AT+CMGD=%d", sms_index))
+	return err
+}
+
+// Parse "+CUSD: <m>[,<str>,<dcs>]"
+func parse_cusd(line string) (string, error) {
+	fields := split_fields(strings.TrimSpace(line[len("+CUSD:"):]))
+	switch fields[0] {
+	case "0", "1":
+	case "2":
+		return "", fmt.Errorf("at_modem: USSD session terminated by network")
+	case "4":
+		return "", fmt.Errorf("at_modem: USSD operation is not supported")
+	default:
+		return "", fmt.Errorf("at_modem: USSD failed with status %s", fields[0])
+	}
+	if len(fields) < 2 {
+		return "", nil
+	}
+	reply := fields[1]
+	if len(fields) > 2 {
+		dcs, err := strconv.Atoi(fields[2])
+		if err == nil && dcs & 0x0c == 0x08 {
+			reply = ucs2_decode(reply)
+		}
+	}
+	return reply, nil
+}
+
+// USSD code is sent in GSM character set, reply arrives as
+// unsolicited +CUSD line
+func (m *Modem) Ussd(ctx context.Context, code string) (string, error) {
+	m.Lock()
+	defer m.Unlock()
+
+	err := m.init()
+	if err != nil {
+		return "", err
+	}
+	_, err = m.command("AT+CSCS=\"GSM\"")
+	if err != nil {
+		return "", err
+	}
+	defer m.command("AT+CSCS=\"UCS2\"")
+
+	select {
+	case <- m.cusd:
+	default:
+	}
+	_, err = m.command(fmt.Sprintf("AT+CUSD=1,\"%s\",15", code))
+	if err != nil {
+		return "", err
+	}
+
+	select {
+	case line := <- m.cusd:
+		return parse_cusd(line)
+	case <- ctx.Done():
+		m.command("AT+CUSD=2")
+		return "", fmt.Errorf("at_modem: no USSD reply: %v", ctx.Err())
+	}
+}
+
+// Signal from AT+CSQ, registration from AT+CREG? and access technology
+// from AT+COPS? in HiLink terms
+func (m *Modem) Get_global_status() (*modem.Global_status, error) {
+	m.Lock()
+	defer m.Unlock()
+
+	err := m.init()
+	if err != nil {
+		return nil, err
+	}
+	st := new(modem.Global_status)
+
+	// +CSQ: <rssi>,<ber>, rssi 0..31 or 99 if unknown
+	resp, err := m.command("AT+CSQ")
+	if err != nil {
+		return nil, err
+	}
+	value, err := find_response(resp, "+CSQ:")
+	if err != nil {
+		return nil, err
+	}
+	rssi, err := strconv.Atoi(split_fields(value)[0])
+	if err != nil {
+		return nil, fmt.Errorf("at_modem: incorrect signal quality '%s'", value)
+	}
+	if rssi <= 31 {
+		st.SignalStrength = rssi * 100 / 31
+		st.SignalIcon = (rssi + 5) / 6
+	}
+
+	// +CREG: <n>,<stat>, stat 1 is home network, 5 is roaming
+	resp, err = m.command("AT+CREG?")
+	if err != nil {
+		return nil, err
+	}
+	value, err = find_response(resp, "+CREG:")
+	if err != nil {
+		return nil, err
+	}
+	fields := split_fields(value)
+	st.ConnectionStatus = modem.DISCONNECTED
+	if len(fields) > 1 && (fields[1] == "1" || fields[1] == "5") {
+		st.ConnectionStatus = modem.CONNECTED
+	}
+	if len(fields) > 1 && fields[1] == "5" {
+		st.RoamingStatus = 1
+	}
+
+	// +COPS: <mode>,<format>,<oper>,<AcT>, not every modem reports AcT
+	resp, err = m.command("AT+COPS?")
+	if err == nil {
+		value, err = find_response(resp, "+COPS:")
+	}
+	if err == nil {
+		fields = split_fields(value)
+		st.CurrentNetworkType = modem.NETWORK_NONE
+		switch {
+		case len(fields) > 3 && fields[3] == "7":
+			st.CurrentNetworkType = modem.NETWORK_LTE
+		case len(fields) > 3 && fields[3] != "0" && fields[3] != "1" && fields[3] != "3":
+			st.CurrentNetworkType = modem.NETWORK_WCDMA
+		case len(fields) > 2:
+			st.CurrentNetworkType = modem.NETWORK_GSM
+		}
+	}
+	return st, nil
+}
+
+func (m *Modem) Get_traffic_statistics() (*modem.Traffic_statistics, error) {
+	return nil, fmt.Errorf("at_modem: traffic statistics are not supported")
+}
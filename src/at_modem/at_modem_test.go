@@ -0,0 +1,450 @@
+//go:build linux
+
+package at_modem
+
+import (
+	"conf"
+	"context"
+	"fmt"
+	"modem"
+	"os"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+	"unsafe"
+)
+
+// Handler reply which sends nothing back
+const NO_REPLY = "-"
+
+// Scripted AT device on pty master side. Handler gets every command
+// and returns raw output, empty reply means plain OK. Text of AT+CMGS
+// is passed to sms handler after prompt
+type fake_device struct {
+	sync.Mutex
+	master *os.File
+	path string
+	handler func(cmd string) string
+	sms func(phone string, text string) string
+	commands []string
+	raw string // everything received
+}
+
+func open_pty(t *testing.T) (*os.File, string) {
+	master, err := os.OpenFile("/dev/ptmx", os.O_RDWR | syscall.O_NOCTTY, 0)
+	if err != nil {
+		t.Skipf("no pty: %v", err)
+	}
+
+	conn, err := master.SyscallConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var num uint32
+	var errno syscall.Errno
+	conn.Control(func(fd uintptr) {
+		_, _, errno = syscall.Syscall(syscall.SYS_IOCTL, fd, syscall.TIOCGPTN,
+		                              uintptr(unsafe.Pointer(&num)))
+		if errno != 0 {
+			return
+		}
+		var unlock int32
+		_, _, errno = syscall.Syscall(syscall.SYS_IOCTL, fd, syscall.TIOCSPTLCK,
+		                              uintptr(unsafe.Pointer(&unlock)))
+	})
+	if errno != 0 {
+		master.Close()
+		t.Skipf("can't set up pty: %v", errno)
+	}
+	return master, fmt.Sprintf("/dev/pts/%d", num)
+}
+
+// Start fake device and modem connected to it
+func start_fake(t *testing.T, handler func(cmd string) string) (*fake_device, *Modem) {
+	d := new(fake_device)
+	d.master, d.path = open_pty(t)
+	d.handler = handler
+	t.Cleanup(func() { d.master.Close() })
+	go d.run()
+
+	m, err := New(&conf.Modem_cfg{Device: d.path, Speed: "115200", At_timeout: "500ms"})
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	t.Cleanup(func() { m.dev.Close() })
+	return d, m
+}
+
+func (d *fake_device) write(data string) {
+	d.master.Write([]byte(data))
+}
+
+func (d *fake_device) run() {
+	var buf [256]byte
+	var pending string
+	sms_phone := "" // waiting for SMS text if set
+	for {
+		n, err := d.master.Read(buf[:])
+		if err != nil {
+			return
+		}
+		d.Lock()
+		d.raw += string(buf[:n])
+		d.Unlock()
+		pending += string(buf[:n])
+
+		for {
+			if sms_phone != "" {
+				i := strings.Index(pending, CTRL_Z)
+				if i < 0 {
+					break
+				}
+				text := ucs2_decode(pending[:i])
+				pending = pending[i + 1:]
+				phone := sms_phone
+				sms_phone = ""
+				d.write(d.sms(phone, text))
+				continue
+			}
+
+			i := strings.Index(pending, "\r")
+			if i < 0 {
+				break
+			}
+			cmd := strings.TrimSpace(pending[:i])
+			pending = pending[i + 1:]
+			if cmd == "" {
+				continue
+			}
+			d.Lock()
+			d.commands = append(d.commands, cmd)
+			d.Unlock()
+
+			reply := ""
+			if d.handler != nil {
+				reply = d.handler(cmd)
+			}
+			switch {
+			case reply == NO_REPLY:
+			case reply == "" && strings.HasPrefix(cmd, "AT+CMGS="):
+				sms_phone = ucs2_decode(strings.Trim(cmd[len("AT+CMGS="):], "\""))
+				d.write("\r\n> ")
+			case reply == "":
+				d.write("\r\nOK\r\n")
+			default:
+				d.write(reply)
+			}
+		}
+	}
+}
+
+func (d *fake_device) sent_commands() []string {
+	d.Lock()
+	defer d.Unlock()
+	return append([]string(nil), d.commands...)
+}
+
+func (d *fake_device) received() string {
+	d.Lock()
+	defer d.Unlock()
+	return d.raw
+}
+
+// Final OK preceded by response lines
+func ok(lines ...string) string {
+	var b strings.Builder
+	for _, line := range lines {
+		b.WriteString("\r\n" + line + "\r\n")
+	}
+	b.WriteString("\r\nOK\r\n")
+	return b.String()
+}
+
+func has_command(cmds []string, cmd string) bool {
+	for _, c := range cmds {
+		if c == cmd {
+			return true
+		}
+	}
+	return false
+}
+
+func TestSendSms(t *testing.T) {
+	d, m := start_fake(t, nil)
+	var sent []string
+	d.sms = func(phone string, text string) string {
+		sent = append(sent, phone + "|" + text)
+		if strings.HasPrefix(phone, "+9") {
+			return "\r\n+CMS ERROR: 500\r\n"
+		}
+		return ok("+CMGS: 7")
+	}
+
+	err := m.Send_sms_to([]string{"+100", "+900"}, "Привет")
+	if err == nil || !strings.Contains(err.Error(), "+CMS ERROR: 500") {
+		t.Errorf("CMS error expected, got %v", err)
+	}
+	want := []string{"+100|Привет", "+900|Привет"}
+	if strings.Join(sent, ",") != strings.Join(want, ",") {
+		t.Errorf("sent %q, want %q", sent, want)
+	}
+	if !has_command(d.sent_commands(), "AT+CSMP=17,167,0,8") {
+		t.Errorf("UCS2 data coding is not set: %q", d.sent_commands())
+	}
+
+	st, err := m.Check_sended_sms_status()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st.SucPhone != "+100;" || st.FailPhone != "+900;" || st.TotalCount != 2 {
+		t.Errorf("unexpected send status %+v", *st)
+	}
+
+	sent = nil
+	err = m.Send_sms_to([]string{"+101"}, "hello")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sent) != 1 || sent[0] != "+101|hello" {
+		t.Errorf("sent %q", sent)
+	}
+	cmds := d.sent_commands()
+	if cmds[len(cmds) - 2] != "AT+CSMP=17,167,0,0" {
+		t.Errorf("GSM data coding is not set: %q", cmds)
+	}
+}
+
+func TestSendSmsMultipart(t *testing.T) {
+	d, m := start_fake(t, nil)
+	var sent []string
+	d.sms = func(phone string, text string) string {
+		sent = append(sent, text)
+		return ok("+CMGS: 1")
+	}
+
+	text := strings.TrimSpace(strings.Repeat("Проверка ", 12))
+	err := m.Send_sms_to([]string{"+100"}, text)
+	if err != nil {
+		t.Fatal(err)
+	}
+	parts := modem.Split_sms(text)
+	if strings.Join(sent, "|") != strings.Join(parts, "|") {
+		t.Errorf("sent %q, want %q", sent, parts)
+	}
+}
+
+func TestSendSmsRejected(t *testing.T) {
+	_, m := start_fake(t, func(cmd string) string {
+		if strings.HasPrefix(cmd, "AT+CMGS=") {
+			return "\r\nERROR\r\n"
+		}
+		return ""
+	})
+	err := m.Send_sms_to([]string{"+100"}, "hello")
+	if err == nil || !strings.Contains(err.Error(), "ERROR") {
+		t.Errorf("error expected, got %v", err)
+	}
+}
+
+func TestSendSmsNoPrompt(t *testing.T) {
+	d, m := start_fake(t, func(cmd string) string {
+		if strings.HasPrefix(cmd, "AT+CMGS=") {
+			return NO_REPLY
+		}
+		return ""
+	})
+	err := m.Send_sms_to([]string{"+100"}, "hello")
+	if err == nil || !strings.Contains(err.Error(), "no prompt") {
+		t.Fatalf("prompt timeout expected, got %v", err)
+	}
+	time.Sleep(50 * time.Millisecond)
+	if !strings.Contains(d.received(), ESC) {
+		t.Errorf("sending is not cancelled by ESC")
+	}
+
+	// modem is set up again after timeout
+	st, err := m.Check_sended_sms_status()
+	if err != nil || st.FailPhone != "+100;" {
+		t.Errorf("unexpected send status %+v, %v", st, err)
+	}
+}
+
+func TestCheckForNewSms(t *testing.T) {
+	_, m := start_fake(t, func(cmd string) string {
+		if cmd != "AT+CMGL=\"ALL\"" {
+			return ""
+		}
+		return ok(
+			"+CMGL: 1,\"REC UNREAD\",\"" + ucs2_encode("+79160000001") +
+			"\",\"\",\"26/10/19,12:30:05+12\"",
+			ucs2_encode("1234 STATUS"),
+			"+CMGL: 2,\"REC READ\",\"" + ucs2_encode("+79160000002") +
+			"\",\"\",\"26/10/18,08:00:00+12\"",
+			ucs2_encode("Привет, мир"),
+			"+CMGL: 3,\"STO SENT\",\"" + ucs2_encode("+79160000003") + "\",\"\",",
+			ucs2_encode("draft"))
+	})
+
+	msgs, err := m.Check_for_new_sms()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []modem.Sms_message{
+		{Index: 1, Smstat: 0, Phone: "+79160000001", Content: "1234 STATUS",
+		 Date: "2026-10-19 12:30:05"},
+		{Index: 2, Smstat: 1, Phone: "+79160000002", Content: "Привет, мир",
+		 Date: "2026-10-18 08:00:00"},
+	}
+	if len(msgs) != len(want) {
+		t.Fatalf("got %d messages, want %d: %+v", len(msgs), len(want), msgs)
+	}
+	for i := range want {
+		if msgs[i] != want[i] {
+			t.Errorf("message %d: got %+v, want %+v", i, msgs[i], want[i])
+		}
+	}
+}
+
+func TestCheckForNewSmsEmpty(t *testing.T) {
+	_, m := start_fake(t, nil)
+	msgs, err := m.Check_for_new_sms()
+	if err != nil || len(msgs) != 0 {
+		t.Errorf("got %+v, %v; want no messages", msgs, err)
+	}
+}
+
+// USSD reply arrives some time after OK
+func ussd_device(t *testing.T, replies map[string]string) (*fake_device, *Modem) {
+	var d *fake_device
+	d, m := start_fake(t, func(cmd string) string {
+		for code, reply := range replies {
+			if cmd == fmt.Sprintf("AT+CUSD=1,\"%s\",15", code) {
+				go func() {
+					time.Sleep(50 * time.Millisecond)
+					d.write(reply)
+				}()
+			}
+		}
+		return ""
+	})
+	return d, m
+}
+
+func TestUssd(t *testing.T) {
+	d, m := ussd_device(t, map[string]string{
+		"*100#": "\r\n+CUSD: 0,\"Balance 15.50\r\nThank you\",15\r\n",
+		"*102#": "\r\n+CUSD: 0,\"" + ucs2_encode("Баланс 1,5 р.") + "\",72\r\n",
+		"*103#": "\r\n+CUSD: 4\r\n",
+	})
+	ctx, cancel := context.WithTimeout(context.Background(), 2 * time.Second)
+	defer cancel()
+
+	reply, err := m.Ussd(ctx, "*100#")
+	if err != nil || reply != "Balance 15.50\nThank you" {
+		t.Errorf("got %q, %v", reply, err)
+	}
+	cmds := d.sent_commands()
+	if cmds[len(cmds) - 3] != "AT+CSCS=\"GSM\"" ||
+	   cmds[len(cmds) - 1] != "AT+CSCS=\"UCS2\"" {
+		t.Errorf("character set is not switched for USSD: %q", cmds)
+	}
+
+	reply, err = m.Ussd(ctx, "*102#")
+	if err != nil || reply != "Баланс 1,5 р." {
+		t.Errorf("got %q, %v", reply, err)
+	}
+
+	_, err = m.Ussd(ctx, "*103#")
+	if err == nil || !strings.Contains(err.Error(), "not supported") {
+		t.Errorf("not supported error expected, got %v", err)
+	}
+}
+
+func TestUssdTimeout(t *testing.T) {
+	d, m := ussd_device(t, nil)
+	ctx, cancel := context.WithTimeout(context.Background(), 300 * time.Millisecond)
+	defer cancel()
+
+	_, err := m.Ussd(ctx, "*100#")
+	if err == nil || !strings.Contains(err.Error(), "no USSD reply") {
+		t.Fatalf("timeout expected, got %v", err)
+	}
+	cmds := d.sent_commands()
+	if !has_command(cmds, "AT+CUSD=2") {
+		t.Errorf("USSD session is not cancelled: %q", cmds)
+	}
+	if cmds[len(cmds) - 1] != "AT+CSCS=\"UCS2\"" {
+		t.Errorf("character set is not restored: %q", cmds)
+	}
+}
+
+func TestGetGlobalStatus(t *testing.T) {
+	tests := []struct {
+		csq string
+		creg string
+		cops string
+		want modem.Global_status
+	}{
+		{"+CSQ: 18,0", "+CREG: 0,1", "+COPS: 0,0,\"MegaFon\",7",
+		 modem.Global_status{ConnectionStatus: modem.CONNECTED, SignalStrength: 58,
+		                     SignalIcon: 3, CurrentNetworkType: modem.NETWORK_LTE}},
+		{"+CSQ: 31,0", "+CREG: 0,5", "+COPS: 0,0,\"Beeline\",2",
+		 modem.Global_status{ConnectionStatus: modem.CONNECTED, SignalStrength: 100,
+		                     SignalIcon: 6, RoamingStatus: 1,
+		                     CurrentNetworkType: modem.NETWORK_WCDMA}},
+		{"+CSQ: 10,0", "+CREG: 0,1", "+COPS: 0,0,\"MTS\"",
+		 modem.Global_status{ConnectionStatus: modem.CONNECTED, SignalStrength: 32,
+		                     SignalIcon: 2, CurrentNetworkType: modem.NETWORK_GSM}},
+		{"+CSQ: 99,99", "+CREG: 0,2", "+COPS: 0",
+		 modem.Global_status{ConnectionStatus: modem.DISCONNECTED}},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		_, m := start_fake(t, func(cmd string) string {
+			switch cmd {
+			case "AT+CSQ":
+				return ok(tt.csq)
+			case "AT+CREG?":
+				return ok(tt.creg)
+			case "AT+COPS?":
+				return ok(tt.cops)
+			}
+			return ""
+		})
+		st, err := m.Get_global_status()
+		if err != nil {
+			t.Errorf("%s: %v", tt.csq, err)
+			continue
+		}
+		if *st != tt.want {
+			t.Errorf("%s %s %s: got %+v, want %+v", tt.csq, tt.creg, tt.cops,
+			         *st, tt.want)
+		}
+	}
+}
+
+func TestGetGlobalStatusError(t *testing.T) {
+	_, m := start_fake(t, func(cmd string) string {
+		if cmd == "AT+CSQ" {
+			return "\r\n+CME ERROR: 10\r\n"
+		}
+		return ""
+	})
+	_, err := m.Get_global_status()
+	if err == nil || !strings.Contains(err.Error(), "+CME ERROR: 10") {
+		t.Errorf("CME error expected, got %v", err)
+	}
+}
+
+func TestNoResponse(t *testing.T) {
+	_, m := start_fake(t, func(cmd string) string {
+		return NO_REPLY
+	})
+	_, err := m.Get_global_status()
+	if err == nil || !strings.Contains(err.Error(), "no response") {
+		t.Errorf("timeout expected, got %v", err)
+	}
+}
@@ -0,0 +1,53 @@
+package at_modem
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode/utf16"
+)
+
+// Text in UCS2 character set: hex of UTF-16 code units
+func ucs2_encode(text string) string {
+	var b strings.Builder
+	for _, unit := range utf16.Encode([]rune(text)) {
+		fmt.Fprintf(&b, "%04X", unit)
+	}
+	return b.String()
+}
+
+// Decode UCS2 hex string, string which is not hex is returned as is
+func ucs2_decode(hex string) string {
+	if hex == "" || len(hex) % 4 != 0 {
+		return hex
+	}
+	units := make([]uint16, 0, len(hex) / 4)
+	for i := 0; i < len(hex); i += 4 {
+		unit, err := strconv.ParseUint(hex[i:i + 4], 16, 16)
+		if err != nil {
+			return hex
+		}
+		units = append(units, uint16(unit))
+	}
+	return string(utf16.Decode(units))
+}
+
+// Split comma separated response values, quoted values may contain
+// commas and are returned without quotes
+func split_fields(value string) []string {
+	var fields []string
+	var field strings.Builder
+	quoted := false
+	for _, c := range value {
+		switch {
+		case c == '"':
+			quoted = !quoted
+		case c == ',' && !quoted:
+			fields = append(fields, strings.TrimSpace(field.String()))
+			field.Reset()
+		default:
+			field.WriteRune(c)
+		}
+	}
+	return append(fields, strings.TrimSpace(field.String()))
+}
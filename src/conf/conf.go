@@ -3,35 +3,296 @@ package conf
 import (
 	"fmt"
 	"io/ioutil"
-    "github.com/BurntSushi/toml"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
 )
 
 const CONFIG_FILE = "/etc/sr90_automation/usio.conf"
 
+// Control socket endpoint
+type Listener_cfg struct {
+	Name string
+	Type string // "unix", "tcp" or "systemd"
+	Path string // unix socket path
+	Mode string // unix socket file permissions, for example "0660"
+	Address string // tcp listen address "host:port"
+	Fd_name string // systemd LISTEN_FDNAMES entry
+	Tls_cert string
+	Tls_key string
+	Tls_ca string // CA for client certificates verification
+	Allow []string // allowed commands, empty or "*" means all
+	Roles map[string]string // client certificate CN -> role name
+}
+
+// Scheduled relay action
+type Job_cfg struct {
+	Name string
+	Schedule string // cron expression, "@sunrise [+-offset]" or "@sunset [+-offset]"
+	Port int
+	State int // logical state, as shown by port_list
+	Disabled bool
+	Catchup string // "skip" or "once"
+	Catchup_window string // max lateness for catch-up run, for example "2h"
+}
+
+// Reaction on input change
+type Rule_cfg struct {
+	Name string
+	Input string // input port number or name
+	State string // logical state "0", "1" or "any"
+	Debounce string // input must keep the state this long, for example "50ms"
+	Window string // time of day "22:00-06:00"
+	Conditions []string // "input <port> = <state>" or "relay <port> = <state>",
+	                    // ports by number or name, logical states
+	Actions []string // "relay_set <port> <state> [after <delay>]",
+	                 // "relay_pulse <port> <duration>", "event <name>"
+}
+
+// Input events filter settings
+type Debounce_port_cfg struct {
+	Stable string // new state must hold this long, for example "20ms"
+	Min_pulse string // ignore edges closer than this to the delivered one
+	Rate_limit string // "<count>/<period>", for example "5/1m"
+}
+
+type Debounce_cfg struct {
+	Debounce_port_cfg // default for all ports
+	Port map[string]Debounce_port_cfg
+}
+
+// Reconciliation poller
+type Poller_cfg struct {
+	Interval string // full board poll period, empty disables poller
+	Min_gap string // pause between polls and after interactive commands
+}
+
+// Relay port settings
+type Output_cfg struct {
+	Restore string // "restore", "off" or "leave" after restart
+	Safe_state *int // logical state on controlling host loss and daemon shutdown
+}
+
+// Relays which must never be switched on at the same time
+type Interlock_cfg struct {
+	Name string
+	Ports []int
+}
+
+// Board watchdog keepalive
+type Watchdog_cfg struct {
+	Enabled bool // daemon owns watchdog, clients can't control it
+	Interval string // keepalive period
+	Uart_max_silence string // board must be heard from within this time
+	Check_sink bool // automation server must be reachable
+	Disk_paths []string // directories which must be writable
+	Exec []string // probe commands, must exit with 0
+	Exec_timeout string
+}
+
+// Logging settings
+type Log_cfg struct {
+	Level string // "debug", "info", "warn" or "error"
+	Format string // "text" or "json" for stdout and stderr targets
+	Target string // "stdout", "stderr", "journald" or "syslog"
+	Tag string // journald and syslog identifier
+}
+
+// Raw UART traffic capture
+type Capture_cfg struct {
+	File string // empty disables capture
+	Max_size int64 // bytes, file is rotated when exceeded
+	Keep int // rotated files to keep
+}
+
+// Named board port
+type Port_cfg struct {
+	Module string // board name, empty means this daemon's module
+	Port int
+	Name string // for example "garage_light"
+	Direction string // "input" or "output"
+	Kind string // free form: "relay", "dry_contact", "alarm_loop"...
+	Inverted bool // active state is physical 0
+	Description string
+	Tags []string
+}
+
+// GSM modem: HiLink HTTP API or AT commands over serial port
+type Modem_cfg struct {
+	Enabled bool
+	Type string // "hilink" or "at"
+	Device string // serial port of AT modem, for example "/dev/ttyS1"
+	Speed string // serial port speed
+	At_timeout string // max wait for AT command result
+	Ip_addr string // modem web interface address, for example "192.168.8.1"
+	Poll_interval string // status and incoming SMS poll period
+	Http_timeout string // modem web API request timeout
+	Queue_size int // outgoing SMS queue length
+	Ussd_code_type string // send-ussd codeType value, HiLink expects "CodeType"
+	Ussd_timeout string // max wait for USSD reply
+	Balance_ussd string // balance request code like "*100#", empty disables check
+	Balance_interval string
+	Balance_regex string // first group or whole match is the balance
+	Balance_low float64 // "low_balance" event is raised below this value
+}
+
+// Relay control by SMS
+type Sms_control_cfg struct {
+	Enabled bool
+	Allow []string // phone numbers allowed to send commands
+	Pin string // if set, must be the first word of every command
+	Audit_file string // append-only log of SMS commands, empty to log only
+}
+
+// SMS alert rule, triggered by input port or daemon event
+type Alert_cfg struct {
+	Name string
+	Port string // input port number or name
+	State string // logical port state "0", "1" or "any"
+	Event string // "board_link_down", "board_link_up", "board_restart",
+	             // "host_lost" or "low_balance"
+	Recipients []string // names of [alerting.recipients] lists
+	Text string // template with {name}, {port}, {state}, {event}, {details} and {time}
+	Min_interval string // don't send this alert more often
+}
+
+// SMS alerts delivery
+type Alerting_cfg struct {
+	// list name -> phone numbers. Each list gets one message, next
+	// numbers are tried if delivery to previous one fails
+	Recipients map[string][]string
+	Delivery_timeout string // wait for delivery confirmation this long
+	Dedupe_window string // identical alert text is not repeated within it
+	Link_timeout string // board is considered lost after this silence
+}
+
+// Access role for TLS clients
+type Role_cfg struct {
+	Allow []string
+}
+
 type Module_io_cfg struct {
+	Module_name string // board name used in port map, for example "usio1"
 	Uart_dev string
 	Uart_speed string
 	Responce_timeout int
 	Repeate_count int
+	Inputs_count int
+	Outputs_count int
+	Cache_max_age int // ms, 0 disables port states cache
+	Relay_state_file string // desired relay states
+	Relay_restore string // default restore policy: "restore", "off" or "leave"
+	Host_timeout string // apply safe states if no commands received this long
+	Shutdown_timeout string // max wait for running commands and events delivery
 	Exec_path string
 	Exec_script string
 	Control_socket string
+	Event_url string // with %d placeholders for port and state
+	Metrics_listen string // Prometheus /metrics address, empty to disable
+	Timers_file string // pending relay timers, empty to keep in memory only
+	Timers_restore string // "restore" or "clear"
+	Latitude float64
+	Longitude float64
+	Jobs_file string // scheduler state, empty to keep in memory only
+	Job []Job_cfg
+	Rule []Rule_cfg
+	Debounce Debounce_cfg
+	Poller Poller_cfg
+	Output map[string]Output_cfg
+	Interlock []Interlock_cfg
+	Port []Port_cfg
+	Watchdog Watchdog_cfg
+	Log Log_cfg
+	Capture Capture_cfg
+	Modem Modem_cfg
+	Sms_control Sms_control_cfg
+	Alert []Alert_cfg
+	Alerting Alerting_cfg
+	Listener []Listener_cfg
+	Role map[string]Role_cfg
 }
 
-func Conf_parse() (*Module_io_cfg, error) {
-	var err error
-	var conf Module_io_cfg
-	
-	config_text, err := ioutil.ReadFile(CONFIG_FILE)
+// Return config path from -config flag, MODULE_IO_CONFIG environment
+// variable or default one. Path is made absolute, so reload finds the
+// file after daemon changes working directory to exec_path
+func Config_path(flag_path string) string {
+	path := CONFIG_FILE
+	if flag_path != "" {
+		path = flag_path
+	} else if env := os.Getenv("MODULE_IO_CONFIG"); env != "" {
+		path = env
+	}
+	abs, err := filepath.Abs(path)
 	if err != nil {
-		return nil, fmt.Errorf("Can't open config file %s: %v", CONFIG_FILE, err)
+		return path
 	}
+	return abs
+}
 
-	_, err = toml.Decode(string(config_text), &conf)
-	if err != nil {
-		return nil, fmt.Errorf("Can't decode config file %s: %v", CONFIG_FILE, err)
+// Default values of all settings
+func Defaults() Module_io_cfg {
+	return Module_io_cfg{
+		Module_name: "usio1",
+		Uart_dev: "/dev/ttyUSB0",
+		Uart_speed: "9600",
+		Responce_timeout: 250,
+		Repeate_count: 3,
+		Relay_restore: "leave",
+		Shutdown_timeout: "10s",
+		Exec_path: ".",
+		Control_socket: "/tmp/module_io_sock",
+		Event_url: "http://localhost:400/ioserver?io=usio1&port=%d&state=%d",
+		Timers_restore: "clear",
+		Poller: Poller_cfg{Min_gap: "200ms"},
+		Watchdog: Watchdog_cfg{Interval: "10s", Exec_timeout: "5s"},
+		Log: Log_cfg{Level: "info", Format: "text", Target: "stdout", Tag: "module_io"},
+		Capture: Capture_cfg{Max_size: 10 * 1024 * 1024, Keep: 5},
+		Modem: Modem_cfg{Type: "hilink",
+		                 Ip_addr: "192.168.8.1",
+		                 Speed: "115200",
+		                 At_timeout: "10s",
+		                 Poll_interval: "10s",
+		                 Http_timeout: "10s",
+		                 Queue_size: 32,
+		                 Ussd_code_type: "CodeType",
+		                 Ussd_timeout: "30s",
+		                 Balance_interval: "24h",
+		                 Balance_regex: `(-?[0-9]+(?:[.,][0-9]+)?)`},
+		Alerting: Alerting_cfg{Delivery_timeout: "2m", Dedupe_window: "10m"},
 	}
-	
-	return &conf, nil
 }
 
+// Parse config file and its drop-in directory <path>.d/*.conf merged
+// in name order. Arrays of tables from drop-ins are appended, other
+// values are overridden. All errors are reported at once
+func Conf_parse(path string) (*Module_io_cfg, error) {
+	conf := Defaults()
+	ld := new_loader()
+
+	paths := []string{path}
+	drop_ins, _ := filepath.Glob(path + ".d/*.conf")
+	sort.Strings(drop_ins)
+	paths = append(paths, drop_ins...)
+
+	for _, p := range paths {
+		config_text, err := ioutil.ReadFile(p)
+		if err != nil {
+			return nil, fmt.Errorf("Can't open config file %s: %v", p, err)
+		}
+		ld.decode(&conf_file{path: p, text: string(config_text)}, &conf)
+	}
+
+	if len(conf.Listener) == 0 {
+		conf.Listener = []Listener_cfg{{Name: "control",
+		                                Type: "unix",
+		                                Path: conf.Control_socket}}
+	}
+
+	ld.validate(&conf)
+	if len(ld.errs) > 0 {
+		return nil, fmt.Errorf("incorrect configuration:\n%s",
+		                       strings.Join(ld.errs, "\n"))
+	}
+	return &conf, nil
+}
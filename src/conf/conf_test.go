@@ -0,0 +1,151 @@
+package conf
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func write_file(t *testing.T, path string, text string) {
+	err := os.MkdirAll(filepath.Dir(path), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ioutil.WriteFile(path, []byte(text), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestConfigPath(t *testing.T) {
+	dir := t.TempDir()
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.Chdir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(wd)
+	dir, _ = os.Getwd() // temp dir may be behind symlink
+
+	t.Setenv("MODULE_IO_CONFIG", "env.conf")
+	if path := Config_path("flag.conf"); path != filepath.Join(dir, "flag.conf") {
+		t.Errorf("flag path: got %s", path)
+	}
+	if path := Config_path(""); path != filepath.Join(dir, "env.conf") {
+		t.Errorf("environment path: got %s", path)
+	}
+	t.Setenv("MODULE_IO_CONFIG", "")
+	if path := Config_path(""); path != CONFIG_FILE {
+		t.Errorf("default path: got %s", path)
+	}
+}
+
+func TestDefaultsValid(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "usio.conf")
+	write_file(t, path, "")
+	cfg, err := Conf_parse(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Uart_speed != "9600" || len(cfg.Listener) != 1 ||
+	   cfg.Listener[0].Path != cfg.Control_socket {
+		t.Errorf("unexpected defaults %+v", cfg)
+	}
+}
+
+func TestDropIns(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "usio.conf")
+	write_file(t, path, `
+uart_speed = "9600"
+module_name = "main"
+
+[[rule]]
+name = "main"
+input = "1"
+actions = ["event main"]
+`)
+	write_file(t, path + ".d/20-speed.conf", `uart_speed = "115200"`)
+	write_file(t, path + ".d/10-rule.conf", `
+uart_speed = "19200"
+
+[[rule]]
+name = "drop-in"
+input = "door"
+actions = ["event door"]
+`)
+	write_file(t, path + ".d/30-ignored.conf.bak", `uart_speed = "bad"`)
+
+	cfg, err := Conf_parse(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Uart_speed != "115200" || cfg.Module_name != "main" {
+		t.Errorf("drop-ins are not applied in name order: %+v", cfg)
+	}
+	if len(cfg.Rule) != 2 || cfg.Rule[0].Name != "main" || cfg.Rule[1].Name != "drop-in" {
+		t.Errorf("rules are not appended: %+v", cfg.Rule)
+	}
+}
+
+func TestErrors(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "usio.conf")
+	write_file(t, path, `
+uart_speed = "fast"
+relay_restore = "maybe"
+`)
+	write_file(t, path + ".d/10-rule.conf", `
+[[rule]]
+name = "broken"
+debounce = "long"
+actions = ["event x"]
+`)
+
+	_, err := Conf_parse(path)
+	if err == nil {
+		t.Fatal("error expected")
+	}
+	// all errors are reported with file and line
+	for _, want := range []string{
+		path + ":2: uart_speed: 'fast' is not a positive number",
+		path + ":3: relay_restore:",
+		path + ".d/10-rule.conf: rule[1].input: must be set",
+		path + ".d/10-rule.conf:4: rule[1].debounce:",
+	} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("%q is not reported:\n%v", want, err)
+		}
+	}
+}
+
+func TestValidation(t *testing.T) {
+	for _, text := range []string{
+		`inputs_count = -1`,
+		`event_url = "http://localhost/"`,
+		`latitude = 91.0`,
+		`log.level = "loud"`,
+		"[poller]\ninterval = \"often\"",
+		"[output.1]\nsafe_state = 2",
+		"[debounce.port.x]\nstable = \"1ms\"",
+		"[[listener]]\nname = \"tcp\"\ntype = \"tcp\"",
+		"[[rule]]\ninput = \"1\"",
+	} {
+		path := filepath.Join(t.TempDir(), "usio.conf")
+		write_file(t, path, text)
+		_, err := Conf_parse(path)
+		if err == nil {
+			t.Errorf("%q: error expected", text)
+		}
+	}
+}
+
+func TestMissingFile(t *testing.T) {
+	_, err := Conf_parse(filepath.Join(t.TempDir(), "none.conf"))
+	if err == nil {
+		t.Error("error expected")
+	}
+}
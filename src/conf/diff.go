@@ -0,0 +1,32 @@
+package conf
+
+import (
+	"reflect"
+	"strings"
+)
+
+// Return names of top level settings which differ
+func Diff(old *Module_io_cfg, cur *Module_io_cfg) []string {
+	var keys []string
+	ov := reflect.ValueOf(old).Elem()
+	cv := reflect.ValueOf(cur).Elem()
+	for i := 0; i < ov.NumField(); i++ {
+		if !reflect.DeepEqual(ov.Field(i).Interface(), cv.Field(i).Interface()) {
+			keys = append(keys, strings.ToLower(ov.Type().Field(i).Name))
+		}
+	}
+	return keys
+}
+
+// Copy top level settings named by keys from src to dst
+func Copy_keys(dst *Module_io_cfg, src *Module_io_cfg, keys []string) {
+	dv := reflect.ValueOf(dst).Elem()
+	sv := reflect.ValueOf(src).Elem()
+	for _, key := range keys {
+		for i := 0; i < dv.NumField(); i++ {
+			if strings.ToLower(dv.Type().Field(i).Name) == key {
+				dv.Field(i).Set(sv.Field(i))
+			}
+		}
+	}
+}
@@ -0,0 +1,534 @@
+package conf
+
+import (
+	"fmt"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+    "github.com/BurntSushi/toml"
+)
+
+type conf_file struct {
+	path string
+	text string
+}
+
+// Source of array of tables element
+type origin struct {
+	file *conf_file
+	index int // element index inside file
+}
+
+// Layered config decoder collecting errors with their locations
+type loader struct {
+	key_file map[string]*conf_file // dotted key -> last file defining it
+	origins map[string][]origin // array of tables -> elements sources
+	errs []string
+}
+
+func new_loader() *loader {
+	ld := new(loader)
+	ld.key_file = make(map[string]*conf_file)
+	ld.origins = make(map[string][]origin)
+	return ld
+}
+
+var decode_err_re = regexp.MustCompile(`^Near line (\d+) \(last key parsed '(.*)'\): (.*)$`)
+
+func (ld *loader) decode(f *conf_file, conf *Module_io_cfg) {
+	// arrays of tables are decoded separately to append them
+	v := reflect.ValueOf(conf).Elem()
+	saved := make(map[int]reflect.Value)
+	for i := 0; i < v.NumField(); i++ {
+		fld := v.Field(i)
+		if fld.Kind() != reflect.Slice || fld.Type().Elem().Kind() != reflect.Struct {
+			continue
+		}
+		saved[i] = reflect.ValueOf(fld.Interface())
+		fld.Set(reflect.Zero(fld.Type()))
+	}
+
+	md, err := toml.Decode(f.text, conf)
+
+	for i, prev := range saved {
+		fld := v.Field(i)
+		if err == nil {
+			key := strings.ToLower(v.Type().Field(i).Name)
+			for j := 0; j < fld.Len(); j++ {
+				ld.origins[key] = append(ld.origins[key], origin{f, j})
+			}
+			fld.Set(reflect.AppendSlice(prev, fld))
+		} else {
+			fld.Set(prev)
+		}
+	}
+
+	if err != nil {
+		m := decode_err_re.FindStringSubmatch(err.Error())
+		if m != nil {
+			ld.errs = append(ld.errs, fmt.Sprintf("%s:%s: %s", f.path, m[1], m[3]))
+		} else {
+			ld.errs = append(ld.errs, fmt.Sprintf("%s: %v", f.path, err))
+		}
+		return
+	}
+
+	for _, key := range md.Keys() {
+		ld.key_file[strings.ToLower(key.String())] = f
+	}
+	for _, key := range md.Undecoded() {
+		ld.error_at(f, []string(key), "unknown key '%s'", key.String())
+	}
+}
+
+// Split dotted TOML key, quotes are removed
+func split_key(key string) []string {
+	var segs []string
+	for _, seg := range strings.Split(key, ".") {
+		segs = append(segs, strings.ToLower(strings.Trim(strings.TrimSpace(seg), "\"'")))
+	}
+	return segs
+}
+
+// Compare full key path with requested one. Array element
+// segments "#N" of full path are skipped if request has no index
+func match_key(full []string, path []string) bool {
+	i := 0
+	for _, seg := range full {
+		if i < len(path) && seg == path[i] {
+			i++
+			continue
+		}
+		if strings.HasPrefix(seg, "#") && (i >= len(path) || !strings.HasPrefix(path[i], "#")) {
+			continue
+		}
+		return false
+	}
+	return i == len(path)
+}
+
+// Find line where key is defined, 0 if not found
+func (f *conf_file) find_line(path []string) int {
+	var table []string
+	counters := make(map[string]int)
+
+	for i, line := range strings.Split(f.text, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || line[0] == '#' {
+			continue
+		}
+
+		if strings.HasPrefix(line, "[[") {
+			end := strings.Index(line, "]]")
+			if end < 0 {
+				continue
+			}
+			name := strings.TrimSpace(line[2:end])
+			table = append(split_key(name), fmt.Sprintf("#%d", counters[name]))
+			counters[name]++
+			if match_key(table, path) {
+				return i + 1
+			}
+			continue
+		}
+
+		if line[0] == '[' {
+			end := strings.Index(line, "]")
+			if end < 0 {
+				continue
+			}
+			table = split_key(line[1:end])
+			if match_key(table, path) {
+				return i + 1
+			}
+			continue
+		}
+
+		eq := strings.Index(line, "=")
+		if eq < 0 {
+			continue
+		}
+		full := append(append([]string(nil), table...), split_key(line[:eq])...)
+		if match_key(full, path) {
+			return i + 1
+		}
+	}
+	return 0
+}
+
+func (ld *loader) error_at(f *conf_file, path []string, format string, args ...interface{}) {
+	msg := fmt.Sprintf(format, args...)
+	switch {
+	case f == nil:
+		ld.errs = append(ld.errs, msg)
+	case f.find_line(path) > 0:
+		ld.errs = append(ld.errs, fmt.Sprintf("%s:%d: %s", f.path, f.find_line(path), msg))
+	default:
+		ld.errs = append(ld.errs, fmt.Sprintf("%s: %s", f.path, msg))
+	}
+}
+
+// Report error of key like "poller.interval"
+func (ld *loader) errorf(key string, format string, args ...interface{}) {
+	path := split_key(key)
+	ld.error_at(ld.key_file[key], path, "%s: " + format,
+	            append([]interface{}{key}, args...)...)
+}
+
+// Report error of array of tables element field like rule[2].debounce
+func (ld *loader) elem_errorf(array string, index int, field string,
+                              format string, args ...interface{}) {
+	key := fmt.Sprintf("%s[%d]", array, index + 1)
+	if field != "" {
+		key += "." + field
+	}
+
+	origins := ld.origins[array]
+	if index >= len(origins) {
+		ld.error_at(nil, nil, "%s: " + format, append([]interface{}{key}, args...)...)
+		return
+	}
+
+	o := origins[index]
+	path := []string{array, fmt.Sprintf("#%d", o.index)}
+	if field != "" {
+		path = append(path, field)
+	}
+	ld.error_at(o.file, path, "%s: " + format, append([]interface{}{key}, args...)...)
+}
+
+func check_duration(value string) error {
+	if value == "" {
+		return nil
+	}
+	_, err := time.ParseDuration(value)
+	return err
+}
+
+func check_enum(value string, allowed ...string) error {
+	for _, a := range allowed {
+		if value == a {
+			return nil
+		}
+	}
+	return fmt.Errorf("'%s' is not one of %s", value, strings.Join(allowed, ", "))
+}
+
+func (ld *loader) check(key string, err error) {
+	if err != nil {
+		ld.errorf(key, "%v", err)
+	}
+}
+
+func (ld *loader) check_elem(array string, index int, field string, err error) {
+	if err != nil {
+		ld.elem_errorf(array, index, field, "%v", err)
+	}
+}
+
+func (ld *loader) check_port(key string, port int, count int) {
+	if port < 1 || (count > 0 && port > count) {
+		ld.errorf(key, "port %d is out of range", port)
+	}
+}
+
+func (ld *loader) validate(c *Module_io_cfg) {
+	if c.Uart_dev == "" {
+		ld.errorf("uart_dev", "must be set")
+	}
+	speed, err := strconv.Atoi(c.Uart_speed)
+	if err != nil || speed <= 0 {
+		ld.errorf("uart_speed", "'%s' is not a positive number", c.Uart_speed)
+	}
+	if c.Responce_timeout <= 0 {
+		ld.errorf("responce_timeout", "must be positive")
+	}
+	if c.Repeate_count <= 0 {
+		ld.errorf("repeate_count", "must be positive")
+	}
+	if c.Inputs_count < 0 {
+		ld.errorf("inputs_count", "must not be negative")
+	}
+	if c.Outputs_count < 0 {
+		ld.errorf("outputs_count", "must not be negative")
+	}
+	if c.Cache_max_age < 0 {
+		ld.errorf("cache_max_age", "must not be negative")
+	}
+	if !strings.Contains(c.Event_url, "%d") {
+		ld.errorf("event_url", "must contain %%d placeholders for port and state")
+	}
+
+	ld.check("relay_restore", check_enum(c.Relay_restore, "restore", "off", "leave"))
+	ld.check("timers_restore", check_enum(c.Timers_restore, "restore", "clear"))
+	ld.check("host_timeout", check_duration(c.Host_timeout))
+	ld.check("shutdown_timeout", check_duration(c.Shutdown_timeout))
+	ld.check("poller.interval", check_duration(c.Poller.Interval))
+	ld.check("poller.min_gap", check_duration(c.Poller.Min_gap))
+	ld.check("watchdog.interval", check_duration(c.Watchdog.Interval))
+	ld.check("watchdog.uart_max_silence", check_duration(c.Watchdog.Uart_max_silence))
+	ld.check("watchdog.exec_timeout", check_duration(c.Watchdog.Exec_timeout))
+	ld.check("log.level", check_enum(strings.ToLower(c.Log.Level),
+	                                 "debug", "info", "warn", "warning", "error"))
+	ld.check("log.format", check_enum(c.Log.Format, "text", "json"))
+	ld.check("log.target", check_enum(c.Log.Target, "stdout", "stderr", "journald", "syslog"))
+	if c.Capture.Max_size < 0 || c.Capture.Keep < 0 {
+		ld.errorf("capture", "max_size and keep must not be negative")
+	}
+	if c.Latitude < -90 || c.Latitude > 90 {
+		ld.errorf("latitude", "must be in range -90..90")
+	}
+	if c.Longitude < -180 || c.Longitude > 180 {
+		ld.errorf("longitude", "must be in range -180..180")
+	}
+
+	ld.validate_debounce("debounce", &c.Debounce.Debounce_port_cfg)
+	for port_str, pcfg := range c.Debounce.Port {
+		key := "debounce.port." + port_str
+		port, err := strconv.Atoi(port_str)
+		if err != nil {
+			ld.errorf(key, "port must be a number")
+			continue
+		}
+		ld.check_port(key, port, c.Inputs_count)
+		pcfg := pcfg
+		ld.validate_debounce(key, &pcfg)
+	}
+
+	for port_str, ocfg := range c.Output {
+		key := "output." + port_str
+		port, err := strconv.Atoi(port_str)
+		if err != nil {
+			ld.errorf(key, "port must be a number")
+			continue
+		}
+		ld.check_port(key, port, c.Outputs_count)
+		if ocfg.Restore != "" {
+			ld.check(key + ".restore", check_enum(ocfg.Restore, "restore", "off", "leave"))
+		}
+		if ocfg.Safe_state != nil && *ocfg.Safe_state != 0 && *ocfg.Safe_state != 1 {
+			ld.errorf(key + ".safe_state", "must be 0 or 1")
+		}
+	}
+
+	for i, il := range c.Interlock {
+		if len(il.Ports) < 2 {
+			ld.elem_errorf("interlock", i, "ports", "at least 2 ports required")
+		}
+		for _, port := range il.Ports {
+			if port < 1 || (c.Outputs_count > 0 && port > c.Outputs_count) {
+				ld.elem_errorf("interlock", i, "ports", "port %d is out of range", port)
+			}
+		}
+	}
+
+	ld.validate_ports(c)
+	ld.validate_alerts(c)
+
+	ld.check("modem.poll_interval", check_duration(c.Modem.Poll_interval))
+	ld.check("modem.http_timeout", check_duration(c.Modem.Http_timeout))
+	ld.check("modem.ussd_timeout", check_duration(c.Modem.Ussd_timeout))
+	ld.check("modem.balance_interval", check_duration(c.Modem.Balance_interval))
+	_, err = regexp.Compile(c.Modem.Balance_regex)
+	if err != nil {
+		ld.errorf("modem.balance_regex", "%v", err)
+	}
+	ld.check("modem.type", check_enum(c.Modem.Type, "hilink", "at"))
+	ld.check("modem.at_timeout", check_duration(c.Modem.At_timeout))
+	if c.Modem.Enabled && c.Modem.Type == "hilink" && c.Modem.Ip_addr == "" {
+		ld.errorf("modem.ip_addr", "must be set")
+	}
+	if c.Modem.Enabled && c.Modem.Type == "at" {
+		if c.Modem.Device == "" {
+			ld.errorf("modem.device", "must be set")
+		}
+		speed, err := strconv.Atoi(c.Modem.Speed)
+		if err != nil || speed <= 0 {
+			ld.errorf("modem.speed", "'%s' is not a positive number", c.Modem.Speed)
+		}
+	}
+	if c.Modem.Queue_size <= 0 {
+		ld.errorf("modem.queue_size", "must be positive")
+	}
+	if c.Sms_control.Enabled && !c.Modem.Enabled {
+		ld.errorf("sms_control.enabled", "modem must be enabled")
+	}
+	if c.Sms_control.Enabled && len(c.Sms_control.Allow) == 0 {
+		ld.errorf("sms_control.allow", "at least one phone number required")
+	}
+	if strings.ContainsAny(c.Sms_control.Pin, " \t") {
+		ld.errorf("sms_control.pin", "must not contain spaces")
+	}
+
+	names := make(map[string]bool)
+	for i, job := range c.Job {
+		if job.Name == "" || names[job.Name] {
+			ld.elem_errorf("job", i, "name", "name must be set and unique")
+		}
+		names[job.Name] = true
+		if job.Schedule == "" {
+			ld.elem_errorf("job", i, "schedule", "must be set")
+		}
+		if job.Catchup != "" {
+			ld.check_elem("job", i, "catchup", check_enum(job.Catchup, "skip", "once"))
+		}
+		ld.check_elem("job", i, "catchup_window", check_duration(job.Catchup_window))
+	}
+
+	for i, rule := range c.Rule {
+		if rule.Input == "" {
+			ld.elem_errorf("rule", i, "input", "must be set")
+		}
+		if rule.State != "" {
+			ld.check_elem("rule", i, "state", check_enum(rule.State, "0", "1", "any"))
+		}
+		ld.check_elem("rule", i, "debounce", check_duration(rule.Debounce))
+		if len(rule.Actions) == 0 {
+			ld.elem_errorf("rule", i, "actions", "at least one action required")
+		}
+	}
+
+	for i, lcfg := range c.Listener {
+		switch lcfg.Type {
+		case "unix":
+			if lcfg.Path == "" {
+				ld.elem_errorf("listener", i, "path", "must be set for unix listener")
+			}
+			if lcfg.Mode != "" {
+				_, err := strconv.ParseUint(lcfg.Mode, 8, 32)
+				if err != nil {
+					ld.elem_errorf("listener", i, "mode", "'%s' is not octal", lcfg.Mode)
+				}
+			}
+		case "tcp":
+			if lcfg.Address == "" {
+				ld.elem_errorf("listener", i, "address", "must be set for tcp listener")
+			}
+			if lcfg.Tls_cert == "" || lcfg.Tls_key == "" || lcfg.Tls_ca == "" {
+				ld.elem_errorf("listener", i, "", "tcp listener requires " +
+				               "tls_cert, tls_key and tls_ca")
+			}
+		case "systemd":
+			if lcfg.Fd_name == "" {
+				ld.elem_errorf("listener", i, "fd_name", "must be set for systemd listener")
+			}
+		default:
+			ld.elem_errorf("listener", i, "type", "unknown type '%s'", lcfg.Type)
+		}
+		for cn, role := range lcfg.Roles {
+			if _, ok := c.Role[role]; !ok {
+				ld.elem_errorf("listener", i, "roles", "unknown role '%s' for '%s'", role, cn)
+			}
+		}
+	}
+}
+
+func (ld *loader) validate_ports(c *Module_io_cfg) {
+	names := make(map[string]bool)
+	ports := make(map[string]bool)
+	for i, pcfg := range c.Port {
+		module := pcfg.Module
+		if module == "" {
+			module = c.Module_name
+		}
+
+		count := 0
+		switch pcfg.Direction {
+		case "input":
+			count = c.Inputs_count
+		case "output":
+			count = c.Outputs_count
+		default:
+			ld.elem_errorf("port", i, "direction", "'%s' is not one of input, output",
+			               pcfg.Direction)
+		}
+		if module == c.Module_name && (pcfg.Port < 1 || (count > 0 && pcfg.Port > count)) {
+			ld.elem_errorf("port", i, "port", "port %d is out of range", pcfg.Port)
+		}
+
+		key := fmt.Sprintf("%s/%s/%d", module, pcfg.Direction, pcfg.Port)
+		if ports[key] {
+			ld.elem_errorf("port", i, "port", "%s port %d is already described",
+			               pcfg.Direction, pcfg.Port)
+		}
+		ports[key] = true
+
+		_, err := strconv.Atoi(pcfg.Name)
+		if pcfg.Name == "" || err == nil || strings.ContainsAny(pcfg.Name, " :\t") {
+			ld.elem_errorf("port", i, "name", "'%s' must be non numeric word", pcfg.Name)
+		}
+		if names[module + "/" + pcfg.Name] {
+			ld.elem_errorf("port", i, "name", "name '%s' is not unique", pcfg.Name)
+		}
+		names[module + "/" + pcfg.Name] = true
+	}
+}
+
+func (ld *loader) validate_alerts(c *Module_io_cfg) {
+	ld.check("alerting.delivery_timeout", check_duration(c.Alerting.Delivery_timeout))
+	ld.check("alerting.dedupe_window", check_duration(c.Alerting.Dedupe_window))
+	ld.check("alerting.link_timeout", check_duration(c.Alerting.Link_timeout))
+	if c.Alerting.Link_timeout != "" && c.Poller.Interval == "" && !c.Watchdog.Enabled {
+		ld.errorf("alerting.link_timeout", "board is silent without poller or watchdog, " +
+		          "set poller.interval or enable watchdog")
+	}
+	for list, phones := range c.Alerting.Recipients {
+		if len(phones) == 0 {
+			ld.errorf("alerting.recipients." + list, "at least one phone number required")
+		}
+	}
+
+	if len(c.Alert) > 0 && !c.Modem.Enabled {
+		ld.elem_errorf("alert", 0, "", "modem must be enabled")
+	}
+	names := make(map[string]bool)
+	for i, acfg := range c.Alert {
+		if acfg.Name == "" || names[acfg.Name] {
+			ld.elem_errorf("alert", i, "name", "name must be set and unique")
+		}
+		names[acfg.Name] = true
+
+		if (acfg.Port == "") == (acfg.Event == "") {
+			ld.elem_errorf("alert", i, "", "either port or event must be set")
+		}
+		if acfg.State != "" {
+			ld.check_elem("alert", i, "state", check_enum(acfg.State, "0", "1", "any"))
+		}
+		if acfg.Event != "" {
+			ld.check_elem("alert", i, "event",
+			              check_enum(acfg.Event, "board_link_down", "board_link_up",
+			                         "board_restart", "host_lost", "low_balance"))
+		}
+		if strings.HasPrefix(acfg.Event, "board_link_") && c.Alerting.Link_timeout == "" {
+			ld.elem_errorf("alert", i, "event", "alerting.link_timeout must be set")
+		}
+		ld.check_elem("alert", i, "min_interval", check_duration(acfg.Min_interval))
+
+		if len(acfg.Recipients) == 0 {
+			ld.elem_errorf("alert", i, "recipients", "at least one list required")
+		}
+		for _, list := range acfg.Recipients {
+			if _, ok := c.Alerting.Recipients[list]; !ok {
+				ld.elem_errorf("alert", i, "recipients", "unknown list '%s'", list)
+			}
+		}
+	}
+}
+
+func (ld *loader) validate_debounce(key string, pcfg *Debounce_port_cfg) {
+	ld.check(key + ".stable", check_duration(pcfg.Stable))
+	ld.check(key + ".min_pulse", check_duration(pcfg.Min_pulse))
+	if pcfg.Rate_limit != "" {
+		var count int
+		var period string
+		_, err := fmt.Sscanf(pcfg.Rate_limit, "%d/%s", &count, &period)
+		if err == nil {
+			err = check_duration(period)
+		}
+		if err != nil || count <= 0 {
+			ld.errorf(key + ".rate_limit", "'%s' is not '<count>/<period>'", pcfg.Rate_limit)
+		}
+	}
+}
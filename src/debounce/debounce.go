@@ -0,0 +1,287 @@
+package debounce
+
+import (
+	"conf"
+	"fmt"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Input filter settings
+type settings struct {
+	stable time.Duration // new state must hold this long before delivery
+	min_pulse time.Duration // edges closer than this to delivered one are ignored
+	rate_count int // max events per rate_period, 0 means no limit
+	rate_period time.Duration
+}
+
+// Input filter counters
+type Port_stats struct {
+	Port int
+	State int // last delivered state
+	Raw int // total raw transitions
+	Delivered int
+	Suppressed int
+}
+
+type port_filter struct {
+	Port_stats
+	delivered_ever bool
+	raw_state int
+	last_delivered time.Time
+	sent []time.Time // delivery times inside rate period
+	timer *time.Timer
+	gen int // changed when timer is armed or stopped
+}
+
+// Filtered change waiting for delivery
+type change struct {
+	port int
+	state int
+}
+
+// Function receiving filtered input changes
+type Deliver func(port int, state int)
+
+type Debounce struct {
+	sync.Mutex
+	deliver Deliver
+	def settings
+	ports_cfg map[int]settings
+	ports map[int]*port_filter
+	queue []change // filtered changes to deliver
+	delivering bool // queue is being passed to deliver
+}
+
+func New(dcfg *conf.Debounce_cfg, deliver Deliver) (*Debounce, error) {
+	d := new(Debounce)
+	d.deliver = deliver
+	d.ports = make(map[int]*port_filter)
+	err := d.Reload(dcfg)
+	if err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+func parse_settings(pcfg *conf.Debounce_port_cfg) (settings, error) {
+	var st settings
+	var err error
+
+	if pcfg.Stable != "" {
+		st.stable, err = time.ParseDuration(pcfg.Stable)
+		if err != nil {
+			return st, fmt.Errorf("incorrect stable: %v", err)
+		}
+	}
+
+	if pcfg.Min_pulse != "" {
+		st.min_pulse, err = time.ParseDuration(pcfg.Min_pulse)
+		if err != nil {
+			return st, fmt.Errorf("incorrect min_pulse: %v", err)
+		}
+	}
+
+	if pcfg.Rate_limit != "" {
+		// "<count>/<period>", for example "5/1m"
+		var period string
+		_, err = fmt.Sscanf(pcfg.Rate_limit, "%d/%s", &st.rate_count, &period)
+		if err == nil {
+			st.rate_period, err = time.ParseDuration(period)
+		}
+		if err != nil || st.rate_count <= 0 {
+			return st, fmt.Errorf("incorrect rate_limit '%s'", pcfg.Rate_limit)
+		}
+	}
+	return st, nil
+}
+
+// Apply new settings, counters are kept
+func (d *Debounce) Reload(dcfg *conf.Debounce_cfg) error {
+	def, err := parse_settings(&dcfg.Debounce_port_cfg)
+	if err != nil {
+		return fmt.Errorf("debounce: %v", err)
+	}
+
+	ports_cfg := make(map[int]settings)
+	for port_str, pcfg := range dcfg.Port {
+		port, err := strconv.Atoi(port_str)
+		if err != nil {
+			return fmt.Errorf("debounce: incorrect port '%s'", port_str)
+		}
+		pcfg := pcfg
+		ports_cfg[port], err = parse_settings(&pcfg)
+		if err != nil {
+			return fmt.Errorf("debounce: port %d: %v", port, err)
+		}
+	}
+
+	d.Lock()
+	d.def = def
+	d.ports_cfg = ports_cfg
+	d.Unlock()
+	return nil
+}
+
+func (d *Debounce) settings(port int) settings {
+	st, ok := d.ports_cfg[port]
+	if !ok {
+		return d.def
+	}
+	return st
+}
+
+// Handle raw input change from board
+func (d *Debounce) Input(port int, state int) {
+	d.Lock()
+	d.input_locked(port, state)
+	d.Unlock()
+	d.flush()
+}
+
+// Must be called with lock held
+func (d *Debounce) input_locked(port int, state int) {
+	f, ok := d.ports[port]
+	if !ok {
+		f = &port_filter{}
+		f.Port = port
+		d.ports[port] = f
+	}
+	f.Raw++
+	f.raw_state = state
+
+	if f.timer != nil {
+		// pending transition is replaced by this one
+		f.stop_timer()
+		f.Suppressed++
+	}
+
+	if f.delivered_ever && state == f.State {
+		// state returned back before it was delivered
+		return
+	}
+
+	st := d.settings(port)
+	wait := st.stable
+
+	if st.min_pulse > 0 && f.delivered_ever {
+		lockout := time.Until(f.last_delivered.Add(st.min_pulse))
+		if lockout > wait {
+			wait = lockout
+		}
+	}
+
+	if st.rate_count > 0 {
+		now := time.Now()
+		for len(f.sent) > 0 && now.Sub(f.sent[0]) >= st.rate_period {
+			f.sent = f.sent[1:]
+		}
+		if len(f.sent) >= st.rate_count {
+			free := time.Until(f.sent[0].Add(st.rate_period))
+			if free > wait {
+				wait = free
+			}
+		}
+	}
+
+	if wait <= 0 {
+		d.queue_locked(f, st)
+		return
+	}
+
+	f.gen++
+	gen := f.gen
+	f.timer = time.AfterFunc(wait, func() {
+		d.Lock()
+		if f.gen != gen {
+			// stopped or replaced after callback was started
+			d.Unlock()
+			return
+		}
+		f.timer = nil
+		if !f.delivered_ever || f.raw_state != f.State {
+			d.queue_locked(f, d.settings(f.Port))
+		}
+		d.Unlock()
+		d.flush()
+	})
+}
+
+// Must be called with lock held
+func (f *port_filter) stop_timer() {
+	f.timer.Stop()
+	f.timer = nil
+	f.gen++
+}
+
+// Set port state known from other source without delivery
+func (d *Debounce) Reconcile(port int, state int) {
+	d.Lock()
+	defer d.Unlock()
+
+	f, ok := d.ports[port]
+	if !ok {
+		f = &port_filter{}
+		f.Port = port
+		d.ports[port] = f
+	}
+	if f.timer != nil {
+		f.stop_timer()
+	}
+	f.raw_state = state
+	f.State = state
+	f.delivered_ever = true
+}
+
+// Queue current raw state for delivery. Must be called with lock held
+func (d *Debounce) queue_locked(f *port_filter, st settings) {
+	now := time.Now()
+	f.State = f.raw_state
+	f.delivered_ever = true
+	f.last_delivered = now
+	f.Delivered++
+	if st.rate_count > 0 {
+		f.sent = append(f.sent, now)
+		if len(f.sent) > st.rate_count {
+			f.sent = f.sent[1:]
+		}
+	}
+	d.queue = append(d.queue, change{f.Port, f.State})
+}
+
+// Pass queued changes to deliver without lock held, so deliver may call
+// back filter. Only one caller delivers at a time to keep events order,
+// changes queued meanwhile are passed by that caller
+func (d *Debounce) flush() {
+	d.Lock()
+	defer d.Unlock()
+	if d.delivering {
+		return
+	}
+	d.delivering = true
+	for len(d.queue) > 0 {
+		ch := d.queue[0]
+		d.queue = d.queue[1:]
+		d.Unlock()
+		d.deliver(ch.port, ch.state)
+		d.Lock()
+	}
+	d.delivering = false
+}
+
+// Return filter counters for all ports seen
+func (d *Debounce) Stats() []Port_stats {
+	d.Lock()
+	defer d.Unlock()
+
+	var list []Port_stats
+	for _, f := range d.ports {
+		list = append(list, f.Port_stats)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Port < list[j].Port
+	})
+	return list
+}
@@ -0,0 +1,200 @@
+package debounce
+
+import (
+	"conf"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Delivered changes collector
+type recorder struct {
+	sync.Mutex
+	list []string
+}
+
+func (r *recorder) deliver(port int, state int) {
+	r.Lock()
+	defer r.Unlock()
+	r.list = append(r.list, fmt.Sprintf("%d=%d", port, state))
+}
+
+func (r *recorder) got() string {
+	r.Lock()
+	defer r.Unlock()
+	return fmt.Sprint(r.list)
+}
+
+func start(t *testing.T, dcfg *conf.Debounce_cfg) (*Debounce, *recorder) {
+	r := new(recorder)
+	d, err := New(dcfg, r.deliver)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return d, r
+}
+
+func TestParseErrors(t *testing.T) {
+	for _, dcfg := range []conf.Debounce_cfg{
+		{Debounce_port_cfg: conf.Debounce_port_cfg{Stable: "fast"}},
+		{Debounce_port_cfg: conf.Debounce_port_cfg{Min_pulse: "1"}},
+		{Debounce_port_cfg: conf.Debounce_port_cfg{Rate_limit: "5"}},
+		{Debounce_port_cfg: conf.Debounce_port_cfg{Rate_limit: "0/1m"}},
+		{Debounce_port_cfg: conf.Debounce_port_cfg{Rate_limit: "5/minute"}},
+		{Port: map[string]conf.Debounce_port_cfg{"x": {}}},
+		{Port: map[string]conf.Debounce_port_cfg{"3": {Stable: "-"}}},
+	} {
+		if _, err := New(&dcfg, nil); err == nil {
+			t.Errorf("%+v: error expected", dcfg)
+		}
+	}
+}
+
+func TestNoFilter(t *testing.T) {
+	d, r := start(t, &conf.Debounce_cfg{})
+	d.Input(1, 1)
+	d.Input(1, 1)
+	d.Input(1, 0)
+	if r.got() != "[1=1 1=0]" {
+		t.Errorf("got %s", r.got())
+	}
+}
+
+func TestStable(t *testing.T) {
+	d, r := start(t, &conf.Debounce_cfg{
+		Debounce_port_cfg: conf.Debounce_port_cfg{Stable: "50ms"},
+		Port: map[string]conf.Debounce_port_cfg{"2": {}},
+	})
+
+	d.Input(2, 1) // port without filter
+	d.Input(1, 1)
+	d.Input(1, 0) // bounce returns to unknown state, 0 is pending
+	time.Sleep(20 * time.Millisecond)
+	d.Input(1, 1)
+	if r.got() != "[2=1]" {
+		t.Fatalf("bounces are delivered: %s", r.got())
+	}
+	time.Sleep(100 * time.Millisecond)
+	if r.got() != "[2=1 1=1]" {
+		t.Fatalf("stable state is not delivered: %s", r.got())
+	}
+
+	// short pulse back to delivered state is dropped
+	d.Input(1, 0)
+	d.Input(1, 1)
+	time.Sleep(100 * time.Millisecond)
+	if r.got() != "[2=1 1=1]" {
+		t.Errorf("short pulse is delivered: %s", r.got())
+	}
+
+	st := d.Stats()
+	if len(st) != 2 || st[0] != (Port_stats{Port: 1, State: 1, Raw: 5,
+	                                          Delivered: 1, Suppressed: 3}) {
+		t.Errorf("unexpected stats %+v", st)
+	}
+}
+
+func TestMinPulse(t *testing.T) {
+	d, r := start(t, &conf.Debounce_cfg{
+		Debounce_port_cfg: conf.Debounce_port_cfg{Min_pulse: "100ms"},
+	})
+	d.Input(1, 1)
+	d.Input(1, 0)
+	if r.got() != "[1=1]" {
+		t.Fatalf("edge inside min pulse is delivered: %s", r.got())
+	}
+	time.Sleep(150 * time.Millisecond)
+	if r.got() != "[1=1 1=0]" {
+		t.Errorf("edge is not delivered after min pulse: %s", r.got())
+	}
+}
+
+func TestRateLimit(t *testing.T) {
+	d, r := start(t, &conf.Debounce_cfg{
+		Debounce_port_cfg: conf.Debounce_port_cfg{Rate_limit: "2/200ms"},
+	})
+	d.Input(1, 1)
+	d.Input(1, 0)
+	d.Input(1, 1)
+	d.Input(1, 0)
+	if r.got() != "[1=1 1=0]" {
+		t.Fatalf("rate limit exceeded: %s", r.got())
+	}
+	time.Sleep(300 * time.Millisecond)
+	// pending 1 was replaced by 0 which is already delivered
+	d.Input(1, 1)
+	if r.got() != "[1=1 1=0 1=1]" {
+		t.Errorf("unexpected delivery after rate period: %s", r.got())
+	}
+}
+
+func TestReconcile(t *testing.T) {
+	d, r := start(t, &conf.Debounce_cfg{
+		Debounce_port_cfg: conf.Debounce_port_cfg{Stable: "50ms"},
+	})
+	d.Input(1, 1)
+	d.Reconcile(1, 1)
+	time.Sleep(100 * time.Millisecond)
+	if r.got() != "[]" {
+		t.Fatalf("reconciled state is delivered: %s", r.got())
+	}
+	d.Input(1, 1)
+	time.Sleep(100 * time.Millisecond)
+	if r.got() != "[]" {
+		t.Errorf("known state is delivered: %s", r.got())
+	}
+}
+
+// deliver may call filter back
+func TestReentrantDeliver(t *testing.T) {
+	var d *Debounce
+	var got []string
+	d, err := New(&conf.Debounce_cfg{}, func(port int, state int) {
+		got = append(got, fmt.Sprintf("%d=%d", port, state))
+		d.Stats()
+		if port == 1 {
+			d.Input(2, state) // delivered after this change
+		}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	done := make(chan bool)
+	go func() {
+		d.Input(1, 1)
+		close(done)
+	}()
+	select {
+	case <- done:
+	case <- time.After(time.Second):
+		t.Fatalf("deliver calling filter deadlocks")
+	}
+	if fmt.Sprint(got) != "[1=1 2=1]" {
+		t.Errorf("got %v", got)
+	}
+}
+
+// Timer callback which is already waiting for lock when its timer
+// is replaced must not deliver before new stable time
+func TestStartedCallbackIgnored(t *testing.T) {
+	d, r := start(t, &conf.Debounce_cfg{
+		Debounce_port_cfg: conf.Debounce_port_cfg{Stable: "100ms"},
+	})
+	d.Input(1, 1)
+
+	d.Lock()
+	time.Sleep(150 * time.Millisecond) // callback is blocked on lock
+	d.input_locked(1, 1)
+	d.Unlock()
+
+	time.Sleep(30 * time.Millisecond)
+	if r.got() != "[]" {
+		t.Fatalf("stale callback delivered change: %s", r.got())
+	}
+	time.Sleep(150 * time.Millisecond)
+	if r.got() != "[1=1]" {
+		t.Errorf("change is not delivered: %s", r.got())
+	}
+}
@@ -0,0 +1,207 @@
+package events
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log/slog"
+	"metrics"
+	"net"
+	"net/http"
+	"net/url"
+	"portmap"
+	"sync"
+	"time"
+)
+
+const QUEUE_SIZE = 256
+
+var (
+	stat_sent = metrics.New_counter("module_io_events_sent_total",
+	                                "Events delivered to automation server")
+	stat_failed = metrics.New_counter("module_io_events_failed_total",
+	                                  "Events delivery failures")
+	stat_dropped = metrics.New_counter("module_io_events_dropped_total",
+	                                   "Events dropped because of full queue")
+	stat_queue = metrics.New_gauge("module_io_events_queue_length",
+	                               "Events waiting for delivery")
+)
+
+// Input change or named event sent to automation server
+type Event struct {
+	Port int
+	State int // physical state, inverted ports are reported inverted
+	Port_name string // filled from port map
+	Name string // named event emitted by rule, empty for input change
+	Relay bool // Port is output, sent with relay=1
+	Reconciled bool // change found by poller, board event was missed
+	Time time.Time
+}
+
+func (ev *Event) direction() string {
+	if ev.Relay {
+		return portmap.OUTPUT
+	}
+	return portmap.INPUT
+}
+
+// Asynchronous HTTP event sink
+type Sink struct {
+	sync.Mutex
+	url_fmt string
+	ports *portmap.Map
+	queue chan *Event
+	client *http.Client
+	closed bool
+	done chan bool
+}
+
+// url_fmt must contain %d placeholders for port and state
+func New(url_fmt string, ports *portmap.Map) *Sink {
+	s := new(Sink)
+	s.url_fmt = url_fmt
+	s.ports = ports
+	s.queue = make(chan *Event, QUEUE_SIZE)
+	s.client = &http.Client{Timeout: 10 * time.Second}
+	s.done = make(chan bool)
+	go s.sender_thread()
+	return s
+}
+
+// Put event to queue, never blocks
+func (s *Sink) Send(ev *Event) {
+	if ev.Time.IsZero() {
+		ev.Time = time.Now()
+	}
+	if s.ports != nil && ev.Port > 0 {
+		ev.Port_name = s.ports.Name(ev.direction(), ev.Port)
+	}
+
+	s.Lock()
+	defer s.Unlock()
+	if s.closed {
+		stat_dropped.Inc()
+		slog.Warn("sink is closed, event dropped", "module", "events",
+		          "port", ev.Port, "name", ev.Port_name, "state", ev.State,
+		          "event", ev.Name)
+		return
+	}
+
+	select {
+	case s.queue <- ev:
+		stat_queue.Set(float64(len(s.queue)))
+	default:
+		stat_dropped.Inc()
+		slog.Error("queue is full, event dropped", "module", "events",
+		           "port", ev.Port, "name", ev.Port_name, "state", ev.State,
+		           "event", ev.Name)
+	}
+}
+
+// Change automation server URL, queued events go to new one
+func (s *Sink) Set_url(url_fmt string) {
+	s.Lock()
+	s.url_fmt = url_fmt
+	s.Unlock()
+}
+
+func (s *Sink) sender_thread() {
+	defer close(s.done)
+	for ev := range s.queue {
+		err := s.post(ev)
+		stat_queue.Set(float64(len(s.queue)))
+		if err == nil {
+			stat_sent.Inc()
+		} else {
+			stat_failed.Inc()
+		}
+		if err != nil {
+			slog.Warn("can't send event", "module", "events",
+			          "port", ev.Port, "name", ev.Port_name, "state", ev.State,
+			          "event", ev.Name, "relay", ev.Relay, "reconciled", ev.Reconciled,
+			          "err", err)
+		}
+	}
+}
+
+// Stop accepting events and wait until queued ones are delivered
+func (s *Sink) Close(timeout time.Duration) error {
+	s.Lock()
+	if !s.closed {
+		s.closed = true
+		close(s.queue)
+	}
+	s.Unlock()
+
+	select {
+	case <- s.done:
+		return nil
+	case <- time.After(timeout):
+		return fmt.Errorf("events: %d events are not delivered", len(s.queue))
+	}
+}
+
+func (s *Sink) post(ev *Event) error {
+	state := ev.State
+	if s.ports != nil && ev.Port > 0 {
+		state = s.ports.Logical(ev.direction(), ev.Port, ev.State)
+	}
+
+	s.Lock()
+	url_fmt := s.url_fmt
+	s.Unlock()
+
+	query := fmt.Sprintf(url_fmt, ev.Port, state)
+	if ev.Port_name != "" {
+		query += "&name=" + url.QueryEscape(ev.Port_name)
+	}
+	if ev.Name != "" {
+		query += "&event=" + url.QueryEscape(ev.Name)
+	}
+	if ev.Relay {
+		query += "&relay=1"
+	}
+	if ev.Reconciled {
+		query += "&reconciled=1"
+	}
+
+	resp, err := s.client.Get(query)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, resp.Body)
+
+	if resp.StatusCode != 200 {
+		return fmt.Errorf("server response: %s", resp.Status)
+	}
+	return nil
+}
+
+// Check automation server reachability by fresh connection. Past
+// delivery failures are not taken into account: events are rare and
+// one failure would fail the check until next event
+func (s *Sink) Check() error {
+	s.Lock()
+	url_fmt := s.url_fmt
+	s.Unlock()
+
+	u, err := url.Parse(fmt.Sprintf(url_fmt, 0, 0))
+	if err != nil {
+		return fmt.Errorf("events: incorrect url: %v", err)
+	}
+	host := u.Host
+	if u.Port() == "" {
+		host = net.JoinHostPort(u.Hostname(), "80")
+		if u.Scheme == "https" {
+			host = net.JoinHostPort(u.Hostname(), "443")
+		}
+	}
+
+	conn, err := net.DialTimeout("tcp", host, 3 * time.Second)
+	if err != nil {
+		return fmt.Errorf("events: server is unreachable: %v", err)
+	}
+	conn.Close()
+	return nil
+}
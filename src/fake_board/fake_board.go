@@ -0,0 +1,245 @@
+// Emulation of IO board on pty for tests of packages using Mod_io
+package fake_board
+
+import (
+	"conf"
+	"fmt"
+	"mod_io"
+	"os"
+	"portmap"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+	"unsafe"
+)
+
+type Board struct {
+	sync.Mutex
+	master *os.File
+	Path string
+	relays map[int]int
+	inputs map[int]int
+	frames []string // received frames without checksum
+	broken map[int]bool // relays not answering RWS
+	on_read map[int]int // input changes made when input is read
+}
+
+func open_pty() (*os.File, string, error) {
+	master, err := os.OpenFile("/dev/ptmx", os.O_RDWR | syscall.O_NOCTTY, 0)
+	if err != nil {
+		return nil, "", err
+	}
+
+	conn, err := master.SyscallConn()
+	if err != nil {
+		master.Close()
+		return nil, "", err
+	}
+	var num uint32
+	var errno syscall.Errno
+	conn.Control(func(fd uintptr) {
+		_, _, errno = syscall.Syscall(syscall.SYS_IOCTL, fd, syscall.TIOCGPTN,
+		                              uintptr(unsafe.Pointer(&num)))
+		if errno != 0 {
+			return
+		}
+		var unlock int32
+		_, _, errno = syscall.Syscall(syscall.SYS_IOCTL, fd, syscall.TIOCSPTLCK,
+		                              uintptr(unsafe.Pointer(&unlock)))
+	})
+	if errno != 0 {
+		master.Close()
+		return nil, "", errno
+	}
+	return master, fmt.Sprintf("/dev/pts/%d", num), nil
+}
+
+// Start board on new pty, test is skipped if pty is not available
+func Start(t testing.TB) *Board {
+	var err error
+
+	b := new(Board)
+	b.relays = make(map[int]int)
+	b.inputs = make(map[int]int)
+	b.broken = make(map[int]bool)
+	b.on_read = make(map[int]int)
+	b.master, b.Path, err = open_pty()
+	if err != nil {
+		t.Skipf("no pty: %v", err)
+	}
+	t.Cleanup(func() { b.master.Close() })
+	go b.run()
+	return b
+}
+
+// Start board and Mod_io connected to it. Empty fields of iocfg are
+// filled for 8 inputs and 8 outputs
+func Start_mod_io(t testing.TB, iocfg *conf.Module_io_cfg,
+                  ports *portmap.Map) (*Board, *mod_io.Mod_io) {
+	b := Start(t)
+	if iocfg == nil {
+		iocfg = new(conf.Module_io_cfg)
+	}
+	iocfg.Uart_dev = b.Path
+	if iocfg.Uart_speed == "" {
+		iocfg.Uart_speed = "115200"
+	}
+	if iocfg.Inputs_count == 0 {
+		iocfg.Inputs_count = 8
+	}
+	if iocfg.Outputs_count == 0 {
+		iocfg.Outputs_count = 8
+	}
+
+	mio, err := mod_io.New(iocfg, ports)
+	if err != nil {
+		t.Fatalf("mod_io: %v", err)
+	}
+	t.Cleanup(mio.Close)
+	return b, mio
+}
+
+func (b *Board) run() {
+	var buf [256]byte
+	var pending string
+	for {
+		n, err := b.master.Read(buf[:])
+		if err != nil {
+			return
+		}
+		pending += string(buf[:n])
+		for {
+			i := strings.IndexAny(pending, "\r\n")
+			if i < 0 {
+				break
+			}
+			frame := strings.Trim(pending[:i], "$")
+			pending = pending[i + 1:]
+			if frame != "" {
+				b.handle(frame)
+			}
+		}
+	}
+}
+
+func (b *Board) handle(frame string) {
+	frame = strings.SplitN(frame, "*", 2)[0]
+	parts := strings.Split(frame, ",")
+	if len(parts[0]) != 5 || len(parts) < 2 {
+		return
+	}
+	var args []int
+	for _, part := range parts[1:] {
+		arg, err := strconv.Atoi(part)
+		if err != nil {
+			return
+		}
+		args = append(args, arg)
+	}
+
+	b.Lock()
+	defer b.Unlock()
+	b.frames = append(b.frames, frame)
+
+	switch si := parts[0][2:]; {
+	case si == "RWS" && len(args) == 3:
+		if b.broken[args[1]] {
+			return
+		}
+		b.relays[args[1]] = args[2]
+		b.send("SOP", args[0], args[1], args[2])
+
+	case si == "RRS" && len(args) == 2:
+		b.send("SOP", args[0], args[1], b.relays[args[1]])
+
+	case si == "RIP" && len(args) == 2:
+		if state, ok := b.on_read[args[1]]; ok {
+			delete(b.on_read, args[1])
+			b.inputs[args[1]] = state
+			b.send("AIP", 0, args[1], state)
+		}
+		b.send("SIP", args[0], args[1], b.inputs[args[1]])
+
+	case si == "WDC" && len(args) == 2:
+		b.send("WDS", args[0], args[1])
+	}
+}
+
+// Send frame with checksum. Must be called with lock held
+func (b *Board) send(si string, args ...int) {
+	body := "IO" + si
+	for _, arg := range args {
+		body += fmt.Sprintf(",%d", arg)
+	}
+	var sum byte
+	for i := 0; i < len(body); i++ {
+		sum += body[i]
+	}
+	b.master.Write([]byte(fmt.Sprintf("$%s*%02X\r\n", body, sum)))
+}
+
+// Physical state of relay
+func (b *Board) Relay(port int) int {
+	b.Lock()
+	defer b.Unlock()
+	return b.relays[port]
+}
+
+// Change relay state behind daemon's back
+func (b *Board) Set_relay(port int, state int) {
+	b.Lock()
+	defer b.Unlock()
+	b.relays[port] = state
+}
+
+// Change input state and send AIP event
+func (b *Board) Set_input(port int, state int) {
+	b.Lock()
+	defer b.Unlock()
+	b.inputs[port] = state
+	b.send("AIP", 0, port, state)
+}
+
+// Change input state as if its event was lost
+func (b *Board) Set_input_silently(port int, state int) {
+	b.Lock()
+	defer b.Unlock()
+	b.inputs[port] = state
+}
+
+// Change input with event when it is read next time, so the event
+// comes just before the reply
+func (b *Board) Set_input_on_read(port int, state int) {
+	b.Lock()
+	defer b.Unlock()
+	b.on_read[port] = state
+}
+
+// Stop answering relay switching commands for port
+func (b *Board) Break_relay(port int) {
+	b.Lock()
+	defer b.Unlock()
+	b.broken[port] = true
+}
+
+// Received frames, for example "PCRWS,1,3,1"
+func (b *Board) Frames() []string {
+	b.Lock()
+	defer b.Unlock()
+	return append([]string(nil), b.frames...)
+}
+
+// Wait until relay gets state, false on timeout
+func (b *Board) Wait_relay(port int, state int, timeout time.Duration) bool {
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		if b.Relay(port) == state {
+			return true
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	return b.Relay(port) == state
+}
@@ -0,0 +1,380 @@
+package gsm
+
+import (
+	"conf"
+	"fmt"
+	"modem"
+	"log/slog"
+	"metrics"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	stat_sms_sent = metrics.New_counter("module_io_modem_sms_sent_total",
+	                                    "SMS sent through GSM modem")
+	stat_sms_failed = metrics.New_counter("module_io_modem_sms_failed_total",
+	                                      "SMS sending failures")
+	stat_sms_received = metrics.New_counter("module_io_modem_sms_received_total",
+	                                        "Incoming SMS fetched from modem")
+	stat_poll_errors = metrics.New_counter("module_io_modem_poll_errors_total",
+	                                       "Modem status and inbox poll failures")
+	stat_up = metrics.New_gauge("module_io_modem_up",
+	                            "1 if last modem poll succeeded")
+	stat_signal = metrics.New_gauge("module_io_modem_signal_strength_percent",
+	                                "GSM signal strength reported by modem")
+)
+
+// Modem ConnectionStatus value of established connection
+const CONNECTED = modem.CONNECTED
+
+type Status struct {
+	Up bool // last poll succeeded
+	Last_poll time.Time
+	Last_err string
+	Connection_status int
+	Signal_strength int
+	Network_type int
+	Roaming bool
+	Wan_ip string
+	Queue int // SMS waiting for sending
+	Sent int
+	Failed int
+	Received int
+	Balance float64
+	Balance_time time.Time // zero if balance is never checked
+	Balance_reply string // last balance USSD reply
+}
+
+// Function receiving service events like "low_balance"
+type Event_handler func(event string, details string)
+
+// Function receiving incoming SMS, message is removed from
+// modem if it returns true
+type Sms_handler func(msg *modem.Sms_message) bool
+
+type outgoing struct {
+	phones []string
+	text string
+	confirm time.Duration // wait for delivery report, 0 to not wait
+	result chan error // sending result, may be nil
+}
+
+// Delivery report poll period
+const CONFIRM_POLL = 2 * time.Second
+
+// Sent SMS waiting for send status confirmation
+type confirmation struct {
+	out outgoing
+	deadline time.Time
+	before *modem.Sent_sms_stat // send status before sending, nil if unknown
+	fresh bool // send status is updated for this sending
+}
+
+// Modem owner: polls status and inbox, sends queued SMS.
+// All modem requests are done from Run goroutine
+type Gsm struct {
+	sync.Mutex
+	modem modem.Modem
+	interval time.Duration
+	queue chan outgoing
+	handler Sms_handler
+	event_handler Event_handler
+	ussd chan ussd_request
+	ussd_timeout time.Duration
+	balance_ussd string
+	balance_interval time.Duration
+	balance_re *regexp.Regexp
+	balance_low float64
+	seen map[int]string // inbox index -> date of already handled SMS
+	confirm *confirmation // nil if nothing is waiting, used by Run only
+	status Status
+}
+
+func New(m modem.Modem, mcfg *conf.Modem_cfg) (*Gsm, error) {
+	var err error
+	g := new(Gsm)
+	g.modem = m
+	g.seen = make(map[int]string)
+
+	g.interval, err = time.ParseDuration(mcfg.Poll_interval)
+	if err != nil || g.interval <= 0 {
+		return nil, fmt.Errorf("gsm: incorrect poll_interval '%s'", mcfg.Poll_interval)
+	}
+
+	queue_size := mcfg.Queue_size
+	if queue_size <= 0 {
+		queue_size = 32
+	}
+	g.queue = make(chan outgoing, queue_size)
+	g.ussd = make(chan ussd_request)
+
+	g.ussd_timeout, err = time.ParseDuration(mcfg.Ussd_timeout)
+	if err != nil || g.ussd_timeout <= 0 {
+		return nil, fmt.Errorf("gsm: incorrect ussd_timeout '%s'", mcfg.Ussd_timeout)
+	}
+
+	g.balance_ussd = mcfg.Balance_ussd
+	g.balance_low = mcfg.Balance_low
+	if g.balance_ussd != "" {
+		g.balance_interval, err = time.ParseDuration(mcfg.Balance_interval)
+		if err != nil || g.balance_interval <= 0 {
+			return nil, fmt.Errorf("gsm: incorrect balance_interval '%s'",
+			                       mcfg.Balance_interval)
+		}
+		g.balance_re, err = regexp.Compile(mcfg.Balance_regex)
+		if err != nil {
+			return nil, fmt.Errorf("gsm: incorrect balance_regex: %v", err)
+		}
+	}
+	return g, nil
+}
+
+// Set function receiving service events
+func (g *Gsm) Set_event_handler(handler Event_handler) {
+	g.Lock()
+	g.event_handler = handler
+	g.Unlock()
+}
+
+// Set function receiving new incoming SMS. Without handler
+// messages are only logged
+func (g *Gsm) Set_sms_handler(handler Sms_handler) {
+	g.Lock()
+	g.handler = handler
+	g.Unlock()
+}
+
+// Put SMS for one or several recipients to sending queue, never blocks
+func (g *Gsm) Send_sms(phones []string, text string) error {
+	select {
+	case g.queue <- outgoing{phones: phones, text: text}:
+		g.Lock()
+		g.status.Queue = len(g.queue)
+		g.Unlock()
+		return nil
+	default:
+		stat_sms_failed.Inc()
+		return fmt.Errorf("gsm: sending queue is full")
+	}
+}
+
+// Service main loop
+func (g *Gsm) Run() {
+	g.poll()
+	ticker := time.NewTicker(g.interval)
+
+	var balance <-chan time.Time
+	if g.balance_ussd != "" {
+		g.check_balance()
+		balance_ticker := time.NewTicker(g.balance_interval)
+		balance = balance_ticker.C
+	}
+
+	confirm_ticker := time.NewTicker(CONFIRM_POLL)
+	for {
+		// modem reports status of last sending only, so next SMS
+		// waits for confirmation of previous one
+		queue := g.queue
+		if g.confirm != nil {
+			queue = nil
+		}
+
+		select {
+		case <- ticker.C:
+			g.poll()
+		case out := <- queue:
+			g.send(out)
+		case <- confirm_ticker.C:
+			if g.confirm != nil {
+				g.check_delivery()
+			}
+		case req := <- g.ussd:
+			reply, err := g.run_ussd(req.code)
+			req.result <- ussd_result{reply, err}
+		case <- balance:
+			g.check_balance()
+		}
+	}
+}
+
+// Send SMS and wait until modem confirms its delivery to network
+func (g *Gsm) Send_sms_confirmed(phone string, text string, timeout time.Duration) error {
+	result := make(chan error, 1)
+	select {
+	case g.queue <- outgoing{[]string{phone}, text, timeout, result}:
+	default:
+		stat_sms_failed.Inc()
+		return fmt.Errorf("gsm: sending queue is full")
+	}
+	return <- result
+}
+
+// True if phone is in list of send status like "+7901;+7902;"
+func has_phone(list string, phone string) bool {
+	for _, p := range strings.FieldsFunc(list, func(r rune) bool {
+		return r == ';' || r == ','
+	}) {
+		if p == phone {
+			return true
+		}
+	}
+	return false
+}
+
+func (g *Gsm) send(out outgoing) {
+	_, sync := g.modem.(modem.Sync_sender)
+	confirm := out.confirm > 0 && !sync
+
+	var before *modem.Sent_sms_stat
+	if confirm {
+		var err error
+		before, err = g.modem.Check_sended_sms_status()
+		if err != nil {
+			slog.Warn("can't get send status", "module", "gsm", "err", err)
+		}
+	}
+
+	err := g.modem.Send_sms_to(out.phones, out.text)
+	if err == nil && confirm {
+		g.confirm = &confirmation{out: out, before: before,
+		                          deadline: time.Now().Add(out.confirm)}
+		g.check_delivery()
+		return
+	}
+	g.sent(out, err)
+}
+
+// Poll modem send status of waiting SMS. Status may still describe
+// previous sending, so result is accepted only after status changed
+// since sending or reported the phone in progress
+func (g *Gsm) check_delivery() {
+	c := g.confirm
+	phone := c.out.phones[0]
+	st, err := g.modem.Check_sended_sms_status()
+	if err != nil {
+		slog.Warn("can't get send status", "module", "gsm", "err", err)
+	} else {
+		succeeded := has_phone(st.SucPhone, phone)
+		failed := has_phone(st.FailPhone, phone)
+		if (c.before != nil && *st != *c.before) || (!succeeded && !failed) {
+			c.fresh = true
+		}
+		if c.fresh && succeeded {
+			g.confirm = nil
+			g.sent(c.out, nil)
+			return
+		}
+		if c.fresh && failed {
+			g.confirm = nil
+			g.sent(c.out, fmt.Errorf("gsm: modem reports delivery failure"))
+			return
+		}
+	}
+
+	if time.Now().After(c.deadline) {
+		g.confirm = nil
+		g.sent(c.out, fmt.Errorf("gsm: no delivery confirmation within %v",
+		                         c.out.confirm))
+	}
+}
+
+// Report sending result
+func (g *Gsm) sent(out outgoing, err error) {
+	phones := strings.Join(out.phones, ",")
+	if out.result != nil {
+		out.result <- err
+	}
+
+	g.Lock()
+	g.status.Queue = len(g.queue)
+	if err == nil {
+		g.status.Sent++
+	} else {
+		g.status.Failed++
+	}
+	g.Unlock()
+
+	if err != nil {
+		stat_sms_failed.Inc()
+		slog.Error("can't send sms", "module", "gsm", "phone", phones, "err", err)
+		return
+	}
+	stat_sms_sent.Inc()
+	encoding, length := modem.Sms_encoding(out.text)
+	slog.Info("sms sent", "module", "gsm", "phone", phones, "encoding", encoding,
+	          "length", length, "parts", len(modem.Split_sms(out.text)))
+}
+
+func (g *Gsm) poll() {
+	st, err := g.modem.Get_global_status()
+	var msgs []modem.Sms_message
+	if err == nil {
+		msgs, err = g.modem.Check_for_new_sms()
+	}
+
+	g.Lock()
+	g.status.Last_poll = time.Now()
+	g.status.Up = err == nil
+	if err != nil {
+		g.status.Last_err = err.Error()
+		g.status.Connection_status = 0
+	} else {
+		g.status.Last_err = ""
+		g.status.Connection_status = st.ConnectionStatus
+		g.status.Signal_strength = st.SignalStrength
+		g.status.Network_type = st.CurrentNetworkType
+		g.status.Roaming = st.RoamingStatus != 0
+		g.status.Wan_ip = st.WanIPAddress
+	}
+	handler := g.handler
+	g.Unlock()
+
+	if err != nil {
+		stat_up.Set(0)
+		stat_poll_errors.Inc()
+		slog.Warn("modem poll failed", "module", "gsm", "err", err)
+		return
+	}
+	stat_up.Set(1)
+	stat_signal.Set(float64(st.SignalStrength))
+
+	// inbox indexes are reused after removal, date tells messages apart
+	present := make(map[int]bool)
+	for i := range msgs {
+		msg := &msgs[i]
+		present[msg.Index] = true
+		if date, ok := g.seen[msg.Index]; ok && date == msg.Date {
+			continue
+		}
+		g.seen[msg.Index] = msg.Date
+
+		stat_sms_received.Inc()
+		g.Lock()
+		g.status.Received++
+		g.Unlock()
+		slog.Info("sms received", "module", "gsm", "index", msg.Index,
+		          "phone", msg.Phone, "date", msg.Date)
+		if handler == nil || !handler(msg) {
+			continue
+		}
+		err = g.modem.Remove_sms(msg.Index)
+		if err != nil {
+			slog.Error("can't remove sms", "module", "gsm", "index", msg.Index, "err", err)
+		}
+	}
+	for index := range g.seen {
+		if !present[index] {
+			delete(g.seen, index)
+		}
+	}
+}
+
+// Return copy of modem status
+func (g *Gsm) Status() Status {
+	g.Lock()
+	defer g.Unlock()
+	return g.status
+}
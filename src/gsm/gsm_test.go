@@ -0,0 +1,198 @@
+package gsm
+
+import (
+	"conf"
+	"context"
+	"modem"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Modem reporting send status by test script
+type fake_modem struct {
+	sync.Mutex
+	sent [][]string
+	status modem.Sent_sms_stat // returned by Check_sended_sms_status
+	on_send *modem.Sent_sms_stat // status set by Send_sms_to, nil to keep
+	on_check []modem.Sent_sms_stat // statuses set by status checks after sending
+	polls int
+}
+
+func (m *fake_modem) Send_sms_to(phones []string, text string) error {
+	m.Lock()
+	defer m.Unlock()
+	m.sent = append(m.sent, phones)
+	if m.on_send != nil {
+		m.status = *m.on_send
+	}
+	return nil
+}
+
+func (m *fake_modem) Check_for_new_sms() ([]modem.Sms_message, error) {
+	return nil, nil
+}
+
+func (m *fake_modem) Remove_sms(sms_index int) error {
+	return nil
+}
+
+func (m *fake_modem) Check_sended_sms_status() (*modem.Sent_sms_stat, error) {
+	m.Lock()
+	defer m.Unlock()
+	st := m.status
+	if len(m.sent) > 0 && len(m.on_check) > 0 {
+		m.status = m.on_check[0]
+		m.on_check = m.on_check[1:]
+	}
+	return &st, nil
+}
+
+func (m *fake_modem) Ussd(ctx context.Context, code string) (string, error) {
+	return "balance 10", nil
+}
+
+func (m *fake_modem) Get_global_status() (*modem.Global_status, error) {
+	m.Lock()
+	defer m.Unlock()
+	m.polls++
+	return &modem.Global_status{ConnectionStatus: CONNECTED}, nil
+}
+
+func (m *fake_modem) Get_traffic_statistics() (*modem.Traffic_statistics, error) {
+	return &modem.Traffic_statistics{}, nil
+}
+
+type sync_modem struct {
+	fake_modem
+}
+
+func (m *sync_modem) Sync_send() {}
+
+func start(t *testing.T, m modem.Modem) *Gsm {
+	g, err := New(m, &conf.Modem_cfg{Poll_interval: "50ms", Ussd_timeout: "1s"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go g.Run()
+	return g
+}
+
+// Modem keeps result of previous SMS to the same phone
+func TestStaleStatus(t *testing.T) {
+	m := &fake_modem{status: modem.Sent_sms_stat{SucPhone: "+100;+200;", TotalCount: 2}}
+	g := start(t, m)
+
+	err := g.Send_sms_confirmed("+100", "alert", time.Second)
+	if err == nil {
+		t.Error("stale send status confirms delivery")
+	}
+}
+
+func TestConfirmed(t *testing.T) {
+	stale := modem.Sent_sms_stat{SucPhone: "+100;", TotalCount: 1, CurIndex: 1}
+	m := &fake_modem{status: stale,
+	                 on_send: &modem.Sent_sms_stat{Phone: "+100", TotalCount: 1},
+	                 on_check: []modem.Sent_sms_stat{stale}}
+	g := start(t, m)
+
+	err := g.Send_sms_confirmed("+100", "alert", 10 * time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// status of previous sending does not fail new one
+	m.Lock()
+	m.status = modem.Sent_sms_stat{FailPhone: "+200;", TotalCount: 1, CurIndex: 1}
+	m.sent = nil
+	m.on_send = nil
+	m.on_check = []modem.Sent_sms_stat{{SucPhone: "+200;", TotalCount: 1, CurIndex: 1}}
+	m.Unlock()
+	err = g.Send_sms_confirmed("+200", "alert", 10 * time.Second)
+	if err != nil {
+		t.Error(err)
+	}
+}
+
+func TestFailed(t *testing.T) {
+	m := &fake_modem{on_send: &modem.Sent_sms_stat{Phone: "+100", TotalCount: 1},
+	                 on_check: []modem.Sent_sms_stat{{FailPhone: "+100;", TotalCount: 1}}}
+	g := start(t, m)
+
+	err := g.Send_sms_confirmed("+100", "alert", 10 * time.Second)
+	if err == nil {
+		t.Error("failure is not reported")
+	}
+	if st := g.Status(); st.Failed != 1 || st.Sent != 0 {
+		t.Errorf("unexpected counters %+v", st)
+	}
+}
+
+// Modem is used by other requests while SMS waits for confirmation
+func TestConfirmDoesNotBlock(t *testing.T) {
+	m := &fake_modem{on_send: &modem.Sent_sms_stat{Phone: "+100", TotalCount: 1}}
+	g := start(t, m)
+
+	result := make(chan error, 1)
+	go func() {
+		result <- g.Send_sms_confirmed("+100", "alert", 10 * time.Second)
+	}()
+	time.Sleep(100 * time.Millisecond)
+
+	m.Lock()
+	polls := m.polls
+	m.Unlock()
+	_, err := g.Ussd("*100#")
+	if err != nil {
+		t.Errorf("ussd: %v", err)
+	}
+	time.Sleep(200 * time.Millisecond)
+	m.Lock()
+	if m.polls <= polls {
+		t.Error("status polls are stalled")
+	}
+	m.Unlock()
+
+	// sending of next SMS waits, it would replace send status
+	err = g.Send_sms([]string{"+200"}, "other")
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(100 * time.Millisecond)
+	m.Lock()
+	if len(m.sent) != 1 {
+		t.Errorf("next SMS is sent before confirmation: %v", m.sent)
+	}
+	m.on_check = []modem.Sent_sms_stat{{SucPhone: "+100;", TotalCount: 1}}
+	m.Unlock()
+
+	err = <- result
+	if err != nil {
+		t.Error(err)
+	}
+	time.Sleep(100 * time.Millisecond)
+	m.Lock()
+	if len(m.sent) != 2 {
+		t.Errorf("next SMS is not sent after confirmation: %v", m.sent)
+	}
+	m.Unlock()
+}
+
+// Send result of synchronous backend is final
+func TestSyncSender(t *testing.T) {
+	m := new(sync_modem)
+	g := start(t, m)
+
+	start := time.Now()
+	err := g.Send_sms_confirmed("+100", "alert", 10 * time.Second)
+	if err != nil || time.Since(start) > CONFIRM_POLL {
+		t.Errorf("got %v after %v", err, time.Since(start))
+	}
+}
+
+func TestHasPhone(t *testing.T) {
+	if has_phone("+1001;", "+100") || !has_phone("+200;+100;", "+100") ||
+	   !has_phone("+100", "+100") || has_phone("", "+100") {
+		t.Error("incorrect phone list matching")
+	}
+}
@@ -0,0 +1,94 @@
+package gsm
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"metrics"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var stat_balance = metrics.New_gauge("module_io_modem_balance",
+                                     "SIM balance from last USSD balance check")
+
+type ussd_result struct {
+	reply string
+	err error
+}
+
+type ussd_request struct {
+	code string
+	result chan ussd_result
+}
+
+// Send USSD code and return network reply. Blocks until reply
+// or ussd_timeout
+func (g *Gsm) Ussd(code string) (string, error) {
+	req := ussd_request{code, make(chan ussd_result, 1)}
+	select {
+	case g.ussd <- req:
+	case <- time.After(g.ussd_timeout):
+		return "", fmt.Errorf("gsm: modem is busy")
+	}
+	res := <- req.result
+	return res.reply, res.err
+}
+
+func (g *Gsm) run_ussd(code string) (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), g.ussd_timeout)
+	defer cancel()
+	reply, err := g.modem.Ussd(ctx, code)
+	if err != nil {
+		slog.Warn("ussd failed", "module", "gsm", "code", code, "err", err)
+		return "", err
+	}
+	slog.Info("ussd reply", "module", "gsm", "code", code, "reply", reply)
+	return reply, nil
+}
+
+// Extract balance from USSD reply: first regex group or whole match
+func parse_balance(re_match []string) (float64, error) {
+	str := re_match[0]
+	if len(re_match) > 1 {
+		str = re_match[1]
+	}
+	return strconv.ParseFloat(strings.Replace(str, ",", ".", 1), 64)
+}
+
+func (g *Gsm) check_balance() {
+	reply, err := g.run_ussd(g.balance_ussd)
+	if err != nil {
+		return
+	}
+
+	m := g.balance_re.FindStringSubmatch(reply)
+	if m == nil {
+		slog.Error("can't find balance in ussd reply", "module", "gsm", "reply", reply)
+		return
+	}
+	balance, err := parse_balance(m)
+	if err != nil {
+		slog.Error("incorrect balance in ussd reply", "module", "gsm",
+		           "reply", reply, "err", err)
+		return
+	}
+
+	g.Lock()
+	g.status.Balance = balance
+	g.status.Balance_time = time.Now()
+	g.status.Balance_reply = reply
+	handler := g.event_handler
+	g.Unlock()
+
+	stat_balance.Set(balance)
+	slog.Info("balance checked", "module", "gsm", "balance", balance)
+	if balance < g.balance_low {
+		slog.Warn("low balance", "module", "gsm", "balance", balance,
+		          "threshold", g.balance_low)
+		if handler != nil {
+			handler("low_balance", fmt.Sprintf("balance %.2f", balance))
+		}
+	}
+}
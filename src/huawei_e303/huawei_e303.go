@@ -1,16 +1,95 @@
 package huawei_e303
 
 import (
+	"bytes"
+	"context"
 	"fmt"
+	"io"
 	"net/http"
+	"net/http/cookiejar"
+	"net/url"
 	"encoding/xml"
 	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
 	"io/ioutil"
+	"log/slog"
 	"conf"
+	"modem"
 )
 
+const DEFAULT_TIMEOUT = 10 * time.Second
+
+// USSD status poll period
+const USSD_POLL = time.Second
+
+// Inbox is read by pages of this size
+const SMS_PAGE_SIZE = 20
+const SMS_MAX_PAGES = 50
+
+// Session token renewals for one request
+const TOKEN_RETRIES = 2
+
+// Modem error codes
+const (
+	ERR_NOT_SUPPORTED = 100002
+	ERR_USSD_PROCESSING = 111019
+	ERR_WRONG_TOKEN = 125001
+	ERR_WRONG_SESSION = 125002
+	ERR_WRONG_SESSION_TOKEN = 125003
+)
+
+var error_meanings = map[int]string{
+	100001: "unknown error",
+	100002: "not supported",
+	100003: "no rights, login required",
+	100004: "system busy",
+	100005: "format error",
+	100006: "parameter error",
+	100009: "write error",
+	108001: "wrong username",
+	108002: "wrong password",
+	108003: "already logged in",
+	108006: "wrong username or password",
+	111019: "USSD processing",
+	111020: "USSD timeout",
+	113018: "SMS system busy",
+	125001: "wrong token",
+	125002: "wrong session",
+	125003: "wrong session token",
+}
+
+// Error returned by modem web API
+type Modem_error struct {
+	Code int
+	Message string
+}
+
+func (e *Modem_error) Error() string {
+	meaning, ok := error_meanings[e.Code]
+	if !ok {
+		meaning = "unknown code"
+	}
+	if e.Message != "" {
+		meaning += ": " + e.Message
+	}
+	return fmt.Sprintf("huawei_e303: modem error %d (%s)", e.Code, meaning)
+}
+
+// Return true if request may succeed with new session token
+func (e *Modem_error) Token_error() bool {
+	return e.Code == ERR_WRONG_TOKEN || e.Code == ERR_WRONG_SESSION ||
+	       e.Code == ERR_WRONG_SESSION_TOKEN
+}
+
 type Modem struct {
+	sync.Mutex
 	ip_addr string
+	client *http.Client
+	token string // __RequestVerificationToken
+	token_fetched bool
+	ussd_code_type string
 }
 
 // Huawei modem error response by POST/GET query
@@ -26,152 +105,206 @@ type huawei_e303_ok_resp_xml struct {
 	Ok string 	     `xml:",chardata"`
 }
 
-type Modem_sms_message struct {
-	Smstat     int    `xml:"Smstat"`
-	Index      int    `xml:"Index"`
-	Phone      string `xml:"Phone"`
-	Content    string `xml:"Content"`
-	Date       string `xml:"Date"`
-	Sca        string `xml:"Sca"`
-	SaveType   int    `xml:"SaveType"`
-	Priority   int    `xml:"Priority"`
-	SmsType    int    `xml:"SmsType"`
-}
+// Message and status types are shared by all modem backends
+type Modem_sms_message = modem.Sms_message
+type Modem_global_status = modem.Global_status
+type Modem_trafic_statistics = modem.Traffic_statistics
+type Modem_sent_sms_stat = modem.Sent_sms_stat
 
-type Modem_global_status struct {
-	XMLName               xml.Name `xml:"response"`
-	ConnectionStatus      int      `xml:"ConnectionStatus"`
-	SignalStrength        int      `xml:"SignalStrength"`
-	SignalIcon            int	   `xml:"SignalIcon"`
-	CurrentNetworkType    int      `xml:"CurrentNetworkType"`
-	CurrentServiceDomain  int      `xml:"CurrentServiceDomain"`
-	RoamingStatus         int      `xml:"RoamingStatus"`
-	WanIPAddress          string   `xml:"WanIPAddress"`
-	PrimaryDns            string   `xml:"PrimaryDns"`
-	SecondaryDns          string   `xml:"SecondaryDns"`
-}
+func New(mcfg *conf.Modem_cfg) *Modem {
+	m := new(Modem)
+	m.ip_addr = mcfg.Ip_addr
+	m.ussd_code_type = mcfg.Ussd_code_type
+	if m.ussd_code_type == "" {
+		m.ussd_code_type = "CodeType"
+	}
 
-type Modem_trafic_statistics struct {
-	XMLName               xml.Name `xml:"response"`
-	CurrentConnectTime    uint64   `xml:"CurrentConnectTime"`
-	CurrentUpload         uint64   `xml:"CurrentUpload"`
-	CurrentDownload       uint64   `xml:"CurrentDownload"`
-	CurrentDownloadRate   uint64   `xml:"CurrentDownloadRate"`
-	CurrentUploadRate     uint64   `xml:"CurrentUploadRate"`
-	TotalUpload           uint64   `xml:"TotalUpload"`
-	TotalDownload         uint64   `xml:"TotalDownload"`
-	TotalConnectTime      uint64   `xml:"TotalConnectTime"`
+	timeout, err := time.ParseDuration(mcfg.Http_timeout)
+	if err != nil || timeout <= 0 {
+		timeout = DEFAULT_TIMEOUT
+	}
+	jar, _ := cookiejar.New(nil)
+	m.client = &http.Client{Timeout: timeout, Jar: jar}
+	return m
 }
 
 
-type Modem_sent_sms_stat struct {
-	XMLName     xml.Name `xml:"response"`
-	Phone       string   `xml:"Phone"`
-	SucPhone    string   `xml:"SucPhone"`
-	FailPhone   string   `xml:"FailPhone"`
-	TotalCount  int      `xml:"TotalCount"`
-	CurIndex    int      `xml:"CurIndex"`
-}
+// Fetch session cookie and CSRF token. Old firmware without
+// SesTokInfo works without them. Must be called with lock held
+func (m *Modem) fetch_token() error {
+	m.token = ""
+	m.token_fetched = true
 
+	body, err := m.do("GET", "/api/webserver/SesTokInfo", nil)
+	if err != nil {
+		merr, ok := err.(*Modem_error)
+		if ok && merr.Code == ERR_NOT_SUPPORTED {
+			return nil
+		}
+		return err
+	}
 
-func New(mcfg *conf.Modem_cfg) *Modem {
-	m := new(Modem)
-	m.ip_addr = mcfg.Ip_addr
-	return m
+	type ses_tok_info struct {
+		XMLName xml.Name `xml:"response"`
+		Ses_info string `xml:"SesInfo"`
+		Tok_info string `xml:"TokInfo"`
+	}
+	info := new(ses_tok_info)
+	err = xml.Unmarshal(body, info)
+	if err != nil {
+		return fmt.Errorf("huawei_e303: SesTokInfo can't parse: %v", err)
+	}
+
+	// SesInfo is "SessionID=<value>"
+	cookie := strings.SplitN(info.Ses_info, "=", 2)
+	if len(cookie) == 2 {
+		u := &url.URL{Scheme: "http", Host: m.ip_addr, Path: "/"}
+		m.client.Jar.SetCookies(u, []*http.Cookie{{Name: cookie[0], Value: cookie[1]}})
+	}
+	m.token = info.Tok_info
+	return nil
 }
 
 
-func (m *Modem) send_xml_post_query(query interface{}, url string) (string, error) {
-	var err error
-	
-	// create XML text	
-	query_xml, err := xml.MarshalIndent(query, "  ", "    ")
+// Send one HTTP request and check modem error response.
+// Must be called with lock held
+func (m *Modem) do(method string, path string, body []byte) ([]byte, error) {
+	var reader io.Reader
+	if body != nil {
+		reader = bytes.NewReader(body)
+	}
+	req, err := http.NewRequest(method, "http://" + m.ip_addr + path, reader)
 	if err != nil {
-		return "", fmt.Errorf("xml create err: %v\n", err)
+		return nil, fmt.Errorf("huawei_e303: can't create request: %v", err)
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded; charset=UTF-8")
+	}
+	if m.token != "" {
+		req.Header.Set("__RequestVerificationToken", m.token)
 	}
-	
-	// make POST query	
-	resp, err := http.Post("http://" + m.ip_addr + url, 
-						   "application/x-www-form-urlencoded", 
-						   strings.NewReader(string(query_xml)))
 
-	if resp.StatusCode != 200 {
-		return "", fmt.Errorf("modem error response: %d\n", resp.Status)
+	resp, err := m.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("huawei_e303: query %s: %v", path, err)
 	}
+	defer resp.Body.Close()
 
-	// read POST response 	
 	resp_body, err := ioutil.ReadAll(resp.Body)
 	if err != nil {
-		return "", fmt.Errorf("modem read response error: %v\n", err)
+		return nil, fmt.Errorf("huawei_e303: read response %s: %v", path, err)
 	}
-	defer resp.Body.Close()
-	
-	// Attempt to Parse Error response 	
+	if resp.StatusCode != 200 {
+		return nil, fmt.Errorf("huawei_e303: query %s: %s", path, resp.Status)
+	}
+
+	// token is rotated after every POST on new firmware
+	for _, hdr := range []string{"__RequestVerificationTokenone",
+	                             "__RequestVerificationToken"} {
+		token := resp.Header.Get(hdr)
+		if token != "" {
+			m.token = strings.SplitN(token, "#", 2)[0]
+			break
+		}
+	}
+
+	// Attempt to Parse Error response
 	resp_err := new(huawei_e303_err_resp_xml)
 	err = xml.Unmarshal(resp_body, resp_err)
 	if err == nil {
-		return "", fmt.Errorf("modem return error code: %d", resp_err.Code)
+		return nil, &Modem_error{Code: resp_err.Code, Message: resp_err.Message}
 	}
-
-	return string(resp_body), nil
+	return resp_body, nil
 }
 
 
-func (m *Modem) send_get_query(url string) (string, error) {
+// Send request, renewing session token when modem rejects it
+func (m *Modem) query(method string, path string, body []byte) (string, error) {
+	m.Lock()
+	defer m.Unlock()
+
 	var err error
-	
-	// make GET query	
-	resp, err := http.Get("http://" + m.ip_addr + url)
+	for attempt := 0; attempt <= TOKEN_RETRIES; attempt++ {
+		if !m.token_fetched {
+			err = m.fetch_token()
+			if err != nil {
+				m.token_fetched = false
+				return "", err
+			}
+		}
+
+		var resp_body []byte
+		resp_body, err = m.do(method, path, body)
+		if err == nil {
+			return string(resp_body), nil
+		}
+
+		merr, ok := err.(*Modem_error)
+		if !ok || !merr.Token_error() {
+			return "", err
+		}
+		slog.Debug("modem session expired", "module", "huawei_e303",
+		           "path", path, "code", merr.Code)
+		m.token_fetched = false
+	}
+	return "", err
+}
 
-	if resp.StatusCode != 200 {
-		return "", fmt.Errorf("modem error response: %d\n", resp.Status)
-	}
 
-	// read GET response 	
-	resp_body, err := ioutil.ReadAll(resp.Body)
-	defer resp.Body.Close()
+func (m *Modem) send_xml_post_query(query interface{}, url string) (string, error) {
+	// create XML text
+	query_xml, err := xml.MarshalIndent(query, "  ", "    ")
 	if err != nil {
-		return "", fmt.Errorf("modem read response error: %v\n", err)
+		return "", fmt.Errorf("huawei_e303: xml create err: %v", err)
 	}
+	return m.query("POST", url, query_xml)
+}
 
-	// Attempt to Parse Error response
-	resp_err := new(huawei_e303_err_resp_xml)
-	err = xml.Unmarshal(resp_body, resp_err)
-	if err == nil {
-		return "", fmt.Errorf("modem return error code: %d", resp_err.Code) 
-	}
-	
-	return string(resp_body), nil
+
+func (m *Modem) send_get_query(url string) (string, error) {
+	return m.query("GET", url, nil)
 }
 
 func (m *Modem) Send_sms(phone_num string, text string) error {
+	return m.Send_sms_to([]string{phone_num}, text)
+}
+
+
+// Send text to several recipients, long text is split into parts
+func (m *Modem) Send_sms_to(phones []string, text string) error {
 	type query struct {
 		XMLName   xml.Name `xml:"request"`
 		Index     int      `xml:"Index"`
-		Phone     string   `xml:"Phones>Phone"`
+		Phones    []string `xml:"Phones>Phone"`
 		Content   string   `xml:"Content"`
 		Lenght    int      `xml:"Length"`
 		Reserved  int      `xml:"Reserved"`
 		Date      string   `xml:"Date"`
 	}
-	
-	q := &query{Index: -1, 
-				Phone: phone_num,
-				Content: text,
-				Lenght: len(text),
-				Date: "111",
-				}
-	
-	resp_body, err := m.send_xml_post_query(q, "/api/sms/send-sms")
-	if err != nil {
-		return err
+
+	if len(phones) == 0 {
+		return fmt.Errorf("huawei_e303: no recipients")
 	}
-	
-	// Attempt to Parse OK response 	
-	resp_ok := new(huawei_e303_ok_resp_xml)
-	err = xml.Unmarshal([]byte(resp_body), resp_ok)
-	if err != nil {
-		return fmt.Errorf("Send_sms responce can`t parse: %v\n", err)
+
+	for _, part := range modem.Split_sms(text) {
+		q := &query{Index: -1,
+					Phones: phones,
+					Content: part,
+					Lenght: utf8.RuneCountInString(part),
+					Date: "111",
+					}
+
+		resp_body, err := m.send_xml_post_query(q, "/api/sms/send-sms")
+		if err != nil {
+			return err
+		}
+
+		// Attempt to Parse OK response
+		resp_ok := new(huawei_e303_ok_resp_xml)
+		err = xml.Unmarshal([]byte(resp_body), resp_ok)
+		if err != nil {
+			return fmt.Errorf("Send_sms responce can`t parse: %v", err)
+		}
 	}
 
 	return nil
@@ -202,6 +335,7 @@ func (m *Modem) Remove_sms(sms_index int) error {
 }
 
 
+// Return all messages of inbox, page by page
 func (m *Modem) Check_for_new_sms() ([]Modem_sms_message, error) {
 	type query struct {
 		XMLName          xml.Name `xml:"request"`
@@ -212,33 +346,42 @@ func (m *Modem) Check_for_new_sms() ([]Modem_sms_message, error) {
 		Ascending        int      `xml:"Ascending"`
 		UnreadPreferred  int      `xml:"UnreadPreferred"`
 	}
-	
-	q := &query{PageIndex: 1, 
-				ReadCount: 20,
-				BoxType: 1,
-				SortType: 0,
-				Ascending: 0,
-				UnreadPreferred: 0,
-				}
-	
-	resp_body, err := m.send_xml_post_query(q, "/api/sms/sms-list")
-	if err != nil {
-		return nil, err
-	}
-	
+
 	type huawei_e303_sms_list_xml struct {
 		XMLName xml.Name `xml:"response"`
-		Count   string   `xml:"Count"`
+		Count   int      `xml:"Count"`
 		Messages []Modem_sms_message `xml:"Messages>Message"`
 	}
-	
-	resp_sms_list := new(huawei_e303_sms_list_xml)
-	err = xml.Unmarshal([]byte(resp_body), resp_sms_list)
-	if err != nil {
-		return nil, fmt.Errorf("List incomming sms can`t parse: %v\n", err)
+
+	var messages []Modem_sms_message
+	for page := 1; page <= SMS_MAX_PAGES; page++ {
+		q := &query{PageIndex: page,
+					ReadCount: SMS_PAGE_SIZE,
+					BoxType: 1,
+					SortType: 0,
+					Ascending: 0,
+					UnreadPreferred: 0,
+					}
+
+		resp_body, err := m.send_xml_post_query(q, "/api/sms/sms-list")
+		if err != nil {
+			return nil, err
+		}
+
+		resp_sms_list := new(huawei_e303_sms_list_xml)
+		err = xml.Unmarshal([]byte(resp_body), resp_sms_list)
+		if err != nil {
+			return nil, fmt.Errorf("List incomming sms can`t parse: %v", err)
+		}
+
+		messages = append(messages, resp_sms_list.Messages...)
+		if len(resp_sms_list.Messages) < SMS_PAGE_SIZE ||
+		   len(messages) >= resp_sms_list.Count {
+			break
+		}
 	}
 
-	return resp_sms_list.Messages, nil
+	return messages, nil
 }
 
 
@@ -250,7 +393,7 @@ func (m *Modem) Send_ussd(text string) error {
 	}
 	
 	q := &query{Content: text,
-				Code_type: "CodeType",
+				Code_type: m.ussd_code_type,
 				}
 	
 	resp_body, err := m.send_xml_post_query(q, "/api/ussd/send")
@@ -262,13 +405,63 @@ func (m *Modem) Send_ussd(text string) error {
 	resp_ok := new(huawei_e303_ok_resp_xml)
 	err = xml.Unmarshal([]byte(resp_body), resp_ok)
 	if err != nil {
-		return fmt.Errorf("Remove_sms responce can`t parse: %v\n", err)
+		return fmt.Errorf("Send_ussd responce can`t parse: %v", err)
 	}
 
 	return nil
 }
 
 
+// Return true while USSD request is being processed
+func (m *Modem) Ussd_pending() (bool, error) {
+	resp_body, err := m.send_get_query("/api/ussd/status")
+	if err != nil {
+		return false, err
+	}
+
+	type responce_xml struct {
+		XMLName xml.Name `xml:"response"`
+		Result int       `xml:"result"`
+	}
+
+	resp_status := new(responce_xml)
+	err = xml.Unmarshal([]byte(resp_body), resp_status)
+	if err != nil {
+		return false, fmt.Errorf("Ussd_pending responce can`t parse: %v", err)
+	}
+	return resp_status.Result == 1, nil
+}
+
+
+// Send USSD code and wait for network reply
+func (m *Modem) Ussd(ctx context.Context, code string) (string, error) {
+	err := m.Send_ussd(code)
+	if err != nil {
+		return "", err
+	}
+
+	for {
+		select {
+		case <- ctx.Done():
+			return "", fmt.Errorf("huawei_e303: USSD %s: %v", code, ctx.Err())
+		case <- time.After(USSD_POLL):
+		}
+
+		pending, err := m.Ussd_pending()
+		if err != nil {
+			merr, ok := err.(*Modem_error)
+			if ok && merr.Code == ERR_USSD_PROCESSING {
+				continue
+			}
+			return "", err
+		}
+		if !pending {
+			return m.Check_for_new_ussd()
+		}
+	}
+}
+
+
 func (m *Modem) Check_for_new_ussd() (string, error) {
 	resp_body, err := m.send_get_query("/api/ussd/get")
 	if err != nil {
@@ -296,7 +489,7 @@ func (m *Modem) Get_global_status() (*Modem_global_status, error) {
 		return nil, err
 	}
 
-	fmt.Printf("resp: %v", resp_body)
+	slog.Debug("modem response", "module", "huawei_e303", "body", resp_body)
 
 	resp_status := new(Modem_global_status)
 	err = xml.Unmarshal([]byte(resp_body), resp_status)
@@ -314,7 +507,7 @@ func (m *Modem) Get_traffic_statistics() (*Modem_trafic_statistics, error) {
 		return nil, err
 	}
 
-	fmt.Printf("resp: %v", resp_body)
+	slog.Debug("modem response", "module", "huawei_e303", "body", resp_body)
 
 	resp_statistics := new(Modem_trafic_statistics)
 	err = xml.Unmarshal([]byte(resp_body), resp_statistics)
@@ -356,7 +549,7 @@ func (m *Modem) Check_sended_sms_status() (*Modem_sent_sms_stat, error) {
 		return nil, err
 	}
 
-	fmt.Printf("resp: %v", resp_body)
+	slog.Debug("modem response", "module", "huawei_e303", "body", resp_body)
 
 	resp_stat := new(Modem_sent_sms_stat)
 	err = xml.Unmarshal([]byte(resp_body), resp_stat)
@@ -0,0 +1,195 @@
+package huawei_e303
+
+import (
+	"conf"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+const STATUS_RESP = "<response><ConnectionStatus>901</ConnectionStatus>" +
+                    "<SignalStrength>80</SignalStrength></response>"
+
+// HiLink web API emulation
+type fake_hilink struct {
+	sync.Mutex
+	token_fetches int
+	requests []string // "<path> <token> <session>"
+	expired int // number of next requests rejected with wrong session
+	no_tokens bool // old firmware without SesTokInfo
+	err_code int // error returned by non token requests
+	delay time.Duration
+	token int
+}
+
+func (f *fake_hilink) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.Lock()
+	defer f.Unlock()
+	time.Sleep(f.delay)
+
+	if r.URL.Path == "/api/webserver/SesTokInfo" {
+		if f.no_tokens {
+			fmt.Fprint(w, "<error><code>100002</code><message></message></error>")
+			return
+		}
+		f.token_fetches++
+		f.token++
+		fmt.Fprintf(w, "<response><SesInfo>SessionID=s%d</SesInfo>" +
+		               "<TokInfo>t%d</TokInfo></response>", f.token_fetches, f.token)
+		return
+	}
+
+	session := ""
+	cookie, err := r.Cookie("SessionID")
+	if err == nil {
+		session = cookie.Value
+	}
+	token := r.Header.Get("__RequestVerificationToken")
+	f.requests = append(f.requests, fmt.Sprintf("%s %s %s", r.URL.Path, token, session))
+
+	if f.expired > 0 {
+		f.expired--
+		fmt.Fprint(w, "<error><code>125002</code><message></message></error>")
+		return
+	}
+	if f.err_code != 0 {
+		fmt.Fprintf(w, "<error><code>%d</code><message></message></error>", f.err_code)
+		return
+	}
+	if r.Method == "POST" {
+		// new firmware rotates token after every POST
+		f.token++
+		w.Header().Set("__RequestVerificationTokenone", fmt.Sprintf("t%d#x", f.token))
+		fmt.Fprint(w, "<response>OK</response>")
+		return
+	}
+	fmt.Fprint(w, STATUS_RESP)
+}
+
+func (f *fake_hilink) got() string {
+	f.Lock()
+	defer f.Unlock()
+	return strings.Join(f.requests, ", ")
+}
+
+func (f *fake_hilink) fetches() int {
+	f.Lock()
+	defer f.Unlock()
+	return f.token_fetches
+}
+
+func start(t *testing.T, f *fake_hilink, timeout string) *Modem {
+	srv := httptest.NewServer(f)
+	t.Cleanup(srv.Close)
+	return New(&conf.Modem_cfg{Ip_addr: strings.TrimPrefix(srv.URL, "http://"),
+	                           Http_timeout: timeout})
+}
+
+func TestToken(t *testing.T) {
+	f := new(fake_hilink)
+	m := start(t, f, "")
+
+	_, err := m.Get_global_status()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = m.Send_sms_to([]string{"+100"}, "text")
+	if err != nil {
+		t.Fatal(err)
+	}
+	st, err := m.Get_global_status()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st.ConnectionStatus != 901 || st.SignalStrength != 80 {
+		t.Errorf("unexpected status %+v", st)
+	}
+
+	want := "/api/monitoring/status t1 s1, /api/sms/send-sms t1 s1, /api/monitoring/status t2 s1"
+	if f.got() != want || f.fetches() != 1 {
+		t.Errorf("got requests %s after %d token fetches", f.got(), f.fetches())
+	}
+}
+
+func TestTokenRenewal(t *testing.T) {
+	f := &fake_hilink{expired: 1}
+	m := start(t, f, "")
+
+	_, err := m.Get_global_status()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "/api/monitoring/status t1 s1, /api/monitoring/status t2 s2"
+	if f.got() != want {
+		t.Errorf("got requests %s", f.got())
+	}
+}
+
+func TestTokenRetriesExhausted(t *testing.T) {
+	f := &fake_hilink{expired: 100}
+	m := start(t, f, "")
+
+	_, err := m.Get_global_status()
+	merr, ok := err.(*Modem_error)
+	if !ok || !merr.Token_error() {
+		t.Fatalf("got %v, token error expected", err)
+	}
+	if f.fetches() != TOKEN_RETRIES + 1 {
+		t.Errorf("got %d token fetches, want %d", f.fetches(), TOKEN_RETRIES + 1)
+	}
+}
+
+func TestOldFirmware(t *testing.T) {
+	f := &fake_hilink{no_tokens: true}
+	m := start(t, f, "")
+
+	_, err := m.Get_global_status()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if f.got() != "/api/monitoring/status  " {
+		t.Errorf("got requests %s", f.got())
+	}
+}
+
+func TestModemError(t *testing.T) {
+	f := &fake_hilink{err_code: 113018}
+	m := start(t, f, "")
+
+	err := m.Send_sms_to([]string{"+100"}, "text")
+	merr, ok := err.(*Modem_error)
+	if !ok || merr.Code != 113018 || merr.Token_error() ||
+	   !strings.Contains(err.Error(), "SMS system busy") {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if f.got() != "/api/sms/send-sms t1 s1" {
+		t.Errorf("request is repeated: %s", f.got())
+	}
+
+	merr = &Modem_error{Code: 42, Message: "strange"}
+	if merr.Error() != "huawei_e303: modem error 42 (unknown code: strange)" {
+		t.Errorf("unexpected text %s", merr.Error())
+	}
+}
+
+func TestHttpErrors(t *testing.T) {
+	srv := httptest.NewServer(http.NotFoundHandler())
+	defer srv.Close()
+	m := New(&conf.Modem_cfg{Ip_addr: strings.TrimPrefix(srv.URL, "http://")})
+	_, err := m.Get_global_status()
+	if _, ok := err.(*Modem_error); err == nil || ok {
+		t.Errorf("got %v, HTTP error expected", err)
+	}
+
+	f := &fake_hilink{delay: 200 * time.Millisecond}
+	m = start(t, f, "50ms")
+	start := time.Now()
+	_, err = m.Get_global_status()
+	if err == nil || time.Since(start) > 150 * time.Millisecond {
+		t.Errorf("got %v after %v, timeout expected", err, time.Since(start))
+	}
+}
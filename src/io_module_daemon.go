@@ -4,18 +4,66 @@ import (
 	"fmt"
 	"mod_io"
     "conf"
+    "listener"
+    "timers"
+    "scheduler"
+    "events"
+    "rules"
+    "debounce"
+    "poller"
+    "watchdog"
+    "metrics"
+    "logging"
+    "log/slog"
+    "flag"
+    "nmea0183"
+    "systemd"
+    "portmap"
+    "gsm"
+    "huawei_e303"
+    "at_modem"
+    "modem"
+    "sms_control"
+    "alerts"
+    "time"
     "os"
 //    "os/exec"
+    "strconv"
+    "sort"
     "strings"
+    "sync"
+    "os/signal"
+    "syscall"
     "net"
 //    "io/ioutil"
-    "net/http"
 )
 
 type module_io_daemon struct {
-	cfg *conf.Module_io_cfg
+	cfg_path string
+	cfg *conf.Module_io_cfg // guarded by reload_lock once commands are accepted
 	mio *mod_io.Mod_io
-	last_client_id int
+	ports *portmap.Map
+	timers *timers.Timers
+	scheduler *scheduler.Scheduler
+	sink *events.Sink
+	rules *rules.Rules
+	debounce *debounce.Debounce
+	poller *poller.Poller
+	watchdog *watchdog.Watchdog
+	gsm *gsm.Gsm // nil if modem is disabled
+	sms_control *sms_control.Sms_control // nil if disabled
+	alerts *alerts.Alerts // nil if no alerts configured
+	restore_lock sync.Mutex
+	restore_report string
+	host_lock sync.Mutex
+	host_last_cmd time.Time
+	host_lost bool
+	listeners []*listener.Listener
+	commands sync.WaitGroup // commands in progress
+	reload_lock sync.Mutex
+	shutdown_timeout time.Duration
+	sd_interval time.Duration // systemd watchdog ping interval, 0 if disabled
+	sd_last_ping time.Time
 }
 
 
@@ -23,44 +71,546 @@ func main() {
 	var err error
 	var md module_io_daemon
 
-	md.last_client_id = 1
+	cfg_path := flag.String("config", "",
+	                        "config file (default $MODULE_IO_CONFIG or " +
+	                        conf.CONFIG_FILE + ")")
+	check_config := flag.Bool("check-config", false,
+	                          "validate configuration and exit")
+	replay_file := flag.String("replay", "",
+	                           "decode UART capture file offline and exit")
+	flag.Parse()
+	md.cfg_path = conf.Config_path(*cfg_path)
 
-	md.cfg, err = conf.Conf_parse()
+	if *check_config {
+		os.Exit(do_check_config(md.cfg_path))
+	}
+
+	if *replay_file != "" {
+		os.Exit(replay(md.cfg_path, *replay_file))
+	}
+
+	md.cfg, err = conf.Conf_parse(md.cfg_path)
     if err != nil {
-        panic(fmt.Sprintf("main: can't get configuration: %v", err))
+        fatal("can't get configuration", err)
     }
 
-	md.mio, err = mod_io.New(md.cfg)
+	err = logging.Setup(&md.cfg.Log)
+	if err != nil {
+		fatal("can't setup logging", err)
+	}
+
+	md.ports, err = portmap.New(md.cfg.Module_name, md.cfg.Port)
+	if err != nil {
+		fatal("can't create port map", err)
+	}
+
+	md.mio, err = mod_io.New(md.cfg, md.ports)
+	if err != nil {
+		fatal("can't create mod_io", err)
+	}
+
+	md.restore_relays("daemon start")
+
+	md.timers = timers.New(md.mio, md.cfg.Timers_file)
+	err = md.timers.Restore(md.cfg.Timers_restore)
+	if err != nil {
+		slog.Error("can't restore timers", "module", "main", "err", err)
+	}
+
+	md.sink = events.New(md.cfg.Event_url, md.ports)
+	md.rules, err = rules.New(md.mio, md.timers, md.sink, md.ports, md.cfg.Rule)
+	if err != nil {
+		fatal("can't create rules", err)
+	}
+
+	md.debounce, err = debounce.New(&md.cfg.Debounce, md.dispatch_input)
+	if err != nil {
+		fatal("can't create input filter", err)
+	}
+
+	md.poller, err = poller.New(md.mio, md.cfg, md.dispatch_reconciled)
+	if err != nil {
+		fatal("can't create poller", err)
+	}
+	go md.poller.Run()
+
+	md.watchdog, err = watchdog.New(md.mio, &md.cfg.Watchdog, md.sink.Check)
+	if err != nil {
+		fatal("can't create watchdog", err)
+	}
+	go md.watchdog.Run()
+
+	md.scheduler, err = scheduler.New(md.mio, md.ports, md.cfg)
 	if err != nil {
-		panic(fmt.Sprintf("main: can't create mod_io: %v", err))
+		fatal("can't create scheduler", err)
+	}
+	go md.scheduler.Run()
+
+	if md.cfg.Modem.Enabled {
+		m, err := new_modem(&md.cfg.Modem)
+		if err != nil {
+			fatal("can't open modem", err)
+		}
+		md.gsm, err = gsm.New(m, &md.cfg.Modem)
+		if err != nil {
+			fatal("can't create modem service", err)
+		}
+		if md.cfg.Sms_control.Enabled {
+			md.sms_control = sms_control.New(md.mio, md.timers, md.ports, md.gsm,
+			                                 &md.cfg.Sms_control)
+			md.gsm.Set_sms_handler(md.sms_control.Handle)
+		}
+		go md.gsm.Run()
+
+		if len(md.cfg.Alert) > 0 {
+			md.alerts, err = alerts.New(md.mio, md.ports, md.gsm,
+			                            md.cfg.Alert, &md.cfg.Alerting)
+			if err != nil {
+				fatal("can't create alerts", err)
+			}
+			md.alerts.Run()
+			md.gsm.Set_event_handler(md.alerts.Event)
+		}
 	}
 
 	err = os.Chdir(md.cfg.Exec_path);
 	if err != nil {
-		panic(fmt.Sprintf("main: can't change current dir: %v", err))
+		fatal("can't change current dir", err)
+	}
+
+	md.shutdown_timeout, err = time.ParseDuration(md.cfg.Shutdown_timeout)
+	if err != nil {
+		fatal("incorrect shutdown_timeout", err)
+	}
+
+	// reload waits until startup is finished
+	md.reload_lock.Lock()
+	for i := range md.cfg.Listener {
+		ls, err := listener.New(&md.cfg.Listener[i], md.cfg.Role)
+		if err != nil {
+			fatal("can't create listener", err)
+		}
+		md.listeners = append(md.listeners, ls)
+		go md.do_listen_for_connections(ls)
+	}
+
+	if md.cfg.Host_timeout != "" {
+		timeout, err := time.ParseDuration(md.cfg.Host_timeout)
+		if err != nil {
+			fatal("incorrect host_timeout", err)
+		}
+		go md.do_watch_host(timeout)
 	}
 
-	go md.do_listen_for_connections()
+	go md.do_wait_signals()
+
+	if md.cfg.Metrics_listen != "" {
+		addr := md.cfg.Metrics_listen
+		go func() {
+			err := metrics.Listen(addr)
+			fatal("can't serve metrics", err)
+		}()
+	}
+	md.reload_lock.Unlock()
+
+	// main loop wakes up at least once per ping interval
+	var recv_timeout uint
+	if interval, ok := systemd.Watchdog_interval(); ok {
+		md.sd_interval = interval / 2
+		recv_timeout = uint(md.sd_interval / time.Millisecond)
+		if recv_timeout == 0 {
+			recv_timeout = 1
+		}
+	}
+	err = systemd.Notify("READY=1")
+	if err != nil {
+		slog.Warn("can't notify systemd", "module", "main", "err", err)
+	}
+	slog.Info("started", "module", "main")
 
 	// waiting actions
 	for {
-		msg := md.mio.Recv(0, []string{"AIP", "ASP"}, 0)
-		fmt.Println("recv msg = ", msg)
+		md.systemd_watchdog_ping()
+		msg := md.mio.Recv(0, []string{"AIP", "ASP"}, recv_timeout)
 		if msg == nil {
             continue
         }
+		slog.Info("board event", "module", "main", "si", msg.Si, "args", msg.Args)
 
         if msg.Si == "AIP" {
-            http.Get(fmt.Sprintf(
-                     "http://localhost:400/ioserver?io=usio1&port=%d&state=%d",
-                     msg.Args[1], msg.Args[2]))
+            md.debounce.Input(msg.Args[1], msg.Args[2])
             //run_action_script(md.cfg.Exec_script, "io_input", msg.Args[1], msg.Args[2])
 		}
 
-      /*  if msg.Si == "ASP" {
+        if msg.Si == "ASP" {
+            md.alerts.Event("board_restart", "")
+            go md.restore_relays("board restart")
            // run_action_script(md.cfg.Exec_script, "restart", 0, 0)
-        }*/
+        }
+	}
+}
+
+// Switch relays to safe states
+func (md *module_io_daemon) apply_safe_states(reason string) {
+	slog.Warn("apply relays safe states", "module", "main", "reason", reason)
+	results, err := md.mio.Apply_safe_states(md.mio.New_request_id())
+	for _, r := range results {
+		if r.Err != nil {
+			slog.Error("can't apply safe state", "module", "main",
+			           "port", r.Port, "state", r.State, "err", r.Err)
+		}
+	}
+	if err != nil {
+		slog.Error("can't apply safe states", "module", "main", "err", err)
+	}
+}
+
+// Apply safe states once if controlling host stops sending commands
+func (md *module_io_daemon) do_watch_host(timeout time.Duration) {
+	md.host_lock.Lock()
+	md.host_last_cmd = time.Now()
+	md.host_lock.Unlock()
+
+	for {
+		time.Sleep(time.Second)
+		md.host_lock.Lock()
+		lost := !md.host_lost && time.Since(md.host_last_cmd) > timeout
+		if lost {
+			md.host_lost = true
+		}
+		md.host_lock.Unlock()
+
+		if lost {
+			md.alerts.Event("host_lost", "")
+			md.apply_safe_states(fmt.Sprintf("no commands for %v", timeout))
+		}
+	}
+}
+
+func (md *module_io_daemon) do_wait_signals() {
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGTERM, syscall.SIGINT, syscall.SIGHUP)
+	for s := range sig {
+		if s == syscall.SIGHUP {
+			md.reload()
+			continue
+		}
+		md.shutdown(fmt.Sprintf("%v received", s))
+	}
+}
+
+// Ping systemd service watchdog from main loop, so wedged loop stops
+// pings. Board silent longer than ping interval is asked for input state,
+// ping is skipped if it does not answer
+func (md *module_io_daemon) systemd_watchdog_ping() {
+	if md.sd_interval == 0 || time.Since(md.sd_last_ping) < md.sd_interval {
+		return
+	}
+	if time.Since(md.mio.Last_rx()) > md.sd_interval {
+		_, err := md.mio.Read_input_port_state(md.mio.New_request_id(), 1)
+		if err != nil {
+			slog.Warn("board does not answer, systemd watchdog is not pinged",
+			          "module", "main", "err", err)
+			return
+		}
 	}
+	systemd.Notify("WATCHDOG=1")
+	md.sd_last_ping = time.Now()
+}
+
+// Re-read configuration, apply settings which can be changed without
+// restart and return report. Current settings are kept on any error.
+// If keys are given, only these settings are reloaded
+func (md *module_io_daemon) reload(keys ...string) (string, error) {
+	md.reload_lock.Lock()
+	defer md.reload_lock.Unlock()
+	systemd.Notify("RELOADING=1")
+	defer systemd.Notify("READY=1")
+
+	cfg, err := conf.Conf_parse(md.cfg_path)
+	if err == nil {
+		err = check_subsystems(cfg)
+	}
+	if err != nil {
+		slog.Error("configuration reload failed", "module", "main", "err", err)
+		return "", err
+	}
+
+	var applied, restart, kept []string
+	for _, key := range conf.Diff(md.cfg, cfg) {
+		if len(keys) > 0 && !contains(keys, key) {
+			kept = append(kept, key)
+			continue
+		}
+		switch key {
+		case "rule", "debounce", "port", "event_url", "job", "latitude", "longitude":
+			applied = append(applied, key)
+		case "log":
+			// only level can be changed live
+			log_cfg := cfg.Log
+			log_cfg.Level = md.cfg.Log.Level
+			if log_cfg == md.cfg.Log {
+				applied = append(applied, key)
+			} else {
+				restart = append(restart, key)
+			}
+		default:
+			restart = append(restart, key)
+		}
+	}
+	conf.Copy_keys(cfg, md.cfg, restart)
+	conf.Copy_keys(cfg, md.cfg, kept)
+	// port names used by other settings must be known first
+	sort.SliceStable(applied, func(i, j int) bool {
+		return applied[i] == "port" && applied[j] != "port"
+	})
+
+	// new settings are already checked, errors are not expected here
+	var failed []string
+	for _, key := range applied {
+		switch key {
+		case "rule":
+			err = md.rules.Reload(cfg.Rule)
+		case "debounce":
+			err = md.debounce.Reload(&cfg.Debounce)
+		case "port":
+			// rules resolve port names when loaded
+			err = md.ports.Reload(cfg.Port)
+			if err == nil {
+				err = md.rules.Reload(cfg.Rule)
+			}
+		case "event_url":
+			md.sink.Set_url(cfg.Event_url)
+		case "job", "latitude", "longitude":
+			err = md.scheduler.Reload(cfg)
+		case "log":
+			err = logging.Set_level(cfg.Log.Level)
+		}
+		if err != nil {
+			slog.Error("can't apply setting", "module", "main", "key", key, "err", err)
+			failed = append(failed, fmt.Sprintf("can't apply %s: %v", key, err))
+		}
+	}
+	md.cfg = cfg
+
+	slog.Info("configuration reloaded", "module", "main",
+	          "applied", strings.Join(applied, ","),
+	          "restart_required", strings.Join(restart, ","))
+	if len(applied) == 0 && len(restart) == 0 {
+		return "no changes", nil
+	}
+	var report []string
+	if len(applied) > 0 {
+		report = append(report, "applied: " + strings.Join(applied, ", "))
+	}
+	if len(restart) > 0 {
+		report = append(report, "restart required: " + strings.Join(restart, ", "))
+	}
+	report = append(report, failed...)
+	return strings.Join(report, "\n"), nil
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// Orderly shutdown: stop accepting commands, let running ones finish,
+// deliver queued events, apply safe relay states and close UART
+func (md *module_io_daemon) shutdown(reason string) {
+	systemd.Notify("STOPPING=1")
+	slog.Info("shutdown", "module", "main", "reason", reason)
+
+	for _, ls := range md.listeners {
+		ls.Close()
+	}
+
+	done := make(chan bool)
+	go func() {
+		md.commands.Wait()
+		close(done)
+	}()
+	select {
+	case <- done:
+	case <- time.After(md.shutdown_timeout):
+		slog.Warn("commands are still running", "module", "main")
+	}
+
+	// nothing may switch relays after safe states
+	md.rules.Stop()
+	if md.sms_control != nil {
+		md.sms_control.Stop()
+	}
+	md.scheduler.Stop()
+	md.timers.Stop()
+	md.watchdog.Stop()
+
+	err := md.sink.Close(md.shutdown_timeout)
+	if err != nil {
+		slog.Warn("events queue is not flushed", "module", "main", "err", err)
+	}
+
+	md.apply_safe_states(reason)
+	md.mio.Close()
+	slog.Info("stopped", "module", "main")
+	os.Exit(0)
+}
+
+// Apply relay restore policy and remember report
+func (md *module_io_daemon) restore_relays(reason string) {
+	md.restore_lock.Lock()
+	defer md.restore_lock.Unlock()
+
+	report := fmt.Sprintf("%s at %s:\n", reason, time.Now().Format(time.RFC3339))
+	for _, r := range md.mio.Restore_relays(md.mio.New_request_id()) {
+		slog.Info("relay restore", "module", "main", "reason", reason,
+		          "port", r.Port, "policy", r.Policy, "before", r.Before,
+		          "after", r.After, "changed", r.Changed, "err", r.Err)
+		switch {
+		case r.Err != nil:
+			report += fmt.Sprintf("relay %d (%s): error: %v\n", r.Port, r.Policy, r.Err)
+		case r.Changed:
+			report += fmt.Sprintf("relay %d (%s): %d -> %d\n",
+			                      r.Port, r.Policy, r.Before, r.After)
+		default:
+			report += fmt.Sprintf("relay %d (%s): %d unchanged\n",
+			                      r.Port, r.Policy, r.Before)
+		}
+	}
+	md.restore_report = report
+}
+
+// Pass filtered input change to rules and automation server
+func (md *module_io_daemon) dispatch_input(port int, state int) {
+	md.rules.Input_changed(port, state)
+	md.alerts.Input_changed(port, state)
+	md.sink.Send(&events.Event{Port: port, State: state})
+}
+
+// Pass input or relay change found by poller
+func (md *module_io_daemon) dispatch_reconciled(relay bool, port int, state int) {
+	if relay {
+		// relay switched by board or another client, only reported
+		md.sink.Send(&events.Event{Port: port, State: state, Relay: true,
+		                           Reconciled: true})
+		return
+	}
+	md.debounce.Reconcile(port, state)
+	md.rules.Input_changed(port, state)
+	md.alerts.Input_changed(port, state)
+	md.sink.Send(&events.Event{Port: port, State: state, Reconciled: true})
+}
+
+// Parse configuration with all drop-ins and check it, print errors
+func do_check_config(path string) int {
+	cfg, err := conf.Conf_parse(path)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %v\n", path, err)
+		return 1
+	}
+
+	err = check_subsystems(cfg)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %v\n", path, err)
+		return 1
+	}
+
+	fmt.Printf("%s: configuration ok\n", path)
+	return 0
+}
+
+// Create modem backend of configured type
+func new_modem(mcfg *conf.Modem_cfg) (modem.Modem, error) {
+	if mcfg.Type == "at" {
+		m, err := at_modem.New(mcfg)
+		if err != nil {
+			return nil, err
+		}
+		return m, nil
+	}
+	return huawei_e303.New(mcfg), nil
+}
+
+// Check settings which are validated by subsystems
+func check_subsystems(cfg *conf.Module_io_cfg) error {
+	var errs []string
+	ports, err := portmap.New(cfg.Module_name, cfg.Port)
+	if err != nil {
+		errs = append(errs, err.Error())
+	} else {
+		_, err = alerts.New(nil, ports, nil, cfg.Alert, &cfg.Alerting)
+		if err != nil {
+			errs = append(errs, err.Error())
+		}
+		_, err = rules.New(nil, nil, nil, ports, cfg.Rule)
+		if err != nil {
+			errs = append(errs, err.Error())
+		}
+	}
+	_, err = debounce.New(&cfg.Debounce, nil)
+	if err != nil {
+		errs = append(errs, err.Error())
+	}
+	_, err = scheduler.New(nil, ports, cfg)
+	if err != nil {
+		errs = append(errs, err.Error())
+	}
+	if cfg.Modem.Enabled {
+		_, err = gsm.New(nil, &cfg.Modem)
+		if err != nil {
+			errs = append(errs, err.Error())
+		}
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("incorrect configuration:\n%s", strings.Join(errs, "\n"))
+	}
+	return nil
+}
+
+// Feed UART capture through parser and dispatch, print decoded frames
+func replay(cfg_path string, file string) int {
+	cfg, err := conf.Conf_parse(cfg_path)
+	if err != nil {
+		cfg = new(conf.Module_io_cfg)
+	}
+
+	mio, err := mod_io.New_offline(cfg)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "replay: %v\n", err)
+		return 1
+	}
+
+	f, err := os.Open(file)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "replay: %v\n", err)
+		return 1
+	}
+	defer f.Close()
+
+	err = mio.Replay(f, func(rec *mod_io.Capture_record, msg *nmea0183.Nmea_msg) {
+		fmt.Printf("%s %s %s%s request_id=%d args=%v\n",
+		           rec.Time.Format(time.RFC3339Nano), rec.Dir,
+		           msg.Ti, msg.Si, msg.Request_id, msg.Args)
+	})
+
+	checksum_errors, parse_errors := mio.Parse_errors()
+	fmt.Printf("checksum errors: %d, format errors: %d\n",
+	           checksum_errors, parse_errors)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "replay: %v\n", err)
+		return 1
+	}
+	return 0
+}
+
+// Log fatal error and exit
+func fatal(msg string, err error) {
+	slog.Error(msg, "module", "main", "err", err)
+	os.Exit(1)
 }
 
 /*
@@ -86,30 +636,18 @@ func run_action_script(script string, action string, port int, state int) {
 }
 */
 
-func (md *module_io_daemon) do_listen_for_connections() {
-	os.Remove(md.cfg.Control_socket)
-    l, err := net.Listen("unix", md.cfg.Control_socket)
-    if err != nil {
-    	panic(fmt.Sprintf("main: can't listen socket: %s: %v",
-			    			md.cfg.Control_socket, err))
-    }
-
-    for {
-        fd, err := l.Accept()
-        if err != nil {
-	    	panic(fmt.Sprintf("main: can't accept new connection: %v", err))
-        }
-
-		md.last_client_id++
-		if md.last_client_id > 255 {
-			md.last_client_id = 1
-		}
-        go md.do_process_cmd(fd, md.last_client_id)
-    }
+func (md *module_io_daemon) do_listen_for_connections(ls *listener.Listener) {
+	err := ls.Serve(md.mio.New_request_id, md.do_process_cmd)
+	if err != nil {
+		fatal("listener failed", err)
+	}
 }
 
-func (md *module_io_daemon) do_process_cmd(fd net.Conn, client_id int) {
+func (md *module_io_daemon) do_process_cmd(fd net.Conn, peer *listener.Peer) {
+	md.commands.Add(1)
+	defer md.commands.Done()
 	defer fd.Close()
+	client_id := peer.Client_id
 
 	ret := ""
     buf := make([]byte, 512)
@@ -130,15 +668,176 @@ func (md *module_io_daemon) do_process_cmd(fd net.Conn, client_id int) {
         	continue
         }
 
+        md.host_lock.Lock()
+        md.host_last_cmd = time.Now()
+        md.host_lost = false
+        md.host_lock.Unlock()
+
         // split query by args
-        println("query = ", query)
+        slog.Info("command", "module", "main", "query", query,
+                  "client_id", client_id, "listener", peer.Listener,
+                  "remote", peer.Remote)
         cmd, args := parse_query(query)
+        if !peer.Allowed(cmd) {
+	        slog.Warn("access denied", "module", "main", "cmd", cmd,
+	                  "client_id", client_id, "listener", peer.Listener,
+	                  "remote", peer.Remote, "role", peer.Role)
+	        fd.Write([]byte("access denied"))
+	        continue
+        }
+
+        if md.watchdog.Managed() && strings.HasPrefix(cmd, "wdt_") &&
+           cmd != "wdt_status" {
+	        fd.Write([]byte("watchdog is managed by daemon"))
+	        continue
+        }
+
         switch cmd {
         case "relay_set":
-	        var port, new_state int
-	        fmt.Sscanf(args[0], "%d", &port)
-	        fmt.Sscanf(args[1], "%d", &new_state)
-	        err := md.mio.Relay_set_state(client_id, port, new_state)
+	        port, err := md.port_arg(portmap.OUTPUT, args, 0)
+	        if err != nil || (len(args) != 2 && len(args) != 4) ||
+	           (len(args) == 4 && args[2] != "after") {
+		        ret = fmt.Sprintf("usage: relay_set <port> <state> [after <delay>]: %v", err)
+		        break
+	        }
+	        new_state, err := strconv.Atoi(args[1])
+	        if err != nil || (new_state != 0 && new_state != 1) {
+		        ret = fmt.Sprintf("incorrect state '%s', 0 or 1 expected", args[1])
+		        break
+	        }
+	        new_state = md.ports.Physical(portmap.OUTPUT, port, new_state)
+	        if len(args) == 4 {
+		        delay, err := time.ParseDuration(args[3])
+		        if err != nil || delay <= 0 {
+			        ret = fmt.Sprintf("incorrect delay '%s', positive duration expected",
+			                          args[3])
+			        break
+		        }
+		        ret = fmt.Sprintf("ok %d", md.timers.Set_after(port, new_state, delay))
+		        break
+	        }
+	        err = md.mio.Relay_set_state(client_id, port, new_state)
+	        if err == nil {
+		        ret = "ok"
+	        } else {
+	        	ret = fmt.Sprintf("%v", err)
+	        }
+	        break;
+
+        case "relay_set_many":
+	        ret = md.do_relay_set_many(client_id, args)
+	        break;
+
+        case "relay_pulse":
+	        port, err := md.port_arg(portmap.OUTPUT, args, 0)
+	        if err != nil || len(args) < 2 {
+		        ret = fmt.Sprintf("usage: relay_pulse <port> <ms>: %v", err)
+		        break
+	        }
+	        ms, err := strconv.Atoi(args[1])
+	        if err != nil || ms <= 0 {
+		        ret = fmt.Sprintf("incorrect pulse duration '%s', positive ms expected",
+		                          args[1])
+		        break
+	        }
+	        id, err := md.timers.Pulse(client_id, port,
+	                                   md.ports.Physical(portmap.OUTPUT, port, 1),
+	                                   time.Duration(ms) * time.Millisecond)
+	        if err == nil {
+		        ret = fmt.Sprintf("ok %d", id)
+	        } else {
+	        	ret = fmt.Sprintf("%v", err)
+	        }
+	        break;
+
+        case "timer_list":
+	        ret = ""
+	        for _, tm := range md.timers.List() {
+		        kind := "set"
+		        if tm.Pulse {
+			        kind = "pulse"
+		        }
+		        ret += fmt.Sprintf("%d %s port=%s state=%d due=%s\n",
+		                           tm.Id, kind, md.ports.Label(portmap.OUTPUT, tm.Port),
+		                           md.ports.Logical(portmap.OUTPUT, tm.Port, tm.State),
+		                           tm.Due.Format(time.RFC3339))
+	        }
+	        break;
+
+        case "timer_cancel":
+	        if len(args) < 1 {
+		        ret = "usage: timer_cancel <id>"
+		        break
+	        }
+	        id, err := strconv.Atoi(args[0])
+	        if err != nil {
+		        ret = fmt.Sprintf("incorrect timer id '%s'", args[0])
+		        break
+	        }
+	        err = md.timers.Cancel(id)
+	        if err == nil {
+		        ret = "ok"
+	        } else {
+	        	ret = fmt.Sprintf("%v", err)
+	        }
+	        break;
+
+        case "job_list":
+	        ret = ""
+	        for _, job := range md.scheduler.List() {
+		        next := "never"
+		        if !job.Next.IsZero() {
+			        next = job.Next.Format(time.RFC3339)
+		        }
+		        last := "never"
+		        if !job.Last_run.IsZero() {
+			        last = fmt.Sprintf("%s (%s)", job.Last_run.Format(time.RFC3339),
+			                           job.Last_result)
+		        }
+		        ret += fmt.Sprintf("%s enabled=%v port=%s state=%d " +
+		                           "schedule='%s' next=%s last=%s\n",
+		                           job.Name, job.Enabled,
+		                           md.ports.Label(portmap.OUTPUT, job.Port), job.State,
+		                           job.Schedule, next, last)
+	        }
+	        break;
+
+        case "job_enable", "job_disable":
+	        if len(args) < 1 {
+		        ret = fmt.Sprintf("usage: %s <name>", cmd)
+		        break
+	        }
+	        err := md.scheduler.Set_enabled(args[0], cmd == "job_enable")
+	        if err == nil {
+		        ret = "ok"
+	        } else {
+	        	ret = fmt.Sprintf("%v", err)
+	        }
+	        break;
+
+        case "job_add":
+	        // job_add <name> <port> <state> <schedule>
+	        var state int
+	        port, err := md.port_arg(portmap.OUTPUT, args, 1)
+	        if err != nil || len(args) < 4 {
+		        ret = fmt.Sprintf("usage: job_add <name> <port> <state> <schedule>: %v", err)
+		        break
+	        }
+	        fmt.Sscanf(args[2], "%d", &state)
+	        err = md.scheduler.Add(args[0], port, state, strings.Join(args[3:], " "))
+	        if err == nil {
+		        ret = "ok"
+	        } else {
+	        	ret = fmt.Sprintf("%v", err)
+	        }
+	        break;
+
+        case "job_del":
+	        if len(args) < 1 {
+		        ret = "usage: job_del <name>"
+		        break
+	        }
+	        err := md.scheduler.Remove(args[0])
 	        if err == nil {
 		        ret = "ok"
 	        } else {
@@ -146,35 +845,199 @@ func (md *module_io_daemon) do_process_cmd(fd net.Conn, client_id int) {
 	        }
 	        break;
 
+        case "rule_list":
+	        ret = strings.Join(md.rules.List(), "\n")
+	        break;
+
+        case "config_reload":
+	        report, err := md.reload()
+	        if err == nil {
+		        ret = "ok\n" + report
+	        } else {
+	        	ret = fmt.Sprintf("%v\nconfiguration is not changed", err)
+	        }
+	        break;
+
+        case "rules_reload":
+	        report, err := md.reload("rule")
+	        if err == nil {
+		        ret = "ok\n" + report
+	        } else {
+	        	ret = fmt.Sprintf("%v\nrules are not changed", err)
+	        }
+	        break;
+
+        case "status":
+	        ps := md.poller.Stats()
+	        ret = fmt.Sprintf("poller cycles=%d polls=%d errors=%d " +
+	                          "input_drifts=%d output_drifts=%d\n",
+	                          ps.Cycles, ps.Polls, ps.Errors,
+	                          ps.Input_drifts, ps.Output_drifts)
+	        for _, st := range md.debounce.Stats() {
+		        ret += fmt.Sprintf("input %s state=%d raw=%d delivered=%d suppressed=%d\n",
+		                           md.ports.Label(portmap.INPUT, st.Port),
+		                           md.ports.Logical(portmap.INPUT, st.Port, st.State),
+		                           st.Raw, st.Delivered, st.Suppressed)
+	        }
+	        break;
+
+        case "all_states":
+	        inputs, outputs, err := md.mio.All_states(client_id)
+	        if err != nil {
+		        ret = fmt.Sprintf("%v", err)
+		        break
+	        }
+	        ret = ""
+	        for _, st := range inputs {
+		        ret += strings.TrimSpace(fmt.Sprintf("input %d %d %s %s %s", st.Port,
+		                           md.ports.Logical(portmap.INPUT, st.Port, st.State),
+		                           st.Source, st.Time.Format(time.RFC3339),
+		                           md.ports.Name(portmap.INPUT, st.Port))) + "\n"
+	        }
+	        for _, st := range outputs {
+		        ret += strings.TrimSpace(fmt.Sprintf("relay %d %d %s %s %s", st.Port,
+		                           md.ports.Logical(portmap.OUTPUT, st.Port, st.State),
+		                           st.Source, st.Time.Format(time.RFC3339),
+		                           md.ports.Name(portmap.OUTPUT, st.Port))) + "\n"
+	        }
+	        break;
+
+        case "port_list":
+	        ret = ""
+	        for _, p := range md.ports.List() {
+		        ret += fmt.Sprintf("%s %d %s kind=%s inverted=%v tags=%s %s\n",
+		                           p.Direction, p.Port, p.Name, p.Kind, p.Inverted,
+		                           strings.Join(p.Tags, ","), p.Description)
+	        }
+	        break;
+
+        case "restore_report":
+	        md.restore_lock.Lock()
+	        ret = md.restore_report
+	        md.restore_lock.Unlock()
+	        break;
+
         case "relay_get":
-	        var port int
-	        fmt.Sscanf(args[0], "%d", &port)
+	        port, err := md.port_arg(portmap.OUTPUT, args, 0)
+	        if err != nil {
+		        ret = fmt.Sprintf("%v", err)
+		        break
+	        }
 	        state, err := md.mio.Get_output_port_state(client_id, port)
 	        if err == nil {
-		        ret = fmt.Sprintf("%d", state)
+		        ret = fmt.Sprintf("%d", md.ports.Logical(portmap.OUTPUT, port, state))
 	        } else {
 	        	ret = fmt.Sprintf("%v", err)
 	        }
 	        break;
 
         case "input_get":
-	        var port int
-	        fmt.Sscanf(args[0], "%d", &port)
+	        port, err := md.port_arg(portmap.INPUT, args, 0)
+	        if err != nil {
+		        ret = fmt.Sprintf("%v", err)
+		        break
+	        }
 	        state, err := md.mio.Get_input_port_state(client_id, port)
 	        if err == nil {
-                ret = fmt.Sprintf("%d", state)
+                ret = fmt.Sprintf("%d", md.ports.Logical(portmap.INPUT, port, state))
 	        } else {
                 ret = fmt.Sprintf("%v", err)
 	        }
 	        break;
 
+        case "modem_status":
+	        if md.gsm == nil {
+		        ret = "modem is disabled"
+		        break
+	        }
+	        st := md.gsm.Status()
+	        last := "never"
+	        if !st.Last_poll.IsZero() {
+		        last = st.Last_poll.Format(time.RFC3339)
+	        }
+	        ret = fmt.Sprintf("up=%v connected=%v connection_status=%d signal=%d " +
+	                          "network_type=%d roaming=%v wan_ip=%s queue=%d " +
+	                          "sent=%d failed=%d received=%d last_poll=%s",
+	                          st.Up, st.Connection_status == gsm.CONNECTED,
+	                          st.Connection_status, st.Signal_strength,
+	                          st.Network_type, st.Roaming, st.Wan_ip, st.Queue,
+	                          st.Sent, st.Failed, st.Received, last)
+	        if !st.Balance_time.IsZero() {
+		        ret += fmt.Sprintf(" balance=%.2f balance_time=%s", st.Balance,
+		                           st.Balance_time.Format(time.RFC3339))
+	        }
+	        if st.Last_err != "" {
+		        ret += " err=" + st.Last_err
+	        }
+	        break;
+
+        case "alert_list":
+	        ret = ""
+	        for _, al := range md.alerts.List() {
+		        last := "never"
+		        if !al.Last_sent.IsZero() {
+			        last = al.Last_sent.Format(time.RFC3339)
+		        }
+		        ret += fmt.Sprintf("%s %s sent=%d suppressed=%d last_sent=%s\n",
+		                           al.Name, al.Trigger, al.Sent, al.Suppressed, last)
+	        }
+	        break;
+
+        case "ussd":
+	        // ussd <code>
+	        if md.gsm == nil {
+		        ret = "modem is disabled"
+		        break
+	        }
+	        if len(args) != 1 {
+		        ret = "usage: ussd <code>"
+		        break
+	        }
+	        reply, err := md.gsm.Ussd(args[0])
+	        if err == nil {
+		        ret = reply
+	        } else {
+	        	ret = fmt.Sprintf("%v", err)
+	        }
+	        break;
+
+        case "sms_send":
+	        // sms_send <phone>[,<phone>...] <text>
+	        if md.gsm == nil {
+		        ret = "modem is disabled"
+		        break
+	        }
+	        if len(args) < 2 {
+		        ret = "usage: sms_send <phone>[,<phone>...] <text>"
+		        break
+	        }
+	        err := md.gsm.Send_sms(strings.Split(args[0], ","),
+	                               strings.Join(args[1:], " "))
+	        if err == nil {
+		        ret = "ok"
+	        } else {
+	        	ret = fmt.Sprintf("%v", err)
+	        }
+	        break;
+
         case "wdt_reset":
-	        println("wdt_reset")
-	        md.mio.Wdt_reset()
+	        md.mio.Wdt_reset(client_id)
+	        break;
+
+        case "wdt_status":
+	        st := md.watchdog.Status()
+	        last := "never"
+	        if !st.Last_reset.IsZero() {
+		        last = st.Last_reset.Format(time.RFC3339)
+	        }
+	        ret = fmt.Sprintf("managed=%v healthy=%v resets=%d last_reset=%s",
+	                          st.Managed, st.Healthy, st.Resets, last)
+	        if len(st.Failed) > 0 {
+		        ret += " failed=" + strings.Join(st.Failed, ",")
+	        }
 	        break;
 
         case "wdt_off":
-	        println("wdt_off")
 	        err := md.mio.Wdt_set_state(client_id, 0)
 	        if err == nil {
 		        ret = "ok"
@@ -184,7 +1047,6 @@ func (md *module_io_daemon) do_process_cmd(fd net.Conn, client_id int) {
 	        break;
 
         case "wdt_on":
-	        println("wdt_on")
 	        err := md.mio.Wdt_set_state(client_id, 1)
 	        if err == nil {
 		        ret = "ok"
@@ -193,10 +1055,62 @@ func (md *module_io_daemon) do_process_cmd(fd net.Conn, client_id int) {
 	        }
 	        break;
         }
+        slog.Debug("command reply", "module", "main", "cmd", cmd,
+                   "client_id", client_id, "reply", ret)
         fd.Write([]byte(ret))
 	}
 }
 
+// relay_set_many [atomic] <port>:<state> ...
+func (md *module_io_daemon) do_relay_set_many(client_id int, args []string) string {
+	atomic := false
+	if len(args) > 0 && args[0] == "atomic" {
+		atomic = true
+		args = args[1:]
+	}
+
+	if len(args) == 0 {
+		return "no ports specified"
+	}
+
+	var ops []mod_io.Relay_op
+	for _, arg := range args {
+		var op mod_io.Relay_op
+		sep := strings.LastIndex(arg, ":")
+		if sep < 0 {
+			return fmt.Sprintf("incorrect argument '%s'", arg)
+		}
+		port, err := md.ports.Resolve(portmap.OUTPUT, arg[:sep])
+		if err == nil {
+			_, err = fmt.Sscanf(arg[sep + 1:], "%d", &op.State)
+		}
+		if err != nil {
+			return fmt.Sprintf("incorrect argument '%s'", arg)
+		}
+		op.Port = port
+		op.State = md.ports.Physical(portmap.OUTPUT, port, op.State)
+		ops = append(ops, op)
+	}
+
+	results, err := md.mio.Relay_set_many(client_id, ops, atomic)
+	ret := "ok"
+	if err != nil {
+		ret = fmt.Sprintf("%v", err)
+	}
+	for _, r := range results {
+		ret += fmt.Sprintf(" %s:%s", md.ports.Label(portmap.OUTPUT, r.Port), r.Status)
+	}
+	return ret
+}
+
+// Return port given by number or name in args[i]
+func (md *module_io_daemon) port_arg(direction string, args []string, i int) (int, error) {
+	if i >= len(args) {
+		return 0, fmt.Errorf("port is not specified")
+	}
+	return md.ports.Resolve(direction, args[i])
+}
+
 func parse_query(query string) (string, []string) {
 	var cmd string
 	var args []string
@@ -0,0 +1,271 @@
+package listener
+
+import (
+	"conf"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"log/slog"
+	"metrics"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+	"systemd"
+	"time"
+)
+
+// Client which connected but did not complete TLS handshake is dropped
+const HANDSHAKE_TIMEOUT = 10 * time.Second
+
+// Control socket client description
+type Peer struct {
+	Client_id int
+	Listener string
+	Remote string
+	Role string
+	allow map[string]bool // nil means all commands are allowed
+}
+
+// Function to serve one client connection
+type Handler func(fd net.Conn, peer *Peer)
+
+type Listener struct {
+	sync.Mutex
+	cfg *conf.Listener_cfg
+	l net.Listener
+	closed bool
+	tls_cfg *tls.Config
+	allow map[string]bool
+	roles map[string]map[string]bool
+}
+
+var (
+	stat_connections = metrics.New_counter("module_io_control_connections_total",
+	                                       "Control socket connections", "listener")
+	stat_rejected = metrics.New_counter("module_io_control_rejected_total",
+	                                    "Control connections rejected on TLS " +
+	                                    "handshake or missing role", "listener")
+)
+
+// systemd sockets are fetched once for all listeners
+var sd_files map[string]*os.File
+
+func make_allow_list(commands []string) map[string]bool {
+	if len(commands) == 0 {
+		return nil
+	}
+
+	allow := make(map[string]bool)
+	for _, cmd := range commands {
+		if cmd == "*" {
+			return nil
+		}
+		allow[cmd] = true
+	}
+	return allow
+}
+
+func New(lcfg *conf.Listener_cfg, roles map[string]conf.Role_cfg) (*Listener, error) {
+	var err error
+
+	ls := new(Listener)
+	ls.cfg = lcfg
+	ls.allow = make_allow_list(lcfg.Allow)
+
+	if lcfg.Tls_cert != "" {
+		ls.tls_cfg, err = make_tls_config(lcfg)
+		if err != nil {
+			return nil, err
+		}
+
+		if len(lcfg.Roles) > 0 {
+			ls.roles = make(map[string]map[string]bool)
+			for cn, role := range lcfg.Roles {
+				rcfg, ok := roles[role]
+				if !ok {
+					return nil, fmt.Errorf("listener %s: unknown role '%s' for '%s'",
+					                       lcfg.Name, role, cn)
+				}
+				ls.roles[cn] = make_allow_list(rcfg.Allow)
+			}
+		}
+	}
+
+	switch lcfg.Type {
+	case "unix":
+		os.Remove(lcfg.Path)
+		ls.l, err = net.Listen("unix", lcfg.Path)
+		if err != nil {
+			return nil, fmt.Errorf("listener %s: can't listen socket %s: %v",
+			                       lcfg.Name, lcfg.Path, err)
+		}
+
+		if lcfg.Mode != "" {
+			mode, err := strconv.ParseUint(lcfg.Mode, 8, 32)
+			if err != nil {
+				return nil, fmt.Errorf("listener %s: incorrect mode '%s'",
+				                       lcfg.Name, lcfg.Mode)
+			}
+			err = os.Chmod(lcfg.Path, os.FileMode(mode))
+			if err != nil {
+				return nil, fmt.Errorf("listener %s: can't chmod %s: %v",
+				                       lcfg.Name, lcfg.Path, err)
+			}
+		}
+
+	case "tcp":
+		if ls.tls_cfg == nil {
+			return nil, fmt.Errorf("listener %s: tcp listener requires tls", lcfg.Name)
+		}
+		ls.l, err = net.Listen("tcp", lcfg.Address)
+		if err != nil {
+			return nil, fmt.Errorf("listener %s: can't listen %s: %v",
+			                       lcfg.Name, lcfg.Address, err)
+		}
+
+	case "systemd":
+		if sd_files == nil {
+			sd_files, err = systemd.Listen_fds()
+			if err != nil {
+				return nil, err
+			}
+		}
+		file, ok := sd_files[lcfg.Fd_name]
+		if !ok {
+			return nil, fmt.Errorf("listener %s: systemd socket '%s' is not passed",
+			                       lcfg.Name, lcfg.Fd_name)
+		}
+		ls.l, err = net.FileListener(file)
+		if err != nil {
+			return nil, fmt.Errorf("listener %s: can't use systemd socket '%s': %v",
+			                       lcfg.Name, lcfg.Fd_name, err)
+		}
+		file.Close()
+
+	default:
+		return nil, fmt.Errorf("listener %s: unknown type '%s'", lcfg.Name, lcfg.Type)
+	}
+
+	if ls.tls_cfg != nil {
+		ls.l = tls.NewListener(ls.l, ls.tls_cfg)
+	}
+
+	return ls, nil
+}
+
+func make_tls_config(lcfg *conf.Listener_cfg) (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(lcfg.Tls_cert, lcfg.Tls_key)
+	if err != nil {
+		return nil, fmt.Errorf("listener %s: can't load certificate: %v",
+		                       lcfg.Name, err)
+	}
+
+	if lcfg.Tls_ca == "" {
+		return nil, fmt.Errorf("listener %s: tls_ca is required " +
+		                       "for client certificates verification", lcfg.Name)
+	}
+
+	ca_pem, err := ioutil.ReadFile(lcfg.Tls_ca)
+	if err != nil {
+		return nil, fmt.Errorf("listener %s: can't read CA %s: %v",
+		                       lcfg.Name, lcfg.Tls_ca, err)
+	}
+
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(ca_pem) {
+		return nil, fmt.Errorf("listener %s: no certificates in %s",
+		                       lcfg.Name, lcfg.Tls_ca)
+	}
+
+	return &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		ClientCAs: pool,
+		ClientAuth: tls.RequireAndVerifyClientCert,
+		MinVersion: tls.VersionTLS12,
+	}, nil
+}
+
+// Accept connections and run handler for each of them
+func (ls *Listener) Serve(new_client_id func() int, handler Handler) error {
+	for {
+		fd, err := ls.l.Accept()
+		if err != nil {
+			ls.Lock()
+			closed := ls.closed
+			ls.Unlock()
+			if closed {
+				return nil
+			}
+			return fmt.Errorf("listener %s: can't accept new connection: %v",
+			                  ls.cfg.Name, err)
+		}
+
+		stat_connections.Inc(ls.cfg.Name)
+		peer := &Peer{Client_id: new_client_id(),
+		              Listener: ls.cfg.Name,
+		              Remote: fd.RemoteAddr().String(),
+		              allow: ls.allow}
+		go ls.serve_client(fd, peer, handler)
+	}
+}
+
+func (ls *Listener) serve_client(fd net.Conn, peer *Peer, handler Handler) {
+	tls_conn, ok := fd.(*tls.Conn)
+	if ok {
+		tls_conn.SetDeadline(time.Now().Add(HANDSHAKE_TIMEOUT))
+		err := tls_conn.Handshake()
+		if err != nil {
+			slog.Warn("tls handshake failed", "module", "listener",
+			          "listener", ls.cfg.Name, "remote", peer.Remote,
+			          "client_id", peer.Client_id, "err", err)
+			stat_rejected.Inc(ls.cfg.Name)
+			fd.Close()
+			return
+		}
+		tls_conn.SetDeadline(time.Time{})
+
+		state := tls_conn.ConnectionState()
+		cn := state.PeerCertificates[0].Subject.CommonName
+		peer.Remote = fmt.Sprintf("%s (%s)", cn, peer.Remote)
+
+		if ls.roles != nil {
+			allow, ok := ls.roles[cn]
+			if !ok {
+				slog.Warn("client has no role", "module", "listener",
+				          "listener", ls.cfg.Name, "remote", peer.Remote,
+				          "client_id", peer.Client_id)
+				stat_rejected.Inc(ls.cfg.Name)
+				fd.Close()
+				return
+			}
+			peer.Role = ls.cfg.Roles[cn]
+			peer.allow = allow
+		}
+	}
+
+	slog.Debug("client connected", "module", "listener", "listener", ls.cfg.Name,
+	           "remote", peer.Remote, "role", peer.Role, "client_id", peer.Client_id)
+	handler(fd, peer)
+}
+
+// Stop accepting connections, unix socket file is removed
+func (ls *Listener) Close() {
+	ls.Lock()
+	ls.closed = true
+	ls.Unlock()
+
+	ls.l.Close()
+	if ls.cfg.Type == "unix" {
+		os.Remove(ls.cfg.Path)
+	}
+}
+
+// Check access to command
+func (p *Peer) Allowed(cmd string) bool {
+	if p.allow == nil {
+		return true
+	}
+	return p.allow[cmd]
+}
@@ -0,0 +1,238 @@
+package logging
+
+import (
+	"conf"
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"log/syslog"
+	"net"
+	"os"
+	"strings"
+	"sync"
+)
+
+const JOURNALD_SOCKET = "/run/systemd/journal/socket"
+
+var level = new(slog.LevelVar)
+
+// Configure default slog logger
+func Setup(lcfg *conf.Log_cfg) error {
+	err := Set_level(lcfg.Level)
+	if err != nil {
+		return err
+	}
+
+	opts := &slog.HandlerOptions{Level: level}
+	var handler slog.Handler
+
+	switch lcfg.Target {
+	case "", "stdout", "stderr":
+		var w io.Writer = os.Stdout
+		if lcfg.Target == "stderr" {
+			w = os.Stderr
+		}
+		switch lcfg.Format {
+		case "", "text":
+			handler = slog.NewTextHandler(w, opts)
+		case "json":
+			handler = slog.NewJSONHandler(w, opts)
+		default:
+			return fmt.Errorf("logging: unknown format '%s'", lcfg.Format)
+		}
+
+	case "journald":
+		conn, err := net.Dial("unixgram", JOURNALD_SOCKET)
+		if err != nil {
+			return fmt.Errorf("logging: can't connect to journald: %v", err)
+		}
+		handler = &record_handler{emit: journald_emitter(conn, lcfg.Tag),
+		                          lock: new(sync.Mutex)}
+
+	case "syslog":
+		w, err := syslog.New(syslog.LOG_DAEMON | syslog.LOG_INFO, lcfg.Tag)
+		if err != nil {
+			return fmt.Errorf("logging: can't connect to syslog: %v", err)
+		}
+		handler = &record_handler{emit: syslog_emitter(w),
+		                          lock: new(sync.Mutex)}
+
+	default:
+		return fmt.Errorf("logging: unknown target '%s'", lcfg.Target)
+	}
+
+	slog.SetDefault(slog.New(handler))
+	return nil
+}
+
+// Change log level at runtime
+func Set_level(name string) error {
+	switch strings.ToLower(name) {
+	case "debug":
+		level.Set(slog.LevelDebug)
+	case "", "info":
+		level.Set(slog.LevelInfo)
+	case "warn", "warning":
+		level.Set(slog.LevelWarn)
+	case "error":
+		level.Set(slog.LevelError)
+	default:
+		return fmt.Errorf("logging: unknown level '%s'", name)
+	}
+	return nil
+}
+
+// Function writing one log record to target
+type emitter func(lvl slog.Level, msg string, attrs []slog.Attr) error
+
+// Handler passing flattened attributes to emitter, used for
+// journald and syslog targets
+type record_handler struct {
+	emit emitter
+	lock *sync.Mutex // shared by handlers derived by With*
+	attrs []slog.Attr
+	prefix string // group prefix
+}
+
+func (h *record_handler) Enabled(ctx context.Context, lvl slog.Level) bool {
+	return lvl >= level.Level()
+}
+
+func (h *record_handler) flatten(prefix string, a slog.Attr, out []slog.Attr) []slog.Attr {
+	v := a.Value.Resolve()
+	if v.Kind() == slog.KindGroup {
+		p := prefix
+		if a.Key != "" {
+			p += a.Key + "."
+		}
+		for _, ga := range v.Group() {
+			out = h.flatten(p, ga, out)
+		}
+		return out
+	}
+	if a.Key == "" {
+		return out
+	}
+	return append(out, slog.Attr{Key: prefix + a.Key, Value: v})
+}
+
+func (h *record_handler) Handle(ctx context.Context, r slog.Record) error {
+	attrs := append([]slog.Attr(nil), h.attrs...)
+	r.Attrs(func(a slog.Attr) bool {
+		attrs = h.flatten(h.prefix, a, attrs)
+		return true
+	})
+
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	return h.emit(r.Level, r.Message, attrs)
+}
+
+func (h *record_handler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	nh := *h
+	nh.attrs = append([]slog.Attr(nil), h.attrs...)
+	for _, a := range attrs {
+		nh.attrs = h.flatten(h.prefix, a, nh.attrs)
+	}
+	return &nh
+}
+
+func (h *record_handler) WithGroup(name string) slog.Handler {
+	if name == "" {
+		return h
+	}
+	nh := *h
+	nh.prefix = h.prefix + name + "."
+	return &nh
+}
+
+// Format attributes as "key=value" pairs
+func format_attrs(attrs []slog.Attr) string {
+	var parts []string
+	for _, a := range attrs {
+		v := a.Value.String()
+		if strings.ContainsAny(v, " \"=") {
+			v = fmt.Sprintf("%q", v)
+		}
+		parts = append(parts, a.Key + "=" + v)
+	}
+	return strings.Join(parts, " ")
+}
+
+func syslog_emitter(w *syslog.Writer) emitter {
+	return func(lvl slog.Level, msg string, attrs []slog.Attr) error {
+		line := msg
+		if len(attrs) > 0 {
+			line += " " + format_attrs(attrs)
+		}
+		switch {
+		case lvl >= slog.LevelError:
+			return w.Err(line)
+		case lvl >= slog.LevelWarn:
+			return w.Warning(line)
+		case lvl >= slog.LevelInfo:
+			return w.Info(line)
+		}
+		return w.Debug(line)
+	}
+}
+
+// Journal field names must be uppercase letters, digits and underscores
+func journal_field(key string) string {
+	var b strings.Builder
+	for _, c := range strings.ToUpper(key) {
+		if (c >= 'A' && c <= 'Z') || (c >= '0' && c <= '9') || c == '_' {
+			b.WriteRune(c)
+		} else {
+			b.WriteRune('_')
+		}
+	}
+	name := strings.TrimLeft(b.String(), "_0123456789")
+	if name == "" {
+		return "FIELD"
+	}
+	return name
+}
+
+// Append field in journald native protocol format
+func journal_append(b *strings.Builder, key string, value string) {
+	if !strings.Contains(value, "\n") {
+		b.WriteString(key + "=" + value + "\n")
+		return
+	}
+
+	// multi-line values are sent with explicit little endian length
+	b.WriteString(key + "\n")
+	n := uint64(len(value))
+	for i := 0; i < 8; i++ {
+		b.WriteByte(byte(n >> (8 * uint(i))))
+	}
+	b.WriteString(value + "\n")
+}
+
+func journald_emitter(conn net.Conn, tag string) emitter {
+	return func(lvl slog.Level, msg string, attrs []slog.Attr) error {
+		priority := "6"
+		switch {
+		case lvl >= slog.LevelError:
+			priority = "3"
+		case lvl >= slog.LevelWarn:
+			priority = "4"
+		case lvl < slog.LevelInfo:
+			priority = "7"
+		}
+
+		var b strings.Builder
+		journal_append(&b, "MESSAGE", msg)
+		journal_append(&b, "PRIORITY", priority)
+		if tag != "" {
+			journal_append(&b, "SYSLOG_IDENTIFIER", tag)
+		}
+		for _, a := range attrs {
+			journal_append(&b, journal_field(a.Key), a.Value.String())
+		}
+		_, err := conn.Write([]byte(b.String()))
+		return err
+	}
+}
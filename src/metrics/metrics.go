@@ -0,0 +1,212 @@
+package metrics
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Minimal Prometheus text format registry
+
+type metric_kind int
+
+const (
+	COUNTER metric_kind = iota
+	GAUGE
+	HISTOGRAM
+)
+
+// Default latency buckets, seconds
+var LATENCY_BUCKETS = []float64{0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5}
+
+type series struct {
+	labels []string
+	value float64
+	counts []uint64 // histogram buckets
+	sum float64
+	count uint64
+}
+
+type Metric struct {
+	sync.Mutex
+	name string
+	help string
+	kind metric_kind
+	label_names []string
+	buckets []float64
+	series map[string]*series
+}
+
+type Registry struct {
+	sync.Mutex
+	metrics []*Metric
+}
+
+var Default = new(Registry)
+
+func (r *Registry) add(name string, help string, kind metric_kind,
+                       label_names []string, buckets []float64) *Metric {
+	m := &Metric{name: name,
+	             help: help,
+	             kind: kind,
+	             label_names: label_names,
+	             buckets: buckets,
+	             series: make(map[string]*series)}
+	r.Lock()
+	r.metrics = append(r.metrics, m)
+	r.Unlock()
+	return m
+}
+
+func New_counter(name string, help string, label_names ...string) *Metric {
+	return Default.add(name, help, COUNTER, label_names, nil)
+}
+
+func New_gauge(name string, help string, label_names ...string) *Metric {
+	return Default.add(name, help, GAUGE, label_names, nil)
+}
+
+func New_histogram(name string, help string, buckets []float64,
+                   label_names ...string) *Metric {
+	return Default.add(name, help, HISTOGRAM, label_names, buckets)
+}
+
+// Must be called with lock held
+func (m *Metric) get(labels []string) *series {
+	if len(labels) != len(m.label_names) {
+		panic(fmt.Sprintf("metrics: %s requires %d labels", m.name, len(m.label_names)))
+	}
+
+	key := strings.Join(labels, "\x00")
+	s, ok := m.series[key]
+	if !ok {
+		s = &series{labels: append([]string(nil), labels...)}
+		if m.kind == HISTOGRAM {
+			s.counts = make([]uint64, len(m.buckets))
+		}
+		m.series[key] = s
+	}
+	return s
+}
+
+func (m *Metric) Add(v float64, labels ...string) {
+	m.Lock()
+	m.get(labels).value += v
+	m.Unlock()
+}
+
+func (m *Metric) Inc(labels ...string) {
+	m.Add(1, labels...)
+}
+
+func (m *Metric) Set(v float64, labels ...string) {
+	m.Lock()
+	m.get(labels).value = v
+	m.Unlock()
+}
+
+func (m *Metric) Observe(v float64, labels ...string) {
+	m.Lock()
+	s := m.get(labels)
+	for i, le := range m.buckets {
+		if v <= le {
+			s.counts[i]++
+		}
+	}
+	s.sum += v
+	s.count++
+	m.Unlock()
+}
+
+func escape(v string) string {
+	v = strings.Replace(v, "\\", "\\\\", -1)
+	v = strings.Replace(v, "\"", "\\\"", -1)
+	return strings.Replace(v, "\n", "\\n", -1)
+}
+
+func format_labels(names []string, values []string, extra string) string {
+	var parts []string
+	for i, name := range names {
+		parts = append(parts, fmt.Sprintf("%s=\"%s\"", name, escape(values[i])))
+	}
+	if extra != "" {
+		parts = append(parts, extra)
+	}
+	if len(parts) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(parts, ",") + "}"
+}
+
+func format_float(v float64) string {
+	if math.IsInf(v, 1) {
+		return "+Inf"
+	}
+	return fmt.Sprintf("%g", v)
+}
+
+func (m *Metric) write(b *strings.Builder) {
+	m.Lock()
+	defer m.Unlock()
+
+	kind := "counter"
+	switch m.kind {
+	case GAUGE:
+		kind = "gauge"
+	case HISTOGRAM:
+		kind = "histogram"
+	}
+	fmt.Fprintf(b, "# HELP %s %s\n# TYPE %s %s\n", m.name, m.help, m.name, kind)
+
+	var keys []string
+	for key := range m.series {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		s := m.series[key]
+		if m.kind != HISTOGRAM {
+			fmt.Fprintf(b, "%s%s %s\n", m.name,
+			            format_labels(m.label_names, s.labels, ""),
+			            format_float(s.value))
+			continue
+		}
+
+		for i, le := range m.buckets {
+			fmt.Fprintf(b, "%s_bucket%s %d\n", m.name,
+			            format_labels(m.label_names, s.labels,
+			                          "le=\"" + format_float(le) + "\""),
+			            s.counts[i])
+		}
+		fmt.Fprintf(b, "%s_bucket%s %d\n", m.name,
+		            format_labels(m.label_names, s.labels, "le=\"+Inf\""), s.count)
+		fmt.Fprintf(b, "%s_sum%s %s\n", m.name,
+		            format_labels(m.label_names, s.labels, ""), format_float(s.sum))
+		fmt.Fprintf(b, "%s_count%s %d\n", m.name,
+		            format_labels(m.label_names, s.labels, ""), s.count)
+	}
+}
+
+func (r *Registry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	var b strings.Builder
+	r.Lock()
+	metrics := r.metrics
+	r.Unlock()
+
+	for _, m := range metrics {
+		m.write(&b)
+	}
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	w.Write([]byte(b.String()))
+}
+
+// Serve /metrics on address
+func Listen(address string) error {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", Default)
+	return http.ListenAndServe(address, mux)
+}
@@ -0,0 +1,140 @@
+package mod_io
+
+import (
+	"bufio"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Raw UART traffic recorder. Every chunk is written as line
+// "<RFC3339Nano time> <rx|tx> <hex bytes>"
+type capture struct {
+	sync.Mutex
+	path string
+	max_size int64
+	keep int
+	file *os.File
+	size int64
+}
+
+// One record of capture file
+type Capture_record struct {
+	Time time.Time
+	Dir string // "rx" or "tx"
+	Data []byte
+}
+
+func new_capture(path string, max_size int64, keep int) (*capture, error) {
+	c := &capture{path: path, max_size: max_size, keep: keep}
+	err := c.open()
+	if err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+func (c *capture) open() error {
+	var err error
+	c.file, err = os.OpenFile(c.path, os.O_WRONLY | os.O_CREATE | os.O_APPEND, 0644)
+	if err != nil {
+		return fmt.Errorf("mod_io: can't open capture file %s: %v", c.path, err)
+	}
+
+	st, err := c.file.Stat()
+	if err != nil {
+		return fmt.Errorf("mod_io: can't stat capture file %s: %v", c.path, err)
+	}
+	c.size = st.Size()
+	return nil
+}
+
+// Shift path.N to path.N+1, the oldest one is removed
+func (c *capture) rotate() error {
+	c.file.Close()
+	for i := c.keep - 1; i >= 1; i-- {
+		os.Rename(fmt.Sprintf("%s.%d", c.path, i), fmt.Sprintf("%s.%d", c.path, i + 1))
+	}
+	if c.keep > 0 {
+		os.Rename(c.path, c.path + ".1")
+	} else {
+		os.Remove(c.path)
+	}
+	return c.open()
+}
+
+func (c *capture) write(dir string, data []byte) {
+	if c == nil {
+		return
+	}
+
+	c.Lock()
+	defer c.Unlock()
+
+	if c.file == nil {
+		return
+	}
+
+	line := fmt.Sprintf("%s %s %s\n", time.Now().Format(time.RFC3339Nano),
+	                    dir, hex.EncodeToString(data))
+	n, err := c.file.WriteString(line)
+	c.size += int64(n)
+	if err == nil && c.max_size > 0 && c.size >= c.max_size {
+		err = c.rotate()
+	}
+	if err != nil {
+		// stop capturing rather than fail UART traffic
+		c.file = nil
+		stat_capture_errors.Inc()
+	}
+}
+
+func (c *capture) close() {
+	if c == nil {
+		return
+	}
+
+	c.Lock()
+	defer c.Unlock()
+	if c.file != nil {
+		c.file.Close()
+		c.file = nil
+	}
+}
+
+// Read capture file records
+func Read_capture(r io.Reader, record func(rec *Capture_record) error) error {
+	scanner := bufio.NewScanner(r)
+	line_num := 0
+	for scanner.Scan() {
+		line_num++
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 {
+			continue
+		}
+		if len(fields) != 3 {
+			return fmt.Errorf("mod_io: capture line %d: incorrect format", line_num)
+		}
+
+		var err error
+		rec := &Capture_record{Dir: fields[1]}
+		rec.Time, err = time.Parse(time.RFC3339Nano, fields[0])
+		if err != nil {
+			return fmt.Errorf("mod_io: capture line %d: %v", line_num, err)
+		}
+		rec.Data, err = hex.DecodeString(fields[2])
+		if err != nil {
+			return fmt.Errorf("mod_io: capture line %d: %v", line_num, err)
+		}
+
+		err = record(rec)
+		if err != nil {
+			return err
+		}
+	}
+	return scanner.Err()
+}
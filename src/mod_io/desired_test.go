@@ -0,0 +1,89 @@
+package mod_io_test
+
+import (
+	"conf"
+	"encoding/json"
+	"fake_board"
+	"io/ioutil"
+	"mod_io"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+func read_desired(t *testing.T, path string) map[int]int {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	desired := make(map[int]int)
+	err = json.Unmarshal(data, &desired)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return desired
+}
+
+func TestDesiredStates(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "relays.json")
+	iocfg := &conf.Module_io_cfg{Relay_state_file: path, Relay_restore: "restore"}
+	_, mio := fake_board.Start_mod_io(t, iocfg, nil)
+
+	var wg sync.WaitGroup
+	for port := 1; port <= 4; port++ {
+		wg.Add(1)
+		go func(port int) {
+			defer wg.Done()
+			err := mio.Relay_set_state(port, port, port % 2)
+			if err != nil {
+				t.Error(err)
+			}
+		}(port)
+	}
+	wg.Wait()
+	_, err := mio.Relay_set_many(5, []mod_io.Relay_op{{Port: 5, State: 1}}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	desired := read_desired(t, path)
+	want := map[int]int{1: 1, 2: 0, 3: 1, 4: 0, 5: 1}
+	for port, state := range want {
+		if st, ok := desired[port]; !ok || st != state {
+			t.Errorf("port %d: saved %d, %v; want %d", port, st, ok, state)
+		}
+	}
+
+	// daemon restart with board reset
+	b, mio := fake_board.Start_mod_io(t, &conf.Module_io_cfg{Relay_state_file: path,
+	                                                         Relay_restore: "restore"}, nil)
+	results := mio.Restore_relays(1)
+	if len(results) != 5 {
+		t.Errorf("got %d results, want 5: %+v", len(results), results)
+	}
+	for port, state := range want {
+		if b.Relay(port) != state {
+			t.Errorf("port %d is not restored to %d", port, state)
+		}
+	}
+}
+
+func TestSafeStatesNotSaved(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "relays.json")
+	safe := 0
+	iocfg := &conf.Module_io_cfg{Relay_state_file: path,
+	                             Output: map[string]conf.Output_cfg{"2": {Safe_state: &safe}}}
+	_, mio := fake_board.Start_mod_io(t, iocfg, nil)
+
+	err := mio.Relay_set_state(1, 2, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = mio.Apply_safe_states(2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if desired := read_desired(t, path); desired[2] != 1 {
+		t.Errorf("safe state overwrote desired one: %v", desired)
+	}
+}
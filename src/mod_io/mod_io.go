@@ -4,11 +4,55 @@ import (
 	"nmea0183"
 	"os"
 	"os/exec"
+	"portmap"
 	"container/list"
+	"io"
+	"encoding/json"
+	"io/ioutil"
+	"sort"
+	"sync/atomic"
 	"sync"
 	"time"
 	"conf"
 	"fmt"
+	"metrics"
+	"log/slog"
+)
+
+// Last known port state
+type Port_state struct {
+	Port int
+	State int
+	Time time.Time
+	Source string // "reply", "event" or "poll"
+}
+
+var (
+	stat_bytes_in = metrics.New_counter("module_io_uart_rx_bytes_total",
+	                                    "Bytes received from board")
+	stat_bytes_out = metrics.New_counter("module_io_uart_tx_bytes_total",
+	                                     "Bytes sent to board")
+	stat_frames_in = metrics.New_counter("module_io_uart_rx_frames_total",
+	                                     "Frames received from board", "si")
+	stat_frames_out = metrics.New_counter("module_io_uart_tx_frames_total",
+	                                      "Frames sent to board", "si")
+	stat_latency = metrics.New_histogram("module_io_command_duration_seconds",
+	                                     "Board command round trip time",
+	                                     metrics.LATENCY_BUCKETS, "cmd")
+	stat_retries = metrics.New_counter("module_io_command_retries_total",
+	                                   "Board command retries", "cmd")
+	stat_timeouts = metrics.New_counter("module_io_command_timeouts_total",
+	                                    "Board command reply timeouts", "cmd")
+	stat_wdt_resets = metrics.New_counter("module_io_watchdog_resets_total",
+	                                      "Board watchdog resets sent")
+	stat_capture_errors = metrics.New_counter("module_io_capture_errors_total",
+	                                          "UART capture write failures")
+	stat_rx_queue = metrics.New_gauge("module_io_rx_queue_length",
+	                                  "Received frames waiting for consumer")
+	stat_relay_state = metrics.New_gauge("module_io_relay_state",
+	                                     "Last known relay state", "port")
+	stat_input_state = metrics.New_gauge("module_io_input_state",
+	                                     "Last known input state", "port")
 )
 
 type Mod_io struct {
@@ -18,16 +62,66 @@ type Mod_io struct {
 	tx chan string
 	rx_queue *list.List
 	rx_recepient_channels *list.List
+	id_lock sync.Mutex
+	last_request_id int
+	cache_max_age time.Duration
+	inputs_count int
+	outputs_count int
+	inputs map[int]Port_state
+	outputs map[int]Port_state
+	polls map[int]bool // request ids of reconciliation reads in progress
+	busy int32 // interactive transactions in progress
+	state_file string
+	desired map[int]int // relay states set by clients
+	desired_ver int // changed with desired
+	save_lock sync.Mutex // serializes state file writes
+	saved_ver int // desired_ver written to state file, under save_lock
+	restore_default string
+	restore_policy map[int]string
+	interlocks []conf.Interlock_cfg
+	interlock_lock sync.Mutex
+	safe_states map[int]int // logical states
+	ports *portmap.Map // inversion of outputs, may be nil
+	last_rx time.Time
+	capture *capture
+	stop chan bool
+	closed int32
 }
 
+// Result of relay state restoring for one port
+type Restore_result struct {
+	Port int
+	Policy string // "restore", "off" or "leave"
+	Before int
+	After int
+	Changed bool
+	Err error
+}
 
-func New(iocfg *conf.Module_io_cfg) (*Mod_io, error) {
+
+// Interlocks, safe states and "off" restore policy are evaluated in
+// logical states of ports
+func New(iocfg *conf.Module_io_cfg, ports *portmap.Map) (*Mod_io, error) {
 	var err error
 	
-	mio := new(Mod_io)
-	mio.tx = make(chan string, 64)
-	mio.rx_queue = list.New()
-	mio.rx_recepient_channels = list.New()
+	mio, err := new_mod_io(iocfg)
+	if err != nil {
+		return nil, err
+	}
+	mio.ports = ports
+
+	err = mio.init_restore(iocfg)
+	if err != nil {
+		return nil, err
+	}
+
+	if iocfg.Capture.File != "" {
+		mio.capture, err = new_capture(iocfg.Capture.File, iocfg.Capture.Max_size,
+		                               iocfg.Capture.Keep)
+		if err != nil {
+			return nil, err
+		}
+	}
 	
 	mio.dev, err = os.OpenFile(iocfg.Uart_dev, 
 						os.O_RDWR | os.O_APPEND, 0660)
@@ -35,8 +129,6 @@ func New(iocfg *conf.Module_io_cfg) (*Mod_io, error) {
 		return nil, fmt.Errorf("can't open file %s", iocfg.Uart_dev)
 	}
 	
-	mio.nmea = nmea0183.New()
-	
 	err = exec.Command("bash", "-c", "stty -F" + iocfg.Uart_dev + 
 						" " + iocfg.Uart_speed + " raw -echo").Run()
 	if err != nil {
@@ -48,6 +140,44 @@ func New(iocfg *conf.Module_io_cfg) (*Mod_io, error) {
 	return mio, err
 }
 
+// Stop UART threads and close device
+func (mio *Mod_io) Close() {
+	if !atomic.CompareAndSwapInt32(&mio.closed, 0, 1) {
+		return
+	}
+	close(mio.stop)
+	if mio.dev != nil {
+		mio.dev.Close()
+	}
+	mio.capture.close()
+}
+
+// Create Mod_io without UART for capture replay
+func New_offline(iocfg *conf.Module_io_cfg) (*Mod_io, error) {
+	return new_mod_io(iocfg)
+}
+
+func new_mod_io(iocfg *conf.Module_io_cfg) (*Mod_io, error) {
+	mio := new(Mod_io)
+	mio.tx = make(chan string, 64)
+	mio.stop = make(chan bool)
+	mio.rx_queue = list.New()
+	mio.rx_recepient_channels = list.New()
+	mio.cache_max_age = time.Duration(iocfg.Cache_max_age) * time.Millisecond
+	mio.inputs_count = iocfg.Inputs_count
+	mio.outputs_count = iocfg.Outputs_count
+	mio.inputs = make(map[int]Port_state)
+	mio.outputs = make(map[int]Port_state)
+	mio.polls = make(map[int]bool)
+	mio.desired = make(map[int]int)
+	mio.nmea = nmea0183.New()
+
+	err := mio.init_safety(iocfg)
+	if err != nil {
+		return nil, err
+	}
+	return mio, nil
+}
 
 func (mio *Mod_io) Receiver_thread() {
 	var buf [64]byte
@@ -56,6 +186,9 @@ func (mio *Mod_io) Receiver_thread() {
 	
 	for {
 		count, err = mio.dev.Read(buf[:])
+		if atomic.LoadInt32(&mio.closed) != 0 {
+			return
+		}
 		if err != nil {
 			continue; // TODO:
 		}
@@ -63,33 +196,177 @@ func (mio *Mod_io) Receiver_thread() {
 		if count <= 0 {
 			continue; // TODO:
 		}
-		
-		for _, byte := range buf[:count] {
-			msg := mio.nmea.Push_rxb(byte)
-			if msg == nil {
-				continue	
+		mio.capture.write("rx", buf[:count])
+		mio.rx_bytes(buf[:count])
+	}
+}
+
+// Parse received bytes and dispatch messages to recipients
+func (mio *Mod_io) rx_bytes(data []byte) {
+	stat_bytes_in.Add(float64(len(data)))
+
+	for _, byte := range data {
+		msg := mio.nmea.Push_rxb(byte)
+		if msg == nil {
+			continue	
+		}
+
+		mio.Lock()
+		mio.last_rx = time.Now()
+		mio.update_cache(msg)
+		mio.rx_queue.PushBack(msg)
+		stat_frames_in.Inc(msg.Si)
+		stat_rx_queue.Set(float64(mio.rx_queue.Len()))
+		slog.Debug("frame received", "module", "mod_io", "si", msg.Si,
+		           "request_id", msg.Request_id, "args", msg.Args)
+
+		for e := mio.rx_recepient_channels.Front(); e != nil; e = e.Next() {
+			chain, _ := e.Value.(chan bool)
+			// receiver already has pending wakeup, don't block
+			// while it waits for lock to unsubscribe
+			select {
+			case chain <- true:
+			default:
 			}
+		}
+		mio.Unlock()
+	}
+}
 
-			mio.Lock()
-			mio.rx_queue.PushBack(msg)
+// Feed capture file through parser and dispatch as if bytes came from
+// UART. Each dispatched or transmitted message is passed to out
+func (mio *Mod_io) Replay(r io.Reader,
+                          out func(rec *Capture_record, msg *nmea0183.Nmea_msg)) error {
+	tx_nmea := nmea0183.New()
+	return Read_capture(r, func(rec *Capture_record) error {
+		if rec.Dir == "tx" {
+			for _, b := range rec.Data {
+				msg := tx_nmea.Push_rxb(b)
+				if msg != nil {
+					out(rec, msg)
+				}
+			}
+			return nil
+		}
 
-			for e := mio.rx_recepient_channels.Front(); e != nil; e = e.Next() {
-				chain, _ := e.Value.(chan bool)
-				chain <- true
+		if rec.Dir != "rx" {
+			return fmt.Errorf("mod_io: unknown capture direction '%s'", rec.Dir)
+		}
+
+		mio.rx_bytes(rec.Data)
+
+		// no consumers offline, take everything dispatched
+		for {
+			mio.Lock()
+			e := mio.rx_queue.Front()
+			if e != nil {
+				mio.rx_queue.Remove(e)
 			}
 			mio.Unlock()
+			if e == nil {
+				break
+			}
+			out(rec, e.Value.(*nmea0183.Nmea_msg))
+		}
+		return nil
+	})
+}
 
+// Parser errors counters: checksum, format
+func (mio *Mod_io) Parse_errors() (int, int) {
+	return mio.nmea.Errors()
+}
 
-		}
+// Update port states shadow by received message. Must be called with lock held
+func (mio *Mod_io) update_cache(msg *nmea0183.Nmea_msg) {
+	if len(msg.Args) < 3 {
+		return
+	}
+	if mio.polls[msg.Request_id] && (msg.Si == "SOP" || msg.Si == "SIP") {
+		return // compared and stored by Poll_port
+	}
+
+	st := Port_state{Port: msg.Args[1],
+	                 State: msg.Args[2],
+	                 Time: time.Now(),
+	                 Source: "reply"}
+	port := fmt.Sprintf("%d", st.Port)
+	switch msg.Si {
+	case "SOP":
+		mio.outputs[st.Port] = st
+		stat_relay_state.Set(float64(st.State), port)
+
+	case "SIP":
+		mio.inputs[st.Port] = st
+		stat_input_state.Set(float64(st.State), port)
+
+	case "AIP":
+		st.Source = "event"
+		mio.inputs[st.Port] = st
+		stat_input_state.Set(float64(st.State), port)
 	}
 }
 
+// Return cached port state if it is not older than max age
+func (mio *Mod_io) cached_state(cache map[int]Port_state, port_num int) (int, bool) {
+	if mio.cache_max_age == 0 {
+		return 0, false
+	}
+
+	mio.Lock()
+	defer mio.Unlock()
+	st, ok := cache[port_num]
+	if !ok || time.Since(st.Time) > mio.cache_max_age {
+		return 0, false
+	}
+	return st.State, true
+}
+
+// Return last known port states without board queries
+func (mio *Mod_io) Cached_states() (inputs []Port_state, outputs []Port_state) {
+	mio.Lock()
+	defer mio.Unlock()
+
+	for _, st := range mio.inputs {
+		inputs = append(inputs, st)
+	}
+	for _, st := range mio.outputs {
+		outputs = append(outputs, st)
+	}
+	sort.Slice(inputs, func(i, j int) bool { return inputs[i].Port < inputs[j].Port })
+	sort.Slice(outputs, func(i, j int) bool { return outputs[i].Port < outputs[j].Port })
+	return inputs, outputs
+}
+
+// Return states of all board ports. Stale ones are read from board
+func (mio *Mod_io) All_states(request_id int) ([]Port_state, []Port_state, error) {
+	for port := 1; port <= mio.inputs_count; port++ {
+		_, err := mio.Get_input_port_state(request_id, port)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+	for port := 1; port <= mio.outputs_count; port++ {
+		_, err := mio.Get_output_port_state(request_id, port)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+
+	inputs, outputs := mio.Cached_states()
+	return inputs, outputs, nil
+}
 
 func (mio *Mod_io) Transmitter_thread() {
 	var count int
 
 	for {
-		msg := <- mio.tx
+		var msg string
+		select {
+		case msg = <- mio.tx:
+		case <- mio.stop:
+			return
+		}
 		count = 0
 		for count < len(msg) {
 			var err error
@@ -97,10 +374,95 @@ func (mio *Mod_io) Transmitter_thread() {
 			if err != nil {
 				panic("Can't write to UART")
 			}
+			stat_bytes_out.Add(float64(count))
+			mio.capture.write("tx", []byte(msg[:count]))
 		}
 	}
 }
 
+// Mark interactive transaction in progress, returns function to finish it
+func (mio *Mod_io) transaction() func() {
+	atomic.AddInt32(&mio.busy, 1)
+	return func() {
+		atomic.AddInt32(&mio.busy, -1)
+	}
+}
+
+// Check for interactive transactions in progress
+func (mio *Mod_io) Busy() bool {
+	return atomic.LoadInt32(&mio.busy) > 0
+}
+
+// Read port state from board for reconciliation. Returns state known
+// when reply was received, known is false if port was never seen
+// before. Board events and other replies received during the read are
+// taken into account, so a change reported by them is not a drift.
+// Doesn't count as interactive transaction
+func (mio *Mod_io) Poll_port(request_id int, relay bool,
+                             port_num int) (prev Port_state, known bool, state int, err error) {
+	cache := mio.inputs
+	if relay {
+		cache = mio.outputs
+	}
+
+	mio.Lock()
+	mio.polls[request_id] = true
+	mio.Unlock()
+
+	if relay {
+		state, err = mio.read_output_port_state(request_id, port_num)
+	} else {
+		state, err = mio.read_input_port_state(request_id, port_num)
+	}
+
+	mio.Lock()
+	defer mio.Unlock()
+	delete(mio.polls, request_id)
+	prev, known = cache[port_num]
+	if err != nil {
+		return
+	}
+	cache[port_num] = Port_state{Port: port_num,
+	                             State: state,
+	                             Time: time.Now(),
+	                             Source: "poll"}
+	gauge := stat_input_state
+	if relay {
+		gauge = stat_relay_state
+	}
+	gauge.Set(float64(state), fmt.Sprintf("%d", port_num))
+	return
+}
+
+// Allocate request_id for a new client or internal transaction.
+// 0 is reserved for board events
+func (mio *Mod_io) New_request_id() int {
+	mio.id_lock.Lock()
+	defer mio.id_lock.Unlock()
+
+	mio.last_request_id++
+	if mio.last_request_id > 255 {
+		mio.last_request_id = 1
+	}
+	return mio.last_request_id
+}
+
+// Send command and wait for reply up to 500ms, collects statistics
+func (mio *Mod_io) request(request_id int, si string, args []int,
+                           reply_si string) *nmea0183.Nmea_msg {
+	start := time.Now()
+	mio.Send_cmd(request_id, "PC", si, args)
+	msg := mio.Recv(request_id, []string{reply_si}, 500)
+	if msg == nil {
+		stat_timeouts.Inc(si)
+		slog.Debug("reply timeout", "module", "mod_io", "cmd", si,
+		           "args", args, "request_id", request_id)
+		return nil
+	}
+	stat_latency.Observe(time.Since(start).Seconds(), si)
+	return msg
+}
+
 // Send nmea0183 message to transmitter
 func (mio *Mod_io) Send_cmd(request_id int, ti string, si string, args []int) {
 	// Remove incomming packet with request_id from rx_queue
@@ -109,7 +471,8 @@ func (mio *Mod_io) Send_cmd(request_id int, ti string, si string, args []int) {
 		msg, _ := e.Value.(*nmea0183.Nmea_msg)
 
 		if msg.Request_id == request_id {
-			println(fmt.Sprintf("find request_id: %d", msg.Request_id))
+			slog.Debug("drop stale reply", "module", "mod_io",
+			           "request_id", msg.Request_id, "si", msg.Si)
 			mio.rx_queue.Remove(e)
 		}
 	}
@@ -117,14 +480,45 @@ func (mio *Mod_io) Send_cmd(request_id int, ti string, si string, args []int) {
 
 	args = append([]int{request_id}, args...)
 	msg := mio.nmea.Create_msg(ti, si, args)
-	mio.tx <- msg
+	stat_frames_out.Inc(si)
+	select {
+	case mio.tx <- msg:
+	case <- mio.stop:
+	}
 }
 
-// Set outport new state 
+// Set outport new state and remember it to restore after restart
 func (mio *Mod_io) Relay_set_state(request_id int, port_num int, state int) error {
+	err := mio.set_state(request_id, port_num, state)
+	if err == nil {
+		mio.save_desired(port_num, state)
+	}
+	return err
+}
+
+// Set outport state without touching desired states. Used for safe
+// states, restoring and rollback which are not client's intentions
+func (mio *Mod_io) set_state(request_id int, port_num int, state int) error {
+	defer mio.transaction()()
+
+	groups := mio.interlock_groups(port_num)
+	if len(groups) > 0 {
+		// check and switch atomically against other interlocked ports
+		mio.interlock_lock.Lock()
+		defer mio.interlock_lock.Unlock()
+		if mio.output_on(port_num, state) {
+			err := mio.check_interlocks(request_id, port_num, groups)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
 	for cnt := 0; cnt < 3; cnt++ {
-		mio.Send_cmd(request_id, "PC", "RWS", []int{port_num, state})
-		msg := mio.Recv(request_id, []string{"SOP"}, 500)
+		if cnt > 0 {
+			stat_retries.Inc("RWS")
+		}
+		msg := mio.request(request_id, "RWS", []int{port_num, state}, "SOP")
 		if msg == nil {
 			continue
 		}
@@ -136,17 +530,361 @@ func (mio *Mod_io) Relay_set_state(request_id int, port_num int, state int) erro
 		if msg.Args[2] != state {
 			continue
 		}
-		
+
 		return nil
 	}
+	slog.Warn("can't set relay state", "module", "mod_io", "port", port_num,
+	          "state", state, "request_id", request_id)
 	return fmt.Errorf("mod_io: can't set relay state")	
 }
 
-// Get output port state
+func (mio *Mod_io) init_restore(iocfg *conf.Module_io_cfg) error {
+	mio.state_file = iocfg.Relay_state_file
+	mio.restore_policy = make(map[int]string)
+
+	mio.restore_default = iocfg.Relay_restore
+	if mio.restore_default == "" {
+		mio.restore_default = "leave"
+	}
+
+	for port_str, ocfg := range iocfg.Output {
+		var port int
+		_, err := fmt.Sscanf(port_str, "%d", &port)
+		if err != nil {
+			return fmt.Errorf("mod_io: incorrect output port '%s'", port_str)
+		}
+		if ocfg.Restore != "" {
+			mio.restore_policy[port] = ocfg.Restore
+		}
+	}
+
+	policies := []string{mio.restore_default}
+	for _, policy := range mio.restore_policy {
+		policies = append(policies, policy)
+	}
+	for _, policy := range policies {
+		switch policy {
+		case "restore", "off", "leave":
+		default:
+			return fmt.Errorf("mod_io: unknown relay restore policy '%s'", policy)
+		}
+	}
+
+	if mio.state_file == "" {
+		return nil
+	}
+
+	data, err := ioutil.ReadFile(mio.state_file)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("mod_io: can't read %s: %v", mio.state_file, err)
+	}
+
+	err = json.Unmarshal(data, &mio.desired)
+	if err != nil {
+		return fmt.Errorf("mod_io: can't parse %s: %v", mio.state_file, err)
+	}
+	return nil
+}
+
+func (mio *Mod_io) init_safety(iocfg *conf.Module_io_cfg) error {
+	mio.interlocks = iocfg.Interlock
+	mio.safe_states = make(map[int]int)
+
+	for _, group := range mio.interlocks {
+		if len(group.Ports) < 2 {
+			return fmt.Errorf("mod_io: interlock %s must have at least 2 ports",
+			                  group.Name)
+		}
+	}
+
+	for port_str, ocfg := range iocfg.Output {
+		if ocfg.Safe_state == nil {
+			continue
+		}
+		var port int
+		fmt.Sscanf(port_str, "%d", &port)
+		mio.safe_states[port] = *ocfg.Safe_state
+	}
+	return nil
+}
+
+// Return interlock groups containing port
+func (mio *Mod_io) interlock_groups(port_num int) []conf.Interlock_cfg {
+	var groups []conf.Interlock_cfg
+	for _, group := range mio.interlocks {
+		for _, port := range group.Ports {
+			if port == port_num {
+				groups = append(groups, group)
+				break
+			}
+		}
+	}
+	return groups
+}
+
+// Check that no other port of port's interlock groups is switched on.
+// Unknown state of other port is treated as conflict
+func (mio *Mod_io) check_interlocks(request_id int, port_num int,
+                                    groups []conf.Interlock_cfg) error {
+	for _, group := range groups {
+		for _, port := range group.Ports {
+			if port == port_num {
+				continue
+			}
+
+			state, err := mio.Get_output_port_state(request_id, port)
+			if err != nil {
+				return fmt.Errorf("mod_io: interlock %s: can't get state of port %d: %v",
+				                  group.Name, port, err)
+			}
+			if mio.output_on(port, state) {
+				return fmt.Errorf("mod_io: interlock %s: port %d can't be switched on " +
+				                  "while port %d is on", group.Name, port_num, port)
+			}
+		}
+	}
+	return nil
+}
+
+// Convert logical output state to physical one
+func (mio *Mod_io) physical(port_num int, state int) int {
+	if mio.ports == nil {
+		return state
+	}
+	return mio.ports.Physical(portmap.OUTPUT, port_num, state)
+}
+
+// Return true if physical output state means switched on
+func (mio *Mod_io) output_on(port_num int, state int) bool {
+	if mio.ports == nil {
+		return state != 0
+	}
+	return mio.ports.Logical(portmap.OUTPUT, port_num, state) != 0
+}
+
+// Switch relays with configured safe states to them.
+// Ports are switched off first to not break interlocks
+func (mio *Mod_io) Apply_safe_states(request_id int) ([]Relay_result, error) {
+	var ops []Relay_op
+	for port, state := range mio.safe_states {
+		ops = append(ops, Relay_op{Port: port, State: state})
+	}
+	if len(ops) == 0 {
+		return nil, nil
+	}
+
+	sort.Slice(ops, func(i, j int) bool {
+		if ops[i].State != ops[j].State {
+			return ops[i].State < ops[j].State
+		}
+		return ops[i].Port < ops[j].Port
+	})
+	for i := range ops {
+		ops[i].State = mio.physical(ops[i].Port, ops[i].State)
+	}
+	return mio.set_many(request_id, ops, false)
+}
+
+// Remember relay state to restore it after restart
+func (mio *Mod_io) save_desired(port_num int, state int) {
+	mio.Lock()
+	if prev, ok := mio.desired[port_num]; ok && prev == state {
+		mio.Unlock()
+		return
+	}
+	mio.desired[port_num] = state
+	mio.desired_ver++
+	ver := mio.desired_ver
+	data, err := json.Marshal(mio.desired)
+	mio.Unlock()
+
+	if mio.state_file == "" {
+		return
+	}
+	if err != nil {
+		slog.Error("can't encode relay states", "module", "mod_io", "err", err)
+		return
+	}
+
+	// file is written without mio lock, UART traffic must not wait
+	// for storage. Newer snapshot may be already written by other call
+	mio.save_lock.Lock()
+	defer mio.save_lock.Unlock()
+	if ver < mio.saved_ver {
+		return
+	}
+	mio.saved_ver = ver
+
+	tmp := mio.state_file + ".tmp"
+	err = ioutil.WriteFile(tmp, data, 0644)
+	if err == nil {
+		err = os.Rename(tmp, mio.state_file)
+	}
+	if err != nil {
+		slog.Error("can't save relay states", "module", "mod_io",
+		           "file", mio.state_file, "err", err)
+	}
+}
+
+// Bring relays to desired states after board or daemon restart
+// according to per-port policy. Returns results for all processed ports
+func (mio *Mod_io) Restore_relays(request_id int) []Restore_result {
+	var results []Restore_result
+
+	for port := 1; port <= mio.outputs_count; port++ {
+		mio.Lock()
+		policy, ok := mio.restore_policy[port]
+		if !ok {
+			policy = mio.restore_default
+		}
+		desired, known := mio.desired[port]
+		mio.Unlock()
+
+		if policy == "leave" || (policy == "restore" && !known) {
+			continue
+		}
+		if policy == "off" {
+			desired = mio.physical(port, 0)
+		}
+
+		r := Restore_result{Port: port, Policy: policy}
+		r.Before, r.Err = mio.Read_output_port_state(request_id, port)
+		if r.Err != nil {
+			results = append(results, r)
+			continue
+		}
+
+		r.After = r.Before
+		if r.Before != desired {
+			r.Err = mio.set_state(request_id, port, desired)
+			if r.Err == nil {
+				r.After = desired
+				r.Changed = true
+			}
+		}
+		results = append(results, r)
+	}
+	return results
+}
+
+// One port of a batch relay operation
+type Relay_op struct {
+	Port int
+	State int
+}
+
+// Result of one port of a batch relay operation
+type Relay_result struct {
+	Port int
+	State int
+	Prev_state int // valid for atomic operation only
+	Status string // "ok", "failed", "skipped", "rolled_back", "rollback_failed"
+	Err error
+}
+
+// Set several outports. If atomic is set, previous states are read
+// from board before switching and on any failure already switched ports are
+// rolled back. Finally set states are remembered as desired ones
+func (mio *Mod_io) Relay_set_many(request_id int, ops []Relay_op,
+                                  atomic bool) ([]Relay_result, error) {
+	results, err := mio.set_many(request_id, ops, atomic)
+	for _, r := range results {
+		if r.Status == "ok" {
+			mio.save_desired(r.Port, r.State)
+		}
+	}
+	return results, err
+}
+
+func (mio *Mod_io) set_many(request_id int, ops []Relay_op,
+                            atomic bool) ([]Relay_result, error) {
+	var err error
+	results := make([]Relay_result, len(ops))
+	for i, op := range ops {
+		results[i].Port = op.Port
+		results[i].State = op.State
+		results[i].Status = "skipped"
+	}
+
+	if atomic {
+		for i, op := range ops {
+			// cache may be stale, rollback must restore real board state
+			results[i].Prev_state, err = mio.Read_output_port_state(request_id, op.Port)
+			if err != nil {
+				results[i].Status = "failed"
+				results[i].Err = err
+				return results, fmt.Errorf("mod_io: can't get state of port %d " +
+				                           "before batch, nothing changed", op.Port)
+			}
+		}
+	}
+
+	failed := 0
+	for i, op := range ops {
+		err = mio.set_state(request_id, op.Port, op.State)
+		if err == nil {
+			results[i].Status = "ok"
+			continue
+		}
+
+		results[i].Status = "failed"
+		results[i].Err = err
+		failed++
+		if atomic {
+			break
+		}
+	}
+
+	if failed == 0 {
+		return results, nil
+	}
+
+	if !atomic {
+		return results, fmt.Errorf("mod_io: can't set %d of %d relays",
+		                           failed, len(ops))
+	}
+
+	// roll back in reverse order
+	for i := len(ops) - 1; i >= 0; i-- {
+		if results[i].Status != "ok" {
+			continue
+		}
+
+		err = mio.set_state(request_id, results[i].Port, results[i].Prev_state)
+		if err != nil {
+			results[i].Status = "rollback_failed"
+			results[i].Err = err
+			continue
+		}
+		results[i].Status = "rolled_back"
+	}
+	return results, fmt.Errorf("mod_io: batch failed, rolled back")
+}
+
+// Get output port state from cache or board
 func (mio *Mod_io) Get_output_port_state(request_id int, port_num int) (int, error) {
+	state, ok := mio.cached_state(mio.outputs, port_num)
+	if ok {
+		return state, nil
+	}
+	return mio.Read_output_port_state(request_id, port_num)
+}
+
+// Read output port state from board
+func (mio *Mod_io) Read_output_port_state(request_id int, port_num int) (int, error) {
+	defer mio.transaction()()
+	return mio.read_output_port_state(request_id, port_num)
+}
+
+func (mio *Mod_io) read_output_port_state(request_id int, port_num int) (int, error) {
 	for cnt := 0; cnt < 3; cnt++ {
-		mio.Send_cmd(request_id, "PC", "RRS", []int{port_num})
-		msg := mio.Recv(request_id, []string{"SOP"}, 500)
+		if cnt > 0 {
+			stat_retries.Inc("RRS")
+		}
+		msg := mio.request(request_id, "RRS", []int{port_num}, "SOP")
 
 		if msg == nil {
 			continue
@@ -162,11 +900,27 @@ func (mio *Mod_io) Get_output_port_state(request_id int, port_num int) (int, err
 }
 
 
-// Get input port state
+// Get input port state from cache or board
 func (mio *Mod_io) Get_input_port_state(request_id int, port_num int) (int, error) {
+	state, ok := mio.cached_state(mio.inputs, port_num)
+	if ok {
+		return state, nil
+	}
+	return mio.Read_input_port_state(request_id, port_num)
+}
+
+// Read input port state from board
+func (mio *Mod_io) Read_input_port_state(request_id int, port_num int) (int, error) {
+	defer mio.transaction()()
+	return mio.read_input_port_state(request_id, port_num)
+}
+
+func (mio *Mod_io) read_input_port_state(request_id int, port_num int) (int, error) {
 	for cnt := 0; cnt < 3; cnt++ {
-		mio.Send_cmd(request_id, "PC", "RIP", []int{port_num})
-		msg := mio.Recv(request_id, []string{"SIP"}, 500)
+		if cnt > 0 {
+			stat_retries.Inc("RIP")
+		}
+		msg := mio.request(request_id, "RIP", []int{port_num}, "SIP")
 		if msg == nil {
 			continue
 		}
@@ -183,9 +937,12 @@ func (mio *Mod_io) Get_input_port_state(request_id int, port_num int) (int, erro
 
 // Set WDT state
 func (mio *Mod_io) Wdt_set_state(request_id int, state int) error {
+	defer mio.transaction()()
 	for cnt := 0; cnt < 3; cnt++ {
-		mio.Send_cmd(request_id, "PC", "WDC", []int{state})
-		msg := mio.Recv(request_id, []string{"WDS"}, 500)
+		if cnt > 0 {
+			stat_retries.Inc("WDC")
+		}
+		msg := mio.request(request_id, "WDC", []int{state}, "WDS")
 		if msg == nil {
 			continue
 		}
@@ -201,8 +958,16 @@ func (mio *Mod_io) Wdt_set_state(request_id int, state int) error {
 
 
 // WDT reset
-func (mio *Mod_io) Wdt_reset() {
-	mio.Send_cmd(0, "PC", "WRS", []int{})
+func (mio *Mod_io) Wdt_reset(request_id int) {
+	stat_wdt_resets.Inc()
+	mio.Send_cmd(request_id, "PC", "WRS", []int{})
+}
+
+// Return time of last frame received from board
+func (mio *Mod_io) Last_rx() time.Time {
+	mio.Lock()
+	defer mio.Unlock()
+	return mio.last_rx
 }
 
 func (mio *Mod_io) recv_from_queue(request_id int, si string) *nmea0183.Nmea_msg {
@@ -214,14 +979,9 @@ func (mio *Mod_io) recv_from_queue(request_id int, si string) *nmea0183.Nmea_msg
 			continue
 		}
 
-		if len(si) == 0 {
-			mio.rx_queue.Remove(e)
-			mio.Unlock()
-			return msg
-		}
-
-		if msg.Si == si {
+		if len(si) == 0 || msg.Si == si {
 			mio.rx_queue.Remove(e)
+			stat_rx_queue.Set(float64(mio.rx_queue.Len()))
 			mio.Unlock()
 			return msg
 		}
@@ -0,0 +1,89 @@
+package modem
+
+import (
+	"context"
+	"encoding/xml"
+)
+
+// HiLink ConnectionStatus values. Backends without data session report
+// CONNECTED when registered in network
+const (
+	CONNECTED = 901
+	DISCONNECTED = 902
+)
+
+// HiLink CurrentNetworkType values
+const (
+	NETWORK_NONE = 0
+	NETWORK_GSM = 1
+	NETWORK_WCDMA = 4
+	NETWORK_LTE = 19
+)
+
+// Message stored in modem inbox
+type Sms_message struct {
+	Smstat     int    `xml:"Smstat"` // 0 unread, 1 read
+	Index      int    `xml:"Index"`
+	Phone      string `xml:"Phone"`
+	Content    string `xml:"Content"`
+	Date       string `xml:"Date"`
+	Sca        string `xml:"Sca"`
+	SaveType   int    `xml:"SaveType"`
+	Priority   int    `xml:"Priority"`
+	SmsType    int    `xml:"SmsType"`
+}
+
+type Global_status struct {
+	XMLName               xml.Name `xml:"response"`
+	ConnectionStatus      int      `xml:"ConnectionStatus"`
+	SignalStrength        int      `xml:"SignalStrength"` // percent
+	SignalIcon            int	   `xml:"SignalIcon"`
+	CurrentNetworkType    int      `xml:"CurrentNetworkType"`
+	CurrentServiceDomain  int      `xml:"CurrentServiceDomain"`
+	RoamingStatus         int      `xml:"RoamingStatus"`
+	WanIPAddress          string   `xml:"WanIPAddress"`
+	PrimaryDns            string   `xml:"PrimaryDns"`
+	SecondaryDns          string   `xml:"SecondaryDns"`
+}
+
+type Traffic_statistics struct {
+	XMLName               xml.Name `xml:"response"`
+	CurrentConnectTime    uint64   `xml:"CurrentConnectTime"`
+	CurrentUpload         uint64   `xml:"CurrentUpload"`
+	CurrentDownload       uint64   `xml:"CurrentDownload"`
+	CurrentDownloadRate   uint64   `xml:"CurrentDownloadRate"`
+	CurrentUploadRate     uint64   `xml:"CurrentUploadRate"`
+	TotalUpload           uint64   `xml:"TotalUpload"`
+	TotalDownload         uint64   `xml:"TotalDownload"`
+	TotalConnectTime      uint64   `xml:"TotalConnectTime"`
+}
+
+// Result of last sending
+type Sent_sms_stat struct {
+	XMLName     xml.Name `xml:"response"`
+	Phone       string   `xml:"Phone"`
+	SucPhone    string   `xml:"SucPhone"`
+	FailPhone   string   `xml:"FailPhone"`
+	TotalCount  int      `xml:"TotalCount"`
+	CurIndex    int      `xml:"CurIndex"`
+}
+
+// GSM modem backend. Implementations serialize requests themselves
+type Modem interface {
+	// Send text to every phone, long text is split into several SMS
+	Send_sms_to(phones []string, text string) error
+	// Return all inbox messages
+	Check_for_new_sms() ([]Sms_message, error)
+	Remove_sms(sms_index int) error
+	Check_sended_sms_status() (*Sent_sms_stat, error)
+	// Send USSD code and wait for network reply until ctx is done
+	Ussd(ctx context.Context, code string) (string, error)
+	Get_global_status() (*Global_status, error)
+	Get_traffic_statistics() (*Traffic_statistics, error)
+}
+
+// Backend whose Send_sms_to returns after network accepted every
+// message, so its result needs no send status confirmation
+type Sync_sender interface {
+	Sync_send()
+}
@@ -0,0 +1,116 @@
+package modem
+
+import (
+	"fmt"
+	"strings"
+	"unicode/utf8"
+)
+
+// SMS encodings
+const (
+	GSM7 = "GSM-7"
+	UCS2 = "UCS-2"
+)
+
+// Single and concatenated message capacity in encoding units
+const (
+	GSM7_SINGLE = 160
+	UCS2_SINGLE = 70
+)
+
+// GSM 03.38 default alphabet
+const gsm7_basic = "@£$¥èéùìòÇ\nØø\rÅåΔ_ΦΓΛΩΠΨΣΘΞÆæßÉ !\"#¤%&'()*+,-./0123456789:;<=>?" +
+                   "¡ABCDEFGHIJKLMNOPQRSTUVWXYZÄÖÑÜ§¿abcdefghijklmnopqrstuvwxyzäöñüà"
+
+// Extension table characters, take two septets
+const gsm7_extension = "\f^{}\\[~]|€"
+
+// Return encoding required for text and text length in its units:
+// septets for GSM-7, UTF-16 code units for UCS-2
+func Sms_encoding(text string) (string, int) {
+	septets := 0
+	for _, c := range text {
+		switch {
+		case strings.ContainsRune(gsm7_basic, c):
+			septets++
+		case strings.ContainsRune(gsm7_extension, c):
+			septets += 2
+		default:
+			units := 0
+			for _, c := range text {
+				units++
+				if c > 0xffff {
+					units++ // surrogate pair
+				}
+			}
+			return UCS2, units
+		}
+	}
+	return GSM7, septets
+}
+
+// Length of one character in encoding units
+func char_units(encoding string, c rune) int {
+	if encoding == GSM7 && strings.ContainsRune(gsm7_extension, c) {
+		return 2
+	}
+	if encoding == UCS2 && c > 0xffff {
+		return 2
+	}
+	return 1
+}
+
+// Split text into messages fitting into single SMS. Parts of long
+// text are prefixed with "<n>/<count> " because modem sends them
+// as independent messages
+func Split_sms(text string) []string {
+	encoding, length := Sms_encoding(text)
+	limit := GSM7_SINGLE
+	if encoding == UCS2 {
+		limit = UCS2_SINGLE
+	}
+	if length <= limit {
+		return []string{text}
+	}
+
+	// prefix length depends on parts count, repeat until it is stable
+	count := 1
+	for {
+		prefix := len(fmt.Sprintf("%d/%d ", count, count))
+		parts := split_units(encoding, text, limit - prefix)
+		if len(parts) == count {
+			for i := range parts {
+				parts[i] = fmt.Sprintf("%d/%d %s", i + 1, count, parts[i])
+			}
+			return parts
+		}
+		count = len(parts)
+	}
+}
+
+// Split text into chunks of at most limit units, preferring word boundaries
+func split_units(encoding string, text string, limit int) []string {
+	var parts []string
+	for text != "" {
+		units := 0
+		end := 0 // byte offset of chunk end
+		space := -1 // byte offset after last space inside chunk
+		for i, c := range text {
+			u := char_units(encoding, c)
+			if units + u > limit {
+				break
+			}
+			units += u
+			end = i + utf8.RuneLen(c)
+			if c == ' ' || c == '\n' {
+				space = end
+			}
+		}
+		if end < len(text) && space > 0 && space > end / 2 {
+			end = space
+		}
+		parts = append(parts, strings.TrimRight(text[:end], " \n"))
+		text = strings.TrimLeft(text[end:], " \n")
+	}
+	return parts
+}
@@ -0,0 +1,113 @@
+package modem
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+func TestSmsEncoding(t *testing.T) {
+	tests := []struct {
+		text string
+		encoding string
+		length int
+	}{
+		{"", GSM7, 0},
+		{"hello", GSM7, 5},
+		{"price 5€ [x]", GSM7, 15}, // extension chars take two septets
+		{"Привет", UCS2, 6},
+		{"ok 👍", UCS2, 5}, // surrogate pair
+	}
+	for _, tt := range tests {
+		encoding, length := Sms_encoding(tt.text)
+		if encoding != tt.encoding || length != tt.length {
+			t.Errorf("Sms_encoding(%q) = %s, %d; want %s, %d",
+			         tt.text, encoding, length, tt.encoding, tt.length)
+		}
+	}
+}
+
+func TestSplitSmsSingle(t *testing.T) {
+	for _, text := range []string{
+		"",
+		strings.Repeat("a", GSM7_SINGLE),
+		strings.Repeat("я", UCS2_SINGLE),
+	} {
+		parts := Split_sms(text)
+		if len(parts) != 1 || parts[0] != text {
+			t.Errorf("Split_sms(%d chars) = %q, one unchanged part expected",
+			         utf8.RuneCountInString(text), parts)
+		}
+	}
+}
+
+// Every part fits into single SMS, has "i/n " prefix and parts
+// joined back give original words
+func check_parts(t *testing.T, text string, parts []string, count int) {
+	t.Helper()
+	if len(parts) != count {
+		t.Fatalf("%d parts, want %d: %q", len(parts), count, parts)
+	}
+
+	var words []string
+	for i, part := range parts {
+		encoding, length := Sms_encoding(part)
+		limit := GSM7_SINGLE
+		if encoding == UCS2 {
+			limit = UCS2_SINGLE
+		}
+		if length > limit {
+			t.Errorf("part %d is %d units long, limit %d", i + 1, length, limit)
+		}
+
+		prefix := fmt.Sprintf("%d/%d ", i + 1, count)
+		if !strings.HasPrefix(part, prefix) {
+			t.Errorf("part %d %q has no prefix %q", i + 1, part, prefix)
+			continue
+		}
+		words = append(words, strings.Fields(part[len(prefix):])...)
+	}
+	if strings.Join(words, " ") != strings.Join(strings.Fields(text), " ") {
+		t.Errorf("parts %q do not give back text %q", parts, text)
+	}
+}
+
+func TestSplitSmsGsm7(t *testing.T) {
+	text := strings.TrimSpace(strings.Repeat("alarm zone ", 20)) // 219 chars
+	check_parts(t, text, Split_sms(text), 2)
+}
+
+func TestSplitSmsUcs2(t *testing.T) {
+	text := strings.TrimSpace(strings.Repeat("Проверка ", 20)) // 179 chars
+	check_parts(t, text, Split_sms(text), 3)
+}
+
+func TestSplitSmsLongWord(t *testing.T) {
+	text := strings.Repeat("x", 400)
+	parts := Split_sms(text)
+	if len(parts) != 3 {
+		t.Fatalf("%d parts, want 3", len(parts))
+	}
+	var joined string
+	for i, part := range parts {
+		joined += strings.TrimPrefix(part, fmt.Sprintf("%d/3 ", i + 1))
+	}
+	if joined != text {
+		t.Errorf("word split across parts is not restored")
+	}
+}
+
+func TestSplitSmsExtensionChars(t *testing.T) {
+	// 100 euro signs take 200 septets
+	text := strings.Repeat("€", 100)
+	parts := Split_sms(text)
+	if len(parts) != 2 {
+		t.Fatalf("%d parts, want 2: %q", len(parts), parts)
+	}
+	for i, part := range parts {
+		if _, length := Sms_encoding(part); length > GSM7_SINGLE {
+			t.Errorf("part %d is %d septets long", i + 1, length)
+		}
+	}
+}
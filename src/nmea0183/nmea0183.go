@@ -2,13 +2,24 @@ package nmea0183
 
 import (
 	"fmt"
+	"metrics"
 	"strings"
+	"sync/atomic"
+)
+
+var (
+	stat_checksum_errors = metrics.New_counter("module_io_uart_checksum_errors_total",
+	                                           "Frames dropped because of bad checksum")
+	stat_parse_errors = metrics.New_counter("module_io_uart_parse_errors_total",
+	                                        "Frames dropped because of bad format")
 )
 
 type Nmea0183 struct {
 	buf []byte
 	rx_carry bool
 	start bool
+	checksum_errors int32 // read by other goroutines, atomic
+	parse_errors int32
 }
 
 type Nmea_msg struct {
@@ -42,6 +53,8 @@ func (t *Nmea0183) parse() *Nmea_msg {
 		fmt.Sscanf(parts[1], "%x", &check_sum)
 		buf = parts[0]
 		if t.calc_checksum(buf) != check_sum {
+			stat_checksum_errors.Inc()
+			atomic.AddInt32(&t.checksum_errors, 1)
 			return nil
 		}
     }
@@ -53,6 +66,8 @@ func (t *Nmea0183) parse() *Nmea_msg {
     	if first {
     		first = false
     		if len(v) != 5 {
+    			stat_parse_errors.Inc()
+    			atomic.AddInt32(&t.parse_errors, 1)
     			return nil
     		}
     		msg.Ti = string([]byte(v)[:2])
@@ -65,10 +80,22 @@ func (t *Nmea0183) parse() *Nmea_msg {
     	msg.Args = append(msg.Args, arg)
     }
     
+    if len(msg.Args) == 0 {
+        stat_parse_errors.Inc()
+        atomic.AddInt32(&t.parse_errors, 1)
+        return nil
+    }
     msg.Request_id = msg.Args[0]
 	return &msg
 }
 
+// Return counters of dropped frames: bad checksum, bad format.
+// Safe to call while other goroutine pushes data
+func (t *Nmea0183) Errors() (int, int) {
+	return int(atomic.LoadInt32(&t.checksum_errors)),
+	       int(atomic.LoadInt32(&t.parse_errors))
+}
+
 // Push byte data into Nmea0183 parser
 func (t *Nmea0183) Push_rxb(rxb byte) *Nmea_msg {
 	switch rxb {
@@ -95,6 +122,8 @@ func (t *Nmea0183) Push_rxb(rxb byte) *Nmea_msg {
 
         if (len(t.buf) == cap(t.buf)) {
             t.start = false
+            stat_parse_errors.Inc()
+            atomic.AddInt32(&t.parse_errors, 1)
             return nil;
         }
 
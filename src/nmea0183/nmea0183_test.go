@@ -0,0 +1,50 @@
+package nmea0183
+
+import (
+	"sync"
+	"testing"
+)
+
+func push(t *Nmea0183, data string) []*Nmea_msg {
+	var list []*Nmea_msg
+	for i := 0; i < len(data); i++ {
+		if msg := t.Push_rxb(data[i]); msg != nil {
+			list = append(list, msg)
+		}
+	}
+	return list
+}
+
+func TestErrors(t *testing.T) {
+	p := New()
+	msgs := push(p, "$IOSOP,1,3,1*2C\r\n" + // bad checksum
+	                "$IOSOP,1,3,1*A3\r\n" +
+	                "$IOSOPX,1,3\r\n" + // bad sentence id
+	                "$IOSOP\r\n") // no request id
+	if len(msgs) != 1 || msgs[0].Si != "SOP" || msgs[0].Request_id != 1 {
+		t.Errorf("unexpected messages %+v", msgs)
+	}
+	if checksum, format := p.Errors(); checksum != 1 || format != 2 {
+		t.Errorf("got %d checksum and %d format errors, want 1 and 2", checksum, format)
+	}
+}
+
+// Counters are read by status command while receiver pushes data
+func TestErrorsConcurrent(t *testing.T) {
+	p := New()
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 100; i++ {
+			push(p, "$IOSOP\r\n")
+		}
+	}()
+	for i := 0; i < 100; i++ {
+		p.Errors()
+	}
+	wg.Wait()
+	if _, format := p.Errors(); format != 100 {
+		t.Errorf("got %d format errors, want 100", format)
+	}
+}
@@ -0,0 +1,150 @@
+package poller
+
+import (
+	"conf"
+	"fmt"
+	"log/slog"
+	"mod_io"
+	"sync"
+	"time"
+)
+
+// Reconciliation statistics
+type Stats struct {
+	Cycles int
+	Polls int
+	Errors int
+	Input_drifts int
+	Output_drifts int
+	Last_cycle time.Time
+}
+
+// Function receiving input and relay changes missed by daemon
+type Reconciled func(relay bool, port int, state int)
+
+type Poller struct {
+	sync.Mutex
+	mio *mod_io.Mod_io
+	interval time.Duration
+	min_gap time.Duration
+	inputs_count int
+	outputs_count int
+	reconciled Reconciled
+	stats Stats
+}
+
+func New(mio *mod_io.Mod_io, cfg *conf.Module_io_cfg,
+         reconciled Reconciled) (*Poller, error) {
+	var err error
+	p := new(Poller)
+	p.mio = mio
+	p.inputs_count = cfg.Inputs_count
+	p.outputs_count = cfg.Outputs_count
+	p.reconciled = reconciled
+
+	if cfg.Poller.Interval != "" {
+		p.interval, err = time.ParseDuration(cfg.Poller.Interval)
+		if err != nil {
+			return nil, fmt.Errorf("poller: incorrect interval: %v", err)
+		}
+	}
+
+	p.min_gap = 200 * time.Millisecond
+	if cfg.Poller.Min_gap != "" {
+		p.min_gap, err = time.ParseDuration(cfg.Poller.Min_gap)
+		if err != nil {
+			return nil, fmt.Errorf("poller: incorrect min_gap: %v", err)
+		}
+	}
+	return p, nil
+}
+
+// Poller main loop, returns at once if polling is disabled
+func (p *Poller) Run() {
+	if p.interval == 0 {
+		return
+	}
+
+	for {
+		time.Sleep(p.interval)
+		p.poll_all()
+	}
+}
+
+// Wait for a pause in interactive commands
+func (p *Poller) wait_idle() {
+	for {
+		time.Sleep(p.min_gap)
+		if !p.mio.Busy() {
+			return
+		}
+	}
+}
+
+func (p *Poller) poll_all() {
+	input_drifts := 0
+	output_drifts := 0
+	request_id := p.mio.New_request_id()
+
+	for port := 1; port <= p.inputs_count; port++ {
+		if p.poll(request_id, false, port) {
+			input_drifts++
+		}
+	}
+
+	for port := 1; port <= p.outputs_count; port++ {
+		if p.poll(request_id, true, port) {
+			output_drifts++
+		}
+	}
+
+	p.Lock()
+	p.stats.Cycles++
+	p.stats.Input_drifts += input_drifts
+	p.stats.Output_drifts += output_drifts
+	p.stats.Last_cycle = time.Now()
+	stats := p.stats
+	p.Unlock()
+
+	if input_drifts > 0 || output_drifts > 0 {
+		slog.Warn("drift found", "module", "poller",
+		          "inputs", input_drifts, "outputs", output_drifts,
+		          "total_inputs", stats.Input_drifts,
+		          "total_outputs", stats.Output_drifts)
+	}
+}
+
+// Poll one port, returns true if its state differs from last known
+func (p *Poller) poll(request_id int, relay bool, port int) bool {
+	p.wait_idle()
+	prev, known, state, err := p.mio.Poll_port(request_id, relay, port)
+
+	p.Lock()
+	p.stats.Polls++
+	if err != nil {
+		p.stats.Errors++
+	}
+	p.Unlock()
+
+	if err != nil {
+		slog.Warn("poll failed", "module", "poller", "relay", relay,
+		          "port", port, "request_id", request_id, "err", err)
+	}
+	if err != nil || !known || prev.State == state {
+		return false
+	}
+
+	slog.Warn("state differs from last known", "module", "poller",
+	          "relay", relay, "port", port, "state", state,
+	          "known_state", prev.State, "known_source", prev.Source,
+	          "known_time", prev.Time)
+
+	p.reconciled(relay, port, state)
+	return true
+}
+
+func (p *Poller) Stats() Stats {
+	p.Lock()
+	defer p.Unlock()
+	return p.stats
+}
@@ -0,0 +1,126 @@
+package poller
+
+import (
+	"conf"
+	"fake_board"
+	"fmt"
+	"mod_io"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Reconciled changes collector
+type recorder struct {
+	sync.Mutex
+	list []string
+}
+
+func (r *recorder) reconciled(relay bool, port int, state int) {
+	r.Lock()
+	defer r.Unlock()
+	kind := "input"
+	if relay {
+		kind = "relay"
+	}
+	r.list = append(r.list, fmt.Sprintf("%s %d=%d", kind, port, state))
+}
+
+func (r *recorder) got() string {
+	r.Lock()
+	defer r.Unlock()
+	return fmt.Sprint(r.list)
+}
+
+func start(t *testing.T) (*fake_board.Board, *mod_io.Mod_io, *Poller, *recorder) {
+	iocfg := &conf.Module_io_cfg{Inputs_count: 2, Outputs_count: 2,
+	                             Poller: conf.Poller_cfg{Min_gap: "1ms"}}
+	b, mio := fake_board.Start_mod_io(t, iocfg, nil)
+	r := new(recorder)
+	p, err := New(mio, iocfg, r.reconciled)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b, mio, p, r
+}
+
+func TestDrift(t *testing.T) {
+	b, _, p, r := start(t)
+
+	// first cycle learns states
+	b.Set_relay(2, 1)
+	p.poll_all()
+	if r.got() != "[]" {
+		t.Fatalf("unknown ports are reported: %s", r.got())
+	}
+
+	b.Set_relay(1, 1)
+	b.Set_input_silently(2, 1)
+	p.poll_all()
+	if r.got() != "[input 2=1 relay 1=1]" {
+		t.Fatalf("drift is not reported: %s", r.got())
+	}
+
+	p.poll_all()
+	st := p.Stats()
+	if r.got() != "[input 2=1 relay 1=1]" || st.Cycles != 3 || st.Polls != 12 ||
+	   st.Input_drifts != 1 || st.Output_drifts != 1 {
+		t.Errorf("drift is reported twice: %s, %+v", r.got(), st)
+	}
+}
+
+func TestKnownChanges(t *testing.T) {
+	b, mio, p, r := start(t)
+	p.poll_all()
+
+	// changes known by event and by own switching are not drifts
+	b.Set_input(1, 1)
+	time.Sleep(50 * time.Millisecond)
+	err := mio.Relay_set_state(1, 2, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.poll_all()
+	if r.got() != "[]" {
+		t.Errorf("known changes are reported: %s", r.got())
+	}
+}
+
+// Event received while poll waits for reply reports the change, poll
+// must not report it again
+func TestEventDuringPoll(t *testing.T) {
+	b, _, p, r := start(t)
+	p.poll_all()
+
+	b.Set_input_on_read(1, 1)
+	p.poll_all()
+	if r.got() != "[]" {
+		t.Errorf("change reported by event is reported by poll: %s", r.got())
+	}
+}
+
+func TestPollError(t *testing.T) {
+	iocfg := &conf.Module_io_cfg{Inputs_count: 1, Outputs_count: 1,
+	                             Poller: conf.Poller_cfg{Min_gap: "1ms"}}
+	_, mio := fake_board.Start_mod_io(t, iocfg, nil)
+	mio.Close() // board does not answer
+	r := new(recorder)
+	p, err := New(mio, iocfg, r.reconciled)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p.poll_all()
+	if st := p.Stats(); st.Errors != 2 || r.got() != "[]" {
+		t.Errorf("unexpected stats %+v, reported %s", st, r.got())
+	}
+}
+
+func TestConfigErrors(t *testing.T) {
+	for _, pcfg := range []conf.Poller_cfg{{Interval: "often"}, {Min_gap: "-"}} {
+		_, err := New(nil, &conf.Module_io_cfg{Poller: pcfg}, nil)
+		if err == nil {
+			t.Errorf("%+v: error expected", pcfg)
+		}
+	}
+}
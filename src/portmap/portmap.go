@@ -0,0 +1,167 @@
+package portmap
+
+import (
+	"conf"
+	"fmt"
+	"sort"
+	"strconv"
+	"sync"
+)
+
+const (
+	INPUT = "input"
+	OUTPUT = "output"
+)
+
+// Named board port
+type Port struct {
+	Port int
+	Name string
+	Direction string
+	Kind string
+	Inverted bool
+	Description string
+	Tags []string
+}
+
+// Port names and logic of this daemon's module
+type Map struct {
+	sync.RWMutex
+	module string
+	by_name map[string]*Port
+	by_port map[string]map[int]*Port // direction -> port number -> port
+}
+
+func New(module string, ports_cfg []conf.Port_cfg) (*Map, error) {
+	m := new(Map)
+	m.module = module
+	err := m.Reload(ports_cfg)
+	if err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// Replace port map. Current map is kept if new one is incorrect.
+// Entries of other modules are skipped
+func (m *Map) Reload(ports_cfg []conf.Port_cfg) error {
+	by_name := make(map[string]*Port)
+	by_port := map[string]map[int]*Port{INPUT: {}, OUTPUT: {}}
+
+	for _, pcfg := range ports_cfg {
+		if pcfg.Module != "" && pcfg.Module != m.module {
+			continue
+		}
+		if pcfg.Direction != INPUT && pcfg.Direction != OUTPUT {
+			return fmt.Errorf("portmap: port %s: incorrect direction '%s'",
+			                  pcfg.Name, pcfg.Direction)
+		}
+		if _, ok := by_name[pcfg.Name]; ok {
+			return fmt.Errorf("portmap: port name %s is not unique", pcfg.Name)
+		}
+		if _, err := strconv.Atoi(pcfg.Name); err == nil || pcfg.Name == "" {
+			return fmt.Errorf("portmap: incorrect port name '%s'", pcfg.Name)
+		}
+
+		p := &Port{Port: pcfg.Port,
+		           Name: pcfg.Name,
+		           Direction: pcfg.Direction,
+		           Kind: pcfg.Kind,
+		           Inverted: pcfg.Inverted,
+		           Description: pcfg.Description,
+		           Tags: pcfg.Tags}
+		by_name[p.Name] = p
+		by_port[p.Direction][p.Port] = p
+	}
+
+	m.Lock()
+	m.by_name = by_name
+	m.by_port = by_port
+	m.Unlock()
+	return nil
+}
+
+func (m *Map) find(direction string, port int) *Port {
+	m.RLock()
+	defer m.RUnlock()
+	return m.by_port[direction][port]
+}
+
+// Return port number by its number or name
+func (m *Map) Resolve(direction string, arg string) (int, error) {
+	port, err := strconv.Atoi(arg)
+	if err == nil {
+		return port, nil
+	}
+
+	m.RLock()
+	p, ok := m.by_name[arg]
+	m.RUnlock()
+	if !ok {
+		return 0, fmt.Errorf("unknown port '%s'", arg)
+	}
+	if p.Direction != direction {
+		return 0, fmt.Errorf("port '%s' is %s", arg, p.Direction)
+	}
+	return p.Port, nil
+}
+
+// Return port name, empty if port is not named
+func (m *Map) Name(direction string, port int) string {
+	p := m.find(direction, port)
+	if p == nil {
+		return ""
+	}
+	return p.Name
+}
+
+// Return port name or number if port is not named
+func (m *Map) Label(direction string, port int) string {
+	name := m.Name(direction, port)
+	if name == "" {
+		return strconv.Itoa(port)
+	}
+	return name
+}
+
+// Return port description, nil if port is not named
+func (m *Map) Port(direction string, port int) *Port {
+	p := m.find(direction, port)
+	if p == nil {
+		return nil
+	}
+	cp := *p
+	return &cp
+}
+
+// Convert physical state to logical one seen by users
+func (m *Map) Logical(direction string, port int, state int) int {
+	p := m.find(direction, port)
+	if p != nil && p.Inverted {
+		return 1 - state
+	}
+	return state
+}
+
+// Convert logical state to physical one sent to board
+func (m *Map) Physical(direction string, port int, state int) int {
+	return m.Logical(direction, port, state)
+}
+
+// Return all named ports sorted by direction and number
+func (m *Map) List() []Port {
+	m.RLock()
+	var list []Port
+	for _, p := range m.by_name {
+		list = append(list, *p)
+	}
+	m.RUnlock()
+
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].Direction != list[j].Direction {
+			return list[i].Direction < list[j].Direction
+		}
+		return list[i].Port < list[j].Port
+	})
+	return list
+}
@@ -0,0 +1,112 @@
+package portmap
+
+import (
+	"conf"
+	"testing"
+)
+
+func test_ports() []conf.Port_cfg {
+	return []conf.Port_cfg{
+		{Port: 3, Name: "lamp", Direction: OUTPUT, Inverted: true},
+		{Port: 4, Name: "pump", Direction: OUTPUT},
+		{Port: 3, Name: "door", Direction: INPUT, Inverted: true},
+		{Port: 1, Name: "bell", Direction: INPUT},
+		{Module: "usio2", Port: 1, Name: "remote", Direction: OUTPUT},
+	}
+}
+
+func TestInversion(t *testing.T) {
+	m, err := New("usio1", test_ports())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		direction string
+		port int
+		physical int
+		logical int
+	}{
+		{OUTPUT, 3, 0, 1},
+		{OUTPUT, 3, 1, 0},
+		{OUTPUT, 4, 1, 1},
+		{OUTPUT, 5, 1, 1}, // not named
+		{INPUT, 3, 0, 1},
+		{INPUT, 1, 0, 0},
+		{OUTPUT, 1, 1, 1}, // inverted port of other module
+	}
+	for _, tt := range tests {
+		if got := m.Logical(tt.direction, tt.port, tt.physical); got != tt.logical {
+			t.Errorf("Logical(%s, %d, %d) = %d, want %d", tt.direction, tt.port,
+			         tt.physical, got, tt.logical)
+		}
+		if got := m.Physical(tt.direction, tt.port, tt.logical); got != tt.physical {
+			t.Errorf("Physical(%s, %d, %d) = %d, want %d", tt.direction, tt.port,
+			         tt.logical, got, tt.physical)
+		}
+	}
+}
+
+func TestResolve(t *testing.T) {
+	m, err := New("usio1", test_ports())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		direction string
+		arg string
+		port int
+		ok bool
+	}{
+		{OUTPUT, "lamp", 3, true},
+		{OUTPUT, "7", 7, true},
+		{INPUT, "door", 3, true},
+		{INPUT, "lamp", 0, false}, // wrong direction
+		{OUTPUT, "remote", 0, false}, // other module
+		{OUTPUT, "garage", 0, false},
+	}
+	for _, tt := range tests {
+		port, err := m.Resolve(tt.direction, tt.arg)
+		if (err == nil) != tt.ok || port != tt.port {
+			t.Errorf("Resolve(%s, %s) = %d, %v", tt.direction, tt.arg, port, err)
+		}
+	}
+
+	if m.Label(OUTPUT, 3) != "lamp" || m.Label(OUTPUT, 5) != "5" {
+		t.Errorf("unexpected labels %s, %s", m.Label(OUTPUT, 3), m.Label(OUTPUT, 5))
+	}
+	list := m.List()
+	if len(list) != 4 || list[0].Name != "bell" || list[3].Name != "pump" {
+		t.Errorf("unexpected list %+v", list)
+	}
+}
+
+func TestReload(t *testing.T) {
+	m, err := New("usio1", test_ports())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, ports := range [][]conf.Port_cfg{
+		{{Port: 1, Name: "a", Direction: "both"}},
+		{{Port: 1, Name: "a", Direction: INPUT}, {Port: 2, Name: "a", Direction: INPUT}},
+		{{Port: 1, Name: "12", Direction: INPUT}},
+		{{Port: 1, Direction: INPUT}},
+	} {
+		if m.Reload(ports) == nil {
+			t.Errorf("Reload(%+v): error expected", ports)
+		}
+	}
+	if m.Logical(OUTPUT, 3, 0) != 1 {
+		t.Errorf("map is changed by incorrect reload")
+	}
+
+	err = m.Reload([]conf.Port_cfg{{Port: 5, Name: "lamp", Direction: OUTPUT}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if port, _ := m.Resolve(OUTPUT, "lamp"); port != 5 || m.Logical(OUTPUT, 3, 0) != 0 {
+		t.Errorf("reloaded map is not applied")
+	}
+}
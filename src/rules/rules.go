@@ -0,0 +1,382 @@
+package rules
+
+import (
+	"conf"
+	"events"
+	"fmt"
+	"log/slog"
+	"mod_io"
+	"portmap"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"timers"
+)
+
+// Condition on other port state
+type condition struct {
+	relay bool // relay or input port
+	port int
+	state int // logical state
+}
+
+// Parsed rule action
+type action struct {
+	cmd string // "relay_set", "relay_pulse" or "event"
+	port int
+	state int // logical state
+	duration time.Duration // pulse width or delay of relay_set
+	name string // event name
+}
+
+type rule struct {
+	name string
+	input int
+	state int // logical state, -1 means any state
+	debounce time.Duration
+	window_from int // minutes since midnight, -1 if no window
+	window_to int
+	conditions []condition
+	actions []action
+}
+
+type Rules struct {
+	sync.Mutex
+	mio *mod_io.Mod_io
+	timers *timers.Timers
+	sink *events.Sink
+	ports *portmap.Map
+	rules []*rule
+	inputs map[int]int // last reported input states
+	changed map[int]time.Time // last input change time
+	running sync.WaitGroup // rules being executed
+	stopped bool
+}
+
+// Ports are given by numbers or names of port map, states are logical
+func New(mio *mod_io.Mod_io, tm *timers.Timers, sink *events.Sink,
+         ports *portmap.Map, rules_cfg []conf.Rule_cfg) (*Rules, error) {
+	r := new(Rules)
+	r.mio = mio
+	r.timers = tm
+	r.sink = sink
+	r.ports = ports
+	r.inputs = make(map[int]int)
+	r.changed = make(map[int]time.Time)
+	err := r.Reload(rules_cfg)
+	if err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// Replace rules. Current rules are kept if new ones are incorrect.
+// Port names are resolved by current port map
+func (r *Rules) Reload(rules_cfg []conf.Rule_cfg) error {
+	var list []*rule
+	for i := range rules_cfg {
+		rl, err := r.parse_rule(&rules_cfg[i])
+		if err != nil {
+			return fmt.Errorf("rules: rule %s: %v", rules_cfg[i].Name, err)
+		}
+		list = append(list, rl)
+	}
+
+	r.Lock()
+	r.rules = list
+	r.Unlock()
+	return nil
+}
+
+func (r *Rules) parse_rule(rcfg *conf.Rule_cfg) (*rule, error) {
+	var err error
+	rl := &rule{name: rcfg.Name, window_from: -1}
+
+	rl.input, err = r.ports.Resolve(portmap.INPUT, rcfg.Input)
+	if err != nil {
+		return nil, fmt.Errorf("incorrect input: %v", err)
+	}
+
+	switch rcfg.State {
+	case "", "any":
+		rl.state = -1
+	case "0", "1":
+		rl.state, _ = strconv.Atoi(rcfg.State)
+	default:
+		return nil, fmt.Errorf("incorrect state '%s'", rcfg.State)
+	}
+
+	if rcfg.Debounce != "" {
+		rl.debounce, err = time.ParseDuration(rcfg.Debounce)
+		if err != nil {
+			return nil, fmt.Errorf("incorrect debounce: %v", err)
+		}
+	}
+
+	if rcfg.Window != "" {
+		var h1, m1, h2, m2 int
+		_, err = fmt.Sscanf(rcfg.Window, "%d:%d-%d:%d", &h1, &m1, &h2, &m2)
+		if err != nil {
+			return nil, fmt.Errorf("incorrect window '%s'", rcfg.Window)
+		}
+		rl.window_from = h1 * 60 + m1
+		rl.window_to = h2 * 60 + m2
+	}
+
+	for _, str := range rcfg.Conditions {
+		c, err := r.parse_condition(str)
+		if err != nil {
+			return nil, err
+		}
+		rl.conditions = append(rl.conditions, c)
+	}
+
+	for _, str := range rcfg.Actions {
+		a, err := r.parse_action(str)
+		if err != nil {
+			return nil, err
+		}
+		rl.actions = append(rl.actions, a)
+	}
+	return rl, nil
+}
+
+// Parse "input <port> = <state>" or "relay <port> = <state>"
+func (r *Rules) parse_condition(str string) (condition, error) {
+	var c condition
+	var err error
+	args := strings.Fields(str)
+	if len(args) != 4 || args[2] != "=" ||
+	   (args[0] != "input" && args[0] != "relay") {
+		return c, fmt.Errorf("incorrect condition '%s'", str)
+	}
+
+	c.relay = args[0] == "relay"
+	direction := portmap.INPUT
+	if c.relay {
+		direction = portmap.OUTPUT
+	}
+	c.port, err = r.ports.Resolve(direction, args[1])
+	if err == nil {
+		c.state, err = parse_state(args[3])
+	}
+	if err != nil {
+		return c, fmt.Errorf("incorrect condition '%s': %v", str, err)
+	}
+	return c, nil
+}
+
+func parse_state(str string) (int, error) {
+	if str != "0" && str != "1" {
+		return 0, fmt.Errorf("state '%s' is not 0 or 1", str)
+	}
+	return strconv.Atoi(str)
+}
+
+// Parse "relay_set <port> <state> [after <delay>]",
+// "relay_pulse <port> <duration>" or "event <name>"
+func (r *Rules) parse_action(str string) (action, error) {
+	var a action
+	var err error
+	args := strings.Fields(str)
+	if len(args) == 0 {
+		return a, fmt.Errorf("empty action")
+	}
+
+	a.cmd = args[0]
+	switch {
+	case a.cmd == "relay_set" && (len(args) == 3 || len(args) == 5):
+		a.port, err = r.ports.Resolve(portmap.OUTPUT, args[1])
+		if err == nil {
+			a.state, err = parse_state(args[2])
+		}
+		if err == nil && len(args) == 5 {
+			if args[3] != "after" {
+				err = fmt.Errorf("'after' expected")
+			} else {
+				a.duration, err = time.ParseDuration(args[4])
+			}
+		}
+
+	case a.cmd == "relay_pulse" && len(args) == 3:
+		a.port, err = r.ports.Resolve(portmap.OUTPUT, args[1])
+		if err == nil {
+			a.duration, err = time.ParseDuration(args[2])
+		}
+
+	case a.cmd == "event" && len(args) == 2:
+		a.name = args[1]
+
+	default:
+		err = fmt.Errorf("unknown command")
+	}
+
+	if err != nil {
+		return a, fmt.Errorf("incorrect action '%s': %v", str, err)
+	}
+	return a, nil
+}
+
+// Handle input port change reported by board, state is physical
+func (r *Rules) Input_changed(port int, state int) {
+	r.Lock()
+	if r.stopped {
+		r.Unlock()
+		return
+	}
+	r.inputs[port] = state
+	changed := time.Now()
+	r.changed[port] = changed
+
+	var matched []*rule
+	for _, rl := range r.rules {
+		if rl.input != port {
+			continue
+		}
+		if rl.state >= 0 && rl.state != r.ports.Logical(portmap.INPUT, port, state) {
+			continue
+		}
+		if rl.debounce == 0 {
+			r.running.Add(1)
+		}
+		matched = append(matched, rl)
+	}
+	r.Unlock()
+
+	for _, rl := range matched {
+		if rl.debounce == 0 {
+			go func(rl *rule) {
+				defer r.running.Done()
+				r.try_rule(rl, port, state)
+			}(rl)
+			continue
+		}
+
+		rl := rl
+		time.AfterFunc(rl.debounce, func() {
+			// input must keep the state during debounce time
+			r.Lock()
+			stable := !r.stopped && r.inputs[port] == state &&
+			          r.changed[port] == changed
+			if stable {
+				r.running.Add(1)
+			}
+			r.Unlock()
+			if stable {
+				defer r.running.Done()
+				r.try_rule(rl, port, state)
+			}
+		})
+	}
+}
+
+// Stop reacting on inputs and wait for running rules
+func (r *Rules) Stop() {
+	r.Lock()
+	r.stopped = true
+	r.Unlock()
+	r.running.Wait()
+}
+
+func (r *Rules) in_window(rl *rule) bool {
+	if rl.window_from < 0 {
+		return true
+	}
+
+	now := time.Now()
+	minutes := now.Hour() * 60 + now.Minute()
+	if rl.window_from <= rl.window_to {
+		return minutes >= rl.window_from && minutes < rl.window_to
+	}
+	// window crosses midnight
+	return minutes >= rl.window_from || minutes < rl.window_to
+}
+
+func (r *Rules) check_conditions(rl *rule, request_id int) (bool, error) {
+	for _, c := range rl.conditions {
+		var state int
+		var err error
+		direction := portmap.INPUT
+		if c.relay {
+			direction = portmap.OUTPUT
+			state, err = r.mio.Get_output_port_state(request_id, c.port)
+		} else {
+			state, err = r.mio.Get_input_port_state(request_id, c.port)
+		}
+		if err != nil {
+			return false, err
+		}
+		if r.ports.Logical(direction, c.port, state) != c.state {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+func (r *Rules) try_rule(rl *rule, port int, state int) {
+	if !r.in_window(rl) {
+		return
+	}
+
+	request_id := r.mio.New_request_id()
+	ok, err := r.check_conditions(rl, request_id)
+	if err != nil {
+		slog.Error("can't check conditions", "module", "rules", "rule", rl.name,
+		           "request_id", request_id, "err", err)
+		return
+	}
+	if !ok {
+		return
+	}
+
+	slog.Info("rule triggered", "module", "rules", "rule", rl.name,
+	          "port", port, "state", state, "request_id", request_id)
+	for _, a := range rl.actions {
+		err = r.run_action(request_id, &a, port, state)
+		if err != nil {
+			slog.Error("action failed", "module", "rules", "rule", rl.name,
+			           "action", a.cmd, "port", a.port, "request_id", request_id,
+			           "err", err)
+		}
+	}
+}
+
+func (r *Rules) run_action(request_id int, a *action, port int, state int) error {
+	switch a.cmd {
+	case "relay_set":
+		state := r.ports.Physical(portmap.OUTPUT, a.port, a.state)
+		if a.duration > 0 {
+			r.timers.Set_after(a.port, state, a.duration)
+			return nil
+		}
+		return r.mio.Relay_set_state(request_id, a.port, state)
+
+	case "relay_pulse":
+		_, err := r.timers.Pulse(request_id, a.port,
+		                         r.ports.Physical(portmap.OUTPUT, a.port, 1), a.duration)
+		return err
+
+	case "event":
+		r.sink.Send(&events.Event{Port: port, State: state, Name: a.name})
+	}
+	return nil
+}
+
+// Return rules description
+func (r *Rules) List() []string {
+	r.Lock()
+	defer r.Unlock()
+
+	var list []string
+	for _, rl := range r.rules {
+		state := "any"
+		if rl.state >= 0 {
+			state = strconv.Itoa(rl.state)
+		}
+		list = append(list, fmt.Sprintf("%s input=%s state=%s conditions=%d actions=%d",
+		                                rl.name, r.ports.Label(portmap.INPUT, rl.input), state,
+		                                len(rl.conditions), len(rl.actions)))
+	}
+	return list
+}
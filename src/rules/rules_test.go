@@ -0,0 +1,239 @@
+package rules
+
+import (
+	"conf"
+	"events"
+	"fake_board"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"portmap"
+	"strings"
+	"testing"
+	"time"
+	"timers"
+)
+
+const WAIT = 2 * time.Second
+
+func test_ports(t *testing.T) *portmap.Map {
+	ports, err := portmap.New("usio1", []conf.Port_cfg{
+		{Port: 3, Name: "lamp", Direction: portmap.OUTPUT, Inverted: true},
+		{Port: 2, Name: "door", Direction: portmap.INPUT},
+		{Port: 5, Name: "alarm_loop", Direction: portmap.INPUT, Inverted: true},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ports
+}
+
+// Rules on fake board, events are posted to returned channel
+func start(t *testing.T, rules_cfg []conf.Rule_cfg) (*fake_board.Board, *Rules,
+                                                     chan string) {
+	ports := test_ports(t)
+	b, mio := fake_board.Start_mod_io(t, nil, ports)
+	tm := timers.New(mio, "")
+	t.Cleanup(tm.Stop)
+
+	posted := make(chan string, 16)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter,
+	                                                r *http.Request) {
+		posted <- r.URL.RawQuery
+	}))
+	t.Cleanup(srv.Close)
+	sink := events.New(srv.URL + "/?port=%d&state=%d", ports)
+	t.Cleanup(func() { sink.Close(time.Second) })
+
+	r, err := New(mio, tm, sink, ports, rules_cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(r.Stop)
+	return b, r, posted
+}
+
+func TestParseErrors(t *testing.T) {
+	ports := test_ports(t)
+	for _, rcfg := range []conf.Rule_cfg{
+		{Name: "no_input", Actions: []string{"event x"}},
+		{Name: "unknown_input", Input: "garage", Actions: []string{"event x"}},
+		{Name: "relay_as_input", Input: "lamp", Actions: []string{"event x"}},
+		{Name: "state", Input: "2", State: "on", Actions: []string{"event x"}},
+		{Name: "debounce", Input: "2", Debounce: "soon", Actions: []string{"event x"}},
+		{Name: "window", Input: "2", Window: "22-06", Actions: []string{"event x"}},
+		{Name: "cond_kind", Input: "2", Conditions: []string{"timer 1 = 1"},
+		 Actions: []string{"event x"}},
+		{Name: "cond_state", Input: "2", Conditions: []string{"relay lamp = 2"},
+		 Actions: []string{"event x"}},
+		{Name: "cond_port", Input: "2", Conditions: []string{"input lamp = 1"},
+		 Actions: []string{"event x"}},
+		{Name: "cond_format", Input: "2", Conditions: []string{"relay lamp 1"},
+		 Actions: []string{"event x"}},
+		{Name: "action", Input: "2", Actions: []string{"relay_toggle lamp"}},
+		{Name: "set_state", Input: "2", Actions: []string{"relay_set lamp on"}},
+		{Name: "set_after", Input: "2", Actions: []string{"relay_set lamp 1 later 5s"}},
+		{Name: "set_port", Input: "2", Actions: []string{"relay_set door 1"}},
+		{Name: "pulse", Input: "2", Actions: []string{"relay_pulse lamp"}},
+		{Name: "event", Input: "2", Actions: []string{"event"}},
+	} {
+		_, err := New(nil, nil, nil, ports, []conf.Rule_cfg{rcfg})
+		if err == nil {
+			t.Errorf("rule %s: error expected", rcfg.Name)
+		}
+	}
+}
+
+func TestList(t *testing.T) {
+	r, err := New(nil, nil, nil, test_ports(t), []conf.Rule_cfg{
+		{Name: "bell", Input: "door", State: "1", Actions: []string{"event bell"}},
+		{Name: "any", Input: "7", Conditions: []string{"relay 4 = 0"},
+		 Actions: []string{"relay_set lamp 1", "relay_set 4 0 after 1m"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "bell input=door state=1 conditions=0 actions=1\n" +
+	        "any input=7 state=any conditions=1 actions=2"
+	if got := strings.Join(r.List(), "\n"); got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestReloadKeepsRules(t *testing.T) {
+	r, err := New(nil, nil, nil, test_ports(t), []conf.Rule_cfg{
+		{Name: "bell", Input: "door", Actions: []string{"event bell"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = r.Reload([]conf.Rule_cfg{{Name: "bad", Input: "garage",
+	                                 Actions: []string{"event x"}}})
+	if err == nil || len(r.List()) != 1 {
+		t.Errorf("incorrect rules must be rejected, got %v %q", err, r.List())
+	}
+}
+
+func TestRelaySet(t *testing.T) {
+	b, r, _ := start(t, []conf.Rule_cfg{
+		{Name: "on", Input: "door", State: "1", Actions: []string{"relay_set 4 1"}},
+		{Name: "off", Input: "door", State: "0",
+		 Actions: []string{"relay_set 4 0 after 100ms"}},
+	})
+
+	r.Input_changed(2, 1)
+	if !b.Wait_relay(4, 1, WAIT) {
+		t.Fatalf("relay is not switched on")
+	}
+	r.Input_changed(2, 0)
+	time.Sleep(50 * time.Millisecond)
+	if b.Relay(4) != 1 {
+		t.Fatalf("delayed action is run at once")
+	}
+	if !b.Wait_relay(4, 0, WAIT) {
+		t.Errorf("delayed action is not run")
+	}
+}
+
+// Rule states and relay states are logical for inverted ports
+func TestInvertedPorts(t *testing.T) {
+	b, r, _ := start(t, []conf.Rule_cfg{
+		{Name: "alarm", Input: "alarm_loop", State: "1",
+		 Conditions: []string{"relay lamp = 0"},
+		 Actions: []string{"relay_pulse lamp 200ms"}},
+	})
+	b.Set_relay(3, 1) // lamp is off
+
+	r.Input_changed(5, 1) // physical 1 is logical 0
+	time.Sleep(100 * time.Millisecond)
+	if b.Relay(3) != 1 {
+		t.Fatalf("rule is triggered by inactive input")
+	}
+
+	r.Input_changed(5, 0)
+	if !b.Wait_relay(3, 0, WAIT) {
+		t.Fatalf("inverted relay is not switched on")
+	}
+	if !b.Wait_relay(3, 1, WAIT) {
+		t.Fatalf("inverted pulse is not released")
+	}
+
+	// lamp is on, condition fails
+	b.Set_relay(3, 0)
+	r.Input_changed(5, 1)
+	r.Input_changed(5, 0)
+	time.Sleep(300 * time.Millisecond)
+	if b.Relay(3) != 0 {
+		t.Errorf("rule ignored condition on inverted relay")
+	}
+}
+
+func TestEvent(t *testing.T) {
+	_, r, posted := start(t, []conf.Rule_cfg{
+		{Name: "bell", Input: "door", Actions: []string{"event doorbell"}},
+	})
+	r.Input_changed(2, 1)
+	select {
+	case query := <- posted:
+		if query != "port=2&state=1&name=door&event=doorbell" {
+			t.Errorf("unexpected event %s", query)
+		}
+	case <- time.After(WAIT):
+		t.Errorf("event is not sent")
+	}
+}
+
+func TestDebounce(t *testing.T) {
+	b, r, _ := start(t, []conf.Rule_cfg{
+		{Name: "on", Input: "door", State: "1", Debounce: "100ms",
+		 Actions: []string{"relay_set 4 1"}},
+	})
+
+	r.Input_changed(2, 1)
+	time.Sleep(50 * time.Millisecond)
+	r.Input_changed(2, 0)
+	time.Sleep(150 * time.Millisecond)
+	if b.Relay(4) != 0 {
+		t.Fatalf("rule is triggered by short pulse")
+	}
+
+	r.Input_changed(2, 1)
+	if !b.Wait_relay(4, 1, WAIT) {
+		t.Errorf("rule is not triggered by stable input")
+	}
+}
+
+func TestWindow(t *testing.T) {
+	now := time.Now()
+	at := func(d time.Duration) string {
+		t := now.Add(d)
+		return fmt.Sprintf("%02d:%02d", t.Hour(), t.Minute())
+	}
+	b, r, _ := start(t, []conf.Rule_cfg{
+		{Name: "now", Input: "door", Window: at(-time.Minute) + "-" + at(2 * time.Minute),
+		 Actions: []string{"relay_set 4 1"}},
+		{Name: "later", Input: "door", Window: at(time.Hour) + "-" + at(2 * time.Hour),
+		 Actions: []string{"relay_set 6 1"}},
+	})
+
+	r.Input_changed(2, 1)
+	if !b.Wait_relay(4, 1, WAIT) {
+		t.Fatalf("rule is not triggered inside window")
+	}
+	time.Sleep(50 * time.Millisecond)
+	if b.Relay(6) != 0 {
+		t.Errorf("rule is triggered outside window")
+	}
+}
+
+func TestStop(t *testing.T) {
+	b, r, _ := start(t, []conf.Rule_cfg{
+		{Name: "on", Input: "door", Actions: []string{"relay_set 4 1"}},
+	})
+	r.Stop()
+	r.Input_changed(2, 1)
+	time.Sleep(100 * time.Millisecond)
+	if b.Relay(4) != 0 {
+		t.Errorf("stopped rules are triggered")
+	}
+}
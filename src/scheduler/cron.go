@@ -0,0 +1,140 @@
+package scheduler
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Parsed 5-field cron expression: minute hour day-of-month month day-of-week
+type cron_schedule struct {
+	minute uint64
+	hour uint64
+	dom uint64
+	month uint64
+	dow uint64
+	dom_any bool
+	dow_any bool
+}
+
+// Parse one cron field into bit set
+func parse_cron_field(field string, min int, max int) (uint64, bool, error) {
+	var bits uint64
+	any := field == "*"
+
+	for _, part := range strings.Split(field, ",") {
+		step := 1
+		if i := strings.Index(part, "/"); i >= 0 {
+			var err error
+			step, err = strconv.Atoi(part[i + 1:])
+			if err != nil || step <= 0 {
+				return 0, false, fmt.Errorf("incorrect step in '%s'", part)
+			}
+			part = part[:i]
+		}
+
+		lo, hi := min, max
+		if part != "*" {
+			var err error
+			bounds := strings.SplitN(part, "-", 2)
+			lo, err = strconv.Atoi(bounds[0])
+			if err != nil {
+				return 0, false, fmt.Errorf("incorrect value '%s'", part)
+			}
+			hi = lo
+			if len(bounds) == 2 {
+				hi, err = strconv.Atoi(bounds[1])
+				if err != nil {
+					return 0, false, fmt.Errorf("incorrect range '%s'", part)
+				}
+			} else if step > 1 {
+				hi = max
+			}
+		}
+
+		if lo < min || hi > max || lo > hi {
+			return 0, false, fmt.Errorf("'%s' is out of range %d-%d", part, min, max)
+		}
+
+		for v := lo; v <= hi; v += step {
+			bits |= 1 << uint(v)
+		}
+	}
+	return bits, any, nil
+}
+
+func parse_cron(expr string) (*cron_schedule, error) {
+	fields := strings.Fields(expr)
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("cron expression '%s' must have 5 fields", expr)
+	}
+
+	var err error
+	c := new(cron_schedule)
+	c.minute, _, err = parse_cron_field(fields[0], 0, 59)
+	if err == nil {
+		c.hour, _, err = parse_cron_field(fields[1], 0, 23)
+	}
+	if err == nil {
+		c.dom, c.dom_any, err = parse_cron_field(fields[2], 1, 31)
+	}
+	if err == nil {
+		c.month, _, err = parse_cron_field(fields[3], 1, 12)
+	}
+	if err == nil {
+		c.dow, c.dow_any, err = parse_cron_field(fields[4], 0, 7)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("cron expression '%s': %v", expr, err)
+	}
+
+	// 7 is Sunday as well as 0
+	if c.dow & (1 << 7) != 0 {
+		c.dow |= 1
+	}
+	return c, nil
+}
+
+func (c *cron_schedule) day_matches(t time.Time) bool {
+	dom := c.dom & (1 << uint(t.Day())) != 0
+	dow := c.dow & (1 << uint(t.Weekday())) != 0
+
+	// like in Vixie cron, restricted day-of-month and day-of-week are OR'ed
+	if c.dom_any || c.dow_any {
+		return dom && dow
+	}
+	return dom || dow
+}
+
+// Return first matching time after t
+func (c *cron_schedule) next(after time.Time) time.Time {
+	t := after.Truncate(time.Minute).Add(time.Minute)
+	limit := t.AddDate(5, 0, 0)
+
+	for t.Before(limit) {
+		if c.month & (1 << uint(t.Month())) == 0 {
+			t = time.Date(t.Year(), t.Month() + 1, 1, 0, 0, 0, 0, t.Location())
+			continue
+		}
+
+		if !c.day_matches(t) {
+			t = time.Date(t.Year(), t.Month(), t.Day() + 1, 0, 0, 0, 0, t.Location())
+			continue
+		}
+
+		if c.hour & (1 << uint(t.Hour())) == 0 {
+			t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour() + 1, 0, 0, 0,
+			              t.Location())
+			continue
+		}
+
+		if c.minute & (1 << uint(t.Minute())) == 0 {
+			t = t.Add(time.Minute)
+			continue
+		}
+
+		return t
+	}
+	return time.Time{}
+}
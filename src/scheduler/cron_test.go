@@ -0,0 +1,82 @@
+package scheduler
+
+import (
+	"testing"
+	"time"
+)
+
+func utc(s string) time.Time {
+	t, err := time.Parse("2006-01-02 15:04", s)
+	if err != nil {
+		panic(err)
+	}
+	return t
+}
+
+func TestParseCronErrors(t *testing.T) {
+	for _, expr := range []string{
+		"",
+		"* * * *",
+		"* * * * * *",
+		"60 * * * *",
+		"* 24 * * *",
+		"* * 0 * *",
+		"* * * 13 *",
+		"* * * * 8",
+		"5-1 * * * *",
+		"*/0 * * * *",
+		"a * * * *",
+		"1-x * * * *",
+	} {
+		_, err := parse_cron(expr)
+		if err == nil {
+			t.Errorf("parse_cron(%q): error expected", expr)
+		}
+	}
+}
+
+func TestCronNext(t *testing.T) {
+	tests := []struct {
+		expr string
+		after string
+		next string
+	}{
+		{"* * * * *", "2026-10-19 11:45", "2026-10-19 11:46"},
+		{"30 1 * * *", "2026-10-19 11:45", "2026-10-20 01:30"},
+		{"30 1 * * *", "2026-10-19 01:29", "2026-10-19 01:30"},
+		{"*/15 * * * *", "2026-10-19 11:46", "2026-10-19 12:00"},
+		{"10-20/5 8 * * *", "2026-10-19 08:11", "2026-10-19 08:15"},
+		{"0 0 1 * *", "2026-12-15 00:00", "2027-01-01 00:00"},
+		{"0 0 29 2 *", "2026-03-01 00:00", "2028-02-29 00:00"},
+		{"0 9 * * 1-5", "2026-10-17 10:00", "2026-10-19 09:00"}, // Sat -> Mon
+		{"0 9 * * 7", "2026-10-19 10:00", "2026-10-25 09:00"}, // 7 is Sunday
+		{"0 9 * * 0", "2026-10-19 10:00", "2026-10-25 09:00"},
+		{"0,30 6,18 * * *", "2026-10-19 06:30", "2026-10-19 18:00"},
+		// restricted day-of-month and day-of-week are OR'ed
+		{"0 12 13 * 5", "2026-10-19 00:00", "2026-10-23 12:00"},
+		{"0 12 20 * 5", "2026-10-19 00:00", "2026-10-20 12:00"},
+	}
+
+	for _, tt := range tests {
+		c, err := parse_cron(tt.expr)
+		if err != nil {
+			t.Errorf("parse_cron(%q): %v", tt.expr, err)
+			continue
+		}
+		got := c.next(utc(tt.after))
+		if !got.Equal(utc(tt.next)) {
+			t.Errorf("%q after %s: got %s, want %s", tt.expr, tt.after,
+			         got.Format("2006-01-02 15:04"), tt.next)
+		}
+	}
+}
+
+func TestCronNextNever(t *testing.T) {
+	c, err := parse_cron("0 0 31 2 *")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := c.next(utc("2026-10-19 00:00")); !got.IsZero() {
+		t.Errorf("got %v, zero time expected", got)
+	}
+}
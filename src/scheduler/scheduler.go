@@ -0,0 +1,465 @@
+package scheduler
+
+import (
+	"conf"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log/slog"
+	"mod_io"
+	"os"
+	"portmap"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Job late less than this is considered on time
+const ON_TIME_GRACE = time.Minute
+
+type schedule interface {
+	next(after time.Time) time.Time
+}
+
+type Job struct {
+	Name string
+	Schedule string
+	Port int
+	State int // logical state, inverted port gets physical 1 - State
+	Enabled bool
+	Catchup string // "skip" or "once"
+	Catchup_window time.Duration // 0 means any lateness
+	Runtime bool // added over control socket
+	Next time.Time
+	Last_run time.Time
+	Last_result string
+	sched schedule
+}
+
+type Scheduler struct {
+	sync.Mutex
+	mio *mod_io.Mod_io
+	ports *portmap.Map
+	latitude float64
+	longitude float64
+	state_file string
+	jobs map[string]*Job
+	wake chan bool
+	stopped bool
+	done chan bool // closed when Run returns
+}
+
+func New(mio *mod_io.Mod_io, ports *portmap.Map,
+         cfg *conf.Module_io_cfg) (*Scheduler, error) {
+	s := new(Scheduler)
+	s.mio = mio
+	s.ports = ports
+	s.latitude = cfg.Latitude
+	s.longitude = cfg.Longitude
+	s.state_file = cfg.Jobs_file
+	s.wake = make(chan bool, 1)
+	s.done = make(chan bool)
+
+	var err error
+	s.jobs, err = parse_jobs(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	err = s.load()
+	if err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Parse jobs defined in configuration
+func parse_jobs(cfg *conf.Module_io_cfg) (map[string]*Job, error) {
+	s := &Scheduler{latitude: cfg.Latitude,
+	                longitude: cfg.Longitude,
+	                jobs: make(map[string]*Job)}
+
+	for _, jcfg := range cfg.Job {
+		job := &Job{Name: jcfg.Name,
+		            Schedule: jcfg.Schedule,
+		            Port: jcfg.Port,
+		            State: jcfg.State,
+		            Enabled: !jcfg.Disabled,
+		            Catchup: jcfg.Catchup}
+		if jcfg.Catchup_window != "" {
+			var err error
+			job.Catchup_window, err = time.ParseDuration(jcfg.Catchup_window)
+			if err != nil {
+				return nil, fmt.Errorf("scheduler: job %s: incorrect catchup_window: %v",
+				                       jcfg.Name, err)
+			}
+		}
+		err := s.prepare(job)
+		if err != nil {
+			return nil, err
+		}
+		s.jobs[job.Name] = job
+	}
+	return s.jobs, nil
+}
+
+// Replace jobs defined in configuration. Enable flags and last results
+// of kept jobs and jobs added over control socket are preserved
+func (s *Scheduler) Reload(cfg *conf.Module_io_cfg) error {
+	jobs, err := parse_jobs(cfg)
+	if err != nil {
+		return err
+	}
+
+	s.Lock()
+	defer s.Unlock()
+
+	now := time.Now()
+	for name, job := range s.jobs {
+		if job.Runtime {
+			if _, ok := jobs[name]; !ok {
+				jobs[name] = job
+			}
+			continue
+		}
+		nj, ok := jobs[name]
+		if !ok {
+			continue
+		}
+		nj.Enabled = job.Enabled
+		nj.Last_run = job.Last_run
+		nj.Last_result = job.Last_result
+		if nj.Schedule == job.Schedule && cfg.Latitude == s.latitude &&
+		   cfg.Longitude == s.longitude {
+			nj.Next = job.Next
+		}
+	}
+	for _, job := range jobs {
+		if job.Next.IsZero() {
+			job.Next = job.sched.next(now)
+		}
+	}
+
+	s.latitude = cfg.Latitude
+	s.longitude = cfg.Longitude
+	s.jobs = jobs
+	s.save()
+	s.notify()
+	return nil
+}
+
+// Validate job and parse its schedule
+func (s *Scheduler) prepare(job *Job) error {
+	var err error
+	if job.Name == "" {
+		return fmt.Errorf("scheduler: job without name")
+	}
+	if _, ok := s.jobs[job.Name]; ok {
+		return fmt.Errorf("scheduler: job %s already exists", job.Name)
+	}
+
+	switch job.Catchup {
+	case "":
+		job.Catchup = "skip"
+	case "skip", "once":
+	default:
+		return fmt.Errorf("scheduler: job %s: unknown catchup '%s'",
+		                  job.Name, job.Catchup)
+	}
+
+	job.sched, err = s.parse_schedule(job.Schedule)
+	if err != nil {
+		return fmt.Errorf("scheduler: job %s: %v", job.Name, err)
+	}
+	return nil
+}
+
+// Parse "@sunrise [+-offset]", "@sunset [+-offset]" or cron expression
+func (s *Scheduler) parse_schedule(spec string) (schedule, error) {
+	fields := strings.Fields(spec)
+	if len(fields) == 0 {
+		return nil, fmt.Errorf("empty schedule")
+	}
+
+	if fields[0] != "@sunrise" && fields[0] != "@sunset" {
+		return parse_cron(spec)
+	}
+
+	if s.latitude == 0 && s.longitude == 0 {
+		return nil, fmt.Errorf("latitude and longitude are not configured")
+	}
+
+	sun := &sun_schedule{sunrise: fields[0] == "@sunrise",
+	                     latitude: s.latitude,
+	                     longitude: s.longitude}
+	if len(fields) > 2 {
+		return nil, fmt.Errorf("incorrect schedule '%s'", spec)
+	}
+	if len(fields) == 2 {
+		var err error
+		sun.offset, err = time.ParseDuration(strings.TrimPrefix(fields[1], "+"))
+		if err != nil {
+			return nil, fmt.Errorf("incorrect offset in '%s': %v", spec, err)
+		}
+	}
+	return sun, nil
+}
+
+// Load runtime jobs, enable flags and last results saved before restart
+func (s *Scheduler) load() error {
+	if s.state_file == "" {
+		return nil
+	}
+
+	data, err := ioutil.ReadFile(s.state_file)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("scheduler: can't read %s: %v", s.state_file, err)
+	}
+
+	var saved []*Job
+	err = json.Unmarshal(data, &saved)
+	if err != nil {
+		return fmt.Errorf("scheduler: can't parse %s: %v", s.state_file, err)
+	}
+
+	for _, sj := range saved {
+		job, ok := s.jobs[sj.Name]
+		if !ok {
+			if !sj.Runtime {
+				continue // removed from configuration
+			}
+			err = s.prepare(sj)
+			if err != nil {
+				slog.Warn("drop saved job", "module", "scheduler",
+				          "job", sj.Name, "err", err)
+				continue
+			}
+			s.jobs[sj.Name] = sj
+			continue
+		}
+		job.Enabled = sj.Enabled
+		job.Last_run = sj.Last_run
+		job.Last_result = sj.Last_result
+	}
+	return nil
+}
+
+// Save jobs state. Must be called with lock held
+func (s *Scheduler) save() {
+	if s.state_file == "" {
+		return
+	}
+
+	var list []*Job
+	for _, job := range s.jobs {
+		list = append(list, job)
+	}
+
+	data, err := json.Marshal(list)
+	if err != nil {
+		slog.Error("can't encode jobs", "module", "scheduler", "err", err)
+		return
+	}
+
+	tmp := s.state_file + ".tmp"
+	err = ioutil.WriteFile(tmp, data, 0644)
+	if err == nil {
+		err = os.Rename(tmp, s.state_file)
+	}
+	if err != nil {
+		slog.Error("can't save jobs", "module", "scheduler",
+		           "file", s.state_file, "err", err)
+	}
+}
+
+func (s *Scheduler) notify() {
+	select {
+	case s.wake <- true:
+	default:
+	}
+}
+
+// Stop main loop started by Run and wait for running job
+func (s *Scheduler) Stop() {
+	s.Lock()
+	s.stopped = true
+	s.Unlock()
+	s.notify()
+	<- s.done
+}
+
+// Scheduler main loop
+func (s *Scheduler) Run() {
+	s.Lock()
+	now := time.Now()
+	for _, job := range s.jobs {
+		// runs missed while daemon was stopped are handled by catch-up rules
+		if job.Last_run.IsZero() {
+			job.Next = job.sched.next(now)
+		} else {
+			job.Next = job.sched.next(job.Last_run)
+		}
+	}
+	s.Unlock()
+
+	defer close(s.done)
+	for {
+		s.Lock()
+		if s.stopped {
+			s.Unlock()
+			return
+		}
+		now = time.Now()
+		var due []*Job
+		var nearest time.Time
+		for _, job := range s.jobs {
+			if job.Next.IsZero() {
+				continue
+			}
+			if !job.Next.After(now) {
+				due = append(due, job)
+				continue
+			}
+			if nearest.IsZero() || job.Next.Before(nearest) {
+				nearest = job.Next
+			}
+		}
+		s.Unlock()
+
+		for _, job := range due {
+			s.run_due(job, now)
+		}
+		if len(due) > 0 {
+			continue
+		}
+
+		var timeout <-chan time.Time
+		if !nearest.IsZero() {
+			timeout = time.After(time.Until(nearest))
+		}
+		select {
+		case <- timeout:
+		case <- s.wake:
+		}
+	}
+}
+
+func (s *Scheduler) run_due(job *Job, now time.Time) {
+	s.Lock()
+	if s.stopped {
+		s.Unlock()
+		return
+	}
+	late := now.Sub(job.Next)
+	job.Next = job.sched.next(now)
+	run := job.Enabled
+	if run && late > ON_TIME_GRACE {
+		run = job.Catchup == "once" &&
+		      (job.Catchup_window == 0 || late <= job.Catchup_window)
+		if !run {
+			slog.Warn("job run missed", "module", "scheduler",
+			          "job", job.Name, "late", late.Truncate(time.Second))
+			job.Last_result = fmt.Sprintf("missed by %v", late.Truncate(time.Second))
+			job.Last_run = now
+			s.save()
+		}
+	}
+	port, state := job.Port, job.State
+	s.Unlock()
+
+	if !run {
+		return
+	}
+
+	result := "ok"
+	request_id := s.mio.New_request_id()
+	err := s.mio.Relay_set_state(request_id, port,
+	                             s.ports.Physical(portmap.OUTPUT, port, state))
+	if err != nil {
+		result = fmt.Sprintf("%v", err)
+		slog.Error("job failed", "module", "scheduler", "job", job.Name,
+		           "port", port, "state", state, "request_id", request_id, "err", err)
+	} else {
+		slog.Info("job done", "module", "scheduler", "job", job.Name,
+		          "port", port, "state", state, "request_id", request_id)
+	}
+
+	s.Lock()
+	job.Last_run = now
+	job.Last_result = result
+	s.save()
+	s.Unlock()
+}
+
+// Return copy of all jobs sorted by name
+func (s *Scheduler) List() []Job {
+	s.Lock()
+	defer s.Unlock()
+
+	var list []Job
+	for _, job := range s.jobs {
+		list = append(list, *job)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Name < list[j].Name
+	})
+	return list
+}
+
+func (s *Scheduler) Set_enabled(name string, enabled bool) error {
+	s.Lock()
+	defer s.Unlock()
+
+	job, ok := s.jobs[name]
+	if !ok {
+		return fmt.Errorf("scheduler: no job %s", name)
+	}
+	job.Enabled = enabled
+	s.save()
+	return nil
+}
+
+// Add job over control socket
+func (s *Scheduler) Add(name string, port int, state int, spec string) error {
+	s.Lock()
+	defer s.Unlock()
+
+	job := &Job{Name: name,
+	            Schedule: spec,
+	            Port: port,
+	            State: state,
+	            Enabled: true,
+	            Runtime: true}
+	err := s.prepare(job)
+	if err != nil {
+		return err
+	}
+	job.Next = job.sched.next(time.Now())
+	s.jobs[name] = job
+	s.save()
+	s.notify()
+	return nil
+}
+
+// Remove job added over control socket
+func (s *Scheduler) Remove(name string) error {
+	s.Lock()
+	defer s.Unlock()
+
+	job, ok := s.jobs[name]
+	if !ok {
+		return fmt.Errorf("scheduler: no job %s", name)
+	}
+	if !job.Runtime {
+		return fmt.Errorf("scheduler: job %s is defined in configuration, " +
+		                  "disable it instead", name)
+	}
+	delete(s.jobs, name)
+	s.save()
+	s.notify()
+	return nil
+}
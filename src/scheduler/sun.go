@@ -0,0 +1,101 @@
+package scheduler
+
+import (
+	"math"
+	"time"
+)
+
+// Official zenith for sunrise and sunset, degrees
+const SUN_ZENITH = 90.833
+
+// Sunrise or sunset schedule with offset
+type sun_schedule struct {
+	sunrise bool
+	offset time.Duration
+	latitude float64
+	longitude float64
+}
+
+func deg_sin(d float64) float64 {
+	return math.Sin(d * math.Pi / 180)
+}
+
+func deg_cos(d float64) float64 {
+	return math.Cos(d * math.Pi / 180)
+}
+
+func normalize(v float64, max float64) float64 {
+	v = math.Mod(v, max)
+	if v < 0 {
+		v += max
+	}
+	return v
+}
+
+// Calculate sunrise or sunset time for the date of day.
+// Returns false if the sun doesn't rise or set at this day.
+// Algorithm from "Almanac for Computers", 1990
+func sun_event(day time.Time, lat float64, lon float64, sunrise bool) (time.Time, bool) {
+	lng_hour := lon / 15
+	base := 18.0
+	if sunrise {
+		base = 6.0
+	}
+	t := float64(day.YearDay()) + (base - lng_hour) / 24
+
+	m := 0.9856 * t - 3.289
+	l := normalize(m + 1.916 * deg_sin(m) + 0.020 * deg_sin(2 * m) + 282.634, 360)
+
+	ra := normalize(math.Atan(0.91764 * math.Tan(l * math.Pi / 180)) * 180 / math.Pi, 360)
+	ra += math.Floor(l / 90) * 90 - math.Floor(ra / 90) * 90
+	ra /= 15
+
+	sin_dec := 0.39782 * deg_sin(l)
+	cos_dec := math.Cos(math.Asin(sin_dec))
+
+	cos_h := (deg_cos(SUN_ZENITH) - sin_dec * deg_sin(lat)) / (cos_dec * deg_cos(lat))
+	if cos_h > 1 || cos_h < -1 {
+		return time.Time{}, false
+	}
+
+	h := math.Acos(cos_h) * 180 / math.Pi
+	if sunrise {
+		h = 360 - h
+	}
+	h /= 15
+
+	local_t := h + ra - 0.06571 * t - 6.622
+	ut := normalize(local_t - lng_hour, 24)
+
+	y, mon, d := day.Date()
+	res := time.Date(y, mon, d, 0, 0, 0, 0, time.UTC).
+	       Add(time.Duration(ut * float64(time.Hour))).In(day.Location())
+
+	// UT may belong to the previous or the next UTC day
+	_, _, res_d := res.Date()
+	if res_d != d {
+		if res.Before(day) {
+			res = res.Add(24 * time.Hour)
+		} else {
+			res = res.Add(-24 * time.Hour)
+		}
+	}
+	return res.Truncate(time.Second), true
+}
+
+func (s *sun_schedule) next(after time.Time) time.Time {
+	y, m, d := after.Date()
+	for i := 0; i < 367; i++ {
+		day := time.Date(y, m, d + i, 12, 0, 0, 0, after.Location())
+		t, ok := sun_event(day, s.latitude, s.longitude, s.sunrise)
+		if !ok {
+			continue
+		}
+
+		t = t.Add(s.offset)
+		if t.After(after) {
+			return t
+		}
+	}
+	return time.Time{}
+}
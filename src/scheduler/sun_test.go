@@ -0,0 +1,125 @@
+package scheduler
+
+import (
+	"testing"
+	"time"
+)
+
+func location(t *testing.T, name string) *time.Location {
+	loc, err := time.LoadLocation(name)
+	if err != nil {
+		t.Skipf("no time zone data: %v", err)
+	}
+	return loc
+}
+
+func TestSunEvent(t *testing.T) {
+	msk := location(t, "Europe/Moscow")
+	ny := location(t, "America/New_York")
+
+	// published almanac times, algorithm error is about a minute
+	tests := []struct {
+		name string
+		lat float64
+		lon float64
+		day time.Time
+		sunrise string
+		sunset string
+	}{
+		{"Moscow", 55.7558, 37.6173, time.Date(2026, 6, 21, 12, 0, 0, 0, msk),
+		 "03:44", "21:18"},
+		{"New York", 40.7128, -74.006, time.Date(2026, 12, 21, 12, 0, 0, 0, ny),
+		 "07:16", "16:32"},
+		{"Null Island", 0, 0, time.Date(2026, 3, 20, 12, 0, 0, 0, time.UTC),
+		 "06:04", "18:11"},
+	}
+
+	for _, tt := range tests {
+		for _, ev := range []struct {
+			sunrise bool
+			want string
+		}{{true, tt.sunrise}, {false, tt.sunset}} {
+			got, ok := sun_event(tt.day, tt.lat, tt.lon, ev.sunrise)
+			if !ok {
+				t.Errorf("%s: no sun event", tt.name)
+				continue
+			}
+			want, _ := time.ParseInLocation("2006-01-02 15:04",
+			                                tt.day.Format("2006-01-02 ") + ev.want,
+			                                tt.day.Location())
+			if d := got.Sub(want); d < -2 * time.Minute || d > 2 * time.Minute {
+				t.Errorf("%s sunrise=%v: got %s, want %s", tt.name, ev.sunrise,
+				         got.Format("2006-01-02 15:04"), want.Format("2006-01-02 15:04"))
+			}
+		}
+	}
+}
+
+func TestSunEventPolar(t *testing.T) {
+	// Tromsø: polar night in December, midnight sun in June
+	for _, day := range []string{"2026-12-21 12:00", "2026-06-21 12:00"} {
+		for _, sunrise := range []bool{true, false} {
+			if _, ok := sun_event(utc(day), 69.65, 18.96, sunrise); ok {
+				t.Errorf("%s sunrise=%v: no sun event expected", day, sunrise)
+			}
+		}
+	}
+}
+
+func TestSunNext(t *testing.T) {
+	tests := []struct {
+		sched sun_schedule
+		after string
+		from string
+		to string
+	}{
+		// today's sunset is still ahead, offset is applied
+		{sun_schedule{sunrise: false, offset: -30 * time.Minute, latitude: 0},
+		 "2026-03-20 12:00", "2026-03-20 17:39", "2026-03-20 17:42"},
+		// today's sunrise is passed
+		{sun_schedule{sunrise: true, latitude: 0},
+		 "2026-03-20 12:00", "2026-03-21 06:02", "2026-03-21 06:06"},
+		// days without sunrise are skipped until polar night ends
+		{sun_schedule{sunrise: true, latitude: 69.65, longitude: 18.96},
+		 "2026-12-01 00:00", "2027-01-14 00:00", "2027-01-18 00:00"},
+		{sun_schedule{sunrise: false, latitude: 69.65, longitude: 18.96},
+		 "2026-06-01 00:00", "2026-07-20 00:00", "2026-07-27 00:00"},
+	}
+
+	for _, tt := range tests {
+		got := tt.sched.next(utc(tt.after))
+		if got.Before(utc(tt.from)) || got.After(utc(tt.to)) {
+			t.Errorf("%+v after %s: got %s, want %s - %s", tt.sched, tt.after,
+			         got.Format("2006-01-02 15:04"), tt.from, tt.to)
+		}
+	}
+}
+
+func TestParseSunSchedule(t *testing.T) {
+	s := &Scheduler{latitude: 55.75, longitude: 37.62}
+	sched, err := s.parse_schedule("@sunset -30m")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sun, ok := sched.(*sun_schedule)
+	if !ok || sun.sunrise || sun.offset != -30 * time.Minute {
+		t.Errorf("got %+v", sched)
+	}
+
+	sched, err = s.parse_schedule("@sunrise +1h")
+	sun, ok = sched.(*sun_schedule)
+	if err != nil || !ok || !sun.sunrise || sun.offset != time.Hour {
+		t.Errorf("got %+v, %v", sched, err)
+	}
+
+	for _, spec := range []string{"", "@sunrise 1h 2h", "@sunset soon"} {
+		if _, err := s.parse_schedule(spec); err == nil {
+			t.Errorf("parse_schedule(%q): error expected", spec)
+		}
+	}
+
+	s = &Scheduler{}
+	if _, err := s.parse_schedule("@sunrise"); err == nil {
+		t.Errorf("error expected without coordinates")
+	}
+}
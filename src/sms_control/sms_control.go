@@ -0,0 +1,223 @@
+package sms_control
+
+import (
+	"conf"
+	"fmt"
+	"gsm"
+	"modem"
+	"log/slog"
+	"metrics"
+	"mod_io"
+	"os"
+	"portmap"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"timers"
+)
+
+var (
+	stat_commands = metrics.New_counter("module_io_sms_commands_total",
+	                                    "SMS commands executed")
+	stat_denied = metrics.New_counter("module_io_sms_commands_denied_total",
+	                                  "SMS commands from unknown numbers or with wrong PIN")
+)
+
+// Relay control by SMS commands:
+//   RELAY <port> <0|1|on|off>
+//   PULSE <port> <duration>
+//   STATUS
+type Sms_control struct {
+	sync.Mutex
+	mio *mod_io.Mod_io
+	timers *timers.Timers
+	ports *portmap.Map
+	gsm *gsm.Gsm
+	allow map[string]bool
+	pin string
+	audit_file string
+	running sync.WaitGroup // commands being executed
+	stopped bool
+}
+
+func New(mio *mod_io.Mod_io, tm *timers.Timers, ports *portmap.Map,
+         g *gsm.Gsm, scfg *conf.Sms_control_cfg) *Sms_control {
+	sc := new(Sms_control)
+	sc.mio = mio
+	sc.timers = tm
+	sc.ports = ports
+	sc.gsm = g
+	sc.pin = scfg.Pin
+	sc.audit_file = scfg.Audit_file
+	sc.allow = make(map[string]bool)
+	for _, phone := range scfg.Allow {
+		sc.allow[normalize_phone(phone)] = true
+	}
+	return sc
+}
+
+// Keep leading plus and digits only
+func normalize_phone(phone string) string {
+	var b strings.Builder
+	for i, c := range strings.TrimSpace(phone) {
+		if (c >= '0' && c <= '9') || (c == '+' && i == 0) {
+			b.WriteRune(c)
+		}
+	}
+	return b.String()
+}
+
+// Write audit record to log and audit file
+func (sc *Sms_control) audit(phone string, text string, result string) {
+	slog.Info("sms command", "module", "sms_control", "audit", true,
+	          "phone", phone, "command", text, "result", result)
+	if sc.audit_file == "" {
+		return
+	}
+
+	sc.Lock()
+	defer sc.Unlock()
+	f, err := os.OpenFile(sc.audit_file, os.O_APPEND | os.O_CREATE | os.O_WRONLY, 0640)
+	if err != nil {
+		slog.Error("can't open audit file", "module", "sms_control",
+		           "file", sc.audit_file, "err", err)
+		return
+	}
+	defer f.Close()
+	fmt.Fprintf(f, "%s phone=%s command=%q result=%q\n",
+	            time.Now().Format(time.RFC3339), phone, text, result)
+}
+
+// Handle incoming SMS, every message is removed after handling
+func (sc *Sms_control) Handle(msg *modem.Sms_message) bool {
+	sc.Lock()
+	if sc.stopped {
+		sc.Unlock()
+		return false // left in modem for next start
+	}
+	sc.running.Add(1)
+	sc.Unlock()
+	defer sc.running.Done()
+
+	phone := normalize_phone(msg.Phone)
+	text := strings.TrimSpace(msg.Content)
+
+	if !sc.allow[phone] {
+		stat_denied.Inc()
+		// no reply to unknown numbers
+		sc.audit(phone, "-", "denied: number is not allowed")
+		return true
+	}
+
+	args := strings.Fields(text)
+	if sc.pin != "" {
+		if len(args) == 0 || args[0] != sc.pin {
+			stat_denied.Inc()
+			sc.audit(phone, "-", "denied: wrong PIN")
+			sc.reply(phone, "wrong PIN")
+			return true
+		}
+		args = args[1:]
+	}
+
+	// PIN is never written to logs
+	command := strings.Join(args, " ")
+	reply := sc.execute(args)
+	stat_commands.Inc()
+	sc.audit(phone, command, reply)
+	sc.reply(phone, reply)
+	return true
+}
+
+// Stop executing commands and wait for running one
+func (sc *Sms_control) Stop() {
+	sc.Lock()
+	sc.stopped = true
+	sc.Unlock()
+	sc.running.Wait()
+}
+
+func (sc *Sms_control) reply(phone string, text string) {
+	err := sc.gsm.Send_sms([]string{phone}, text)
+	if err != nil {
+		slog.Error("can't reply", "module", "sms_control", "phone", phone, "err", err)
+	}
+}
+
+func parse_state(arg string) (int, error) {
+	switch strings.ToLower(arg) {
+	case "1", "on":
+		return 1, nil
+	case "0", "off":
+		return 0, nil
+	}
+	return 0, fmt.Errorf("incorrect state '%s'", arg)
+}
+
+func (sc *Sms_control) execute(args []string) string {
+	if len(args) == 0 {
+		return "empty command"
+	}
+
+	request_id := sc.mio.New_request_id()
+	switch strings.ToUpper(args[0]) {
+	case "RELAY":
+		if len(args) != 3 {
+			return "usage: RELAY <port> <0|1>"
+		}
+		port, err := sc.ports.Resolve(portmap.OUTPUT, args[1])
+		if err != nil {
+			return err.Error()
+		}
+		state, err := parse_state(args[2])
+		if err != nil {
+			return err.Error()
+		}
+		err = sc.mio.Relay_set_state(request_id, port,
+		                             sc.ports.Physical(portmap.OUTPUT, port, state))
+		if err != nil {
+			return fmt.Sprintf("%s: %v", args[1], err)
+		}
+		return fmt.Sprintf("%s=%d ok", sc.ports.Label(portmap.OUTPUT, port), state)
+
+	case "PULSE":
+		if len(args) != 3 {
+			return "usage: PULSE <port> <duration>"
+		}
+		port, err := sc.ports.Resolve(portmap.OUTPUT, args[1])
+		if err != nil {
+			return err.Error()
+		}
+		duration, err := time.ParseDuration(args[2])
+		if err != nil || duration <= 0 {
+			return fmt.Sprintf("incorrect duration '%s'", args[2])
+		}
+		_, err = sc.timers.Pulse(request_id, port,
+		                         sc.ports.Physical(portmap.OUTPUT, port, 1), duration)
+		if err != nil {
+			return fmt.Sprintf("%s: %v", args[1], err)
+		}
+		return fmt.Sprintf("%s pulse %v ok", sc.ports.Label(portmap.OUTPUT, port), duration)
+
+	case "STATUS":
+		inputs, outputs, err := sc.mio.All_states(request_id)
+		if err != nil {
+			return fmt.Sprintf("status error: %v", err)
+		}
+		var in, out []string
+		for _, st := range inputs {
+			in = append(in, sc.port_state(portmap.INPUT, &st))
+		}
+		for _, st := range outputs {
+			out = append(out, sc.port_state(portmap.OUTPUT, &st))
+		}
+		return "in: " + strings.Join(in, " ") + "\nout: " + strings.Join(out, " ")
+	}
+	return fmt.Sprintf("unknown command '%s'", args[0])
+}
+
+func (sc *Sms_control) port_state(direction string, st *mod_io.Port_state) string {
+	return sc.ports.Label(direction, st.Port) + "=" +
+	       strconv.Itoa(sc.ports.Logical(direction, st.Port, st.State))
+}
@@ -0,0 +1,103 @@
+package systemd
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// First descriptor passed by socket activation
+const LISTEN_FDS_START = 3
+
+// Return sockets passed by systemd socket activation indexed
+// by LISTEN_FDNAMES. Environment is cleared so child processes
+// don't inherit it.
+func Listen_fds() (map[string]*os.File, error) {
+	files := make(map[string]*os.File)
+
+	pid_str := os.Getenv("LISTEN_PID")
+	fds_str := os.Getenv("LISTEN_FDS")
+	names_str := os.Getenv("LISTEN_FDNAMES")
+	if pid_str == "" || fds_str == "" {
+		return files, nil
+	}
+
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_FDNAMES")
+
+	pid, err := strconv.Atoi(pid_str)
+	if err != nil {
+		return nil, fmt.Errorf("systemd: incorrect LISTEN_PID: %s", pid_str)
+	}
+	if pid != os.Getpid() {
+		return files, nil
+	}
+
+	count, err := strconv.Atoi(fds_str)
+	if err != nil || count < 0 {
+		return nil, fmt.Errorf("systemd: incorrect LISTEN_FDS: %s", fds_str)
+	}
+
+	names := strings.Split(names_str, ":")
+	for i := 0; i < count; i++ {
+		name := "unknown"
+		if i < len(names) && names[i] != "" {
+			name = names[i]
+		}
+		if _, ok := files[name]; ok {
+			name = fmt.Sprintf("%s.%d", name, i)
+		}
+		fd := LISTEN_FDS_START + i
+		syscall.CloseOnExec(fd)
+		files[name] = os.NewFile(uintptr(fd), name)
+	}
+	return files, nil
+}
+
+// Send state to service manager, for example "READY=1".
+// Does nothing if daemon is not started by systemd
+func Notify(state string) error {
+	path := os.Getenv("NOTIFY_SOCKET")
+	if path == "" {
+		return nil
+	}
+	if path[0] == '@' {
+		path = "\x00" + path[1:]
+	}
+
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: path, Net: "unixgram"})
+	if err != nil {
+		return fmt.Errorf("systemd: can't connect to notify socket: %v", err)
+	}
+	defer conn.Close()
+
+	_, err = conn.Write([]byte(state))
+	if err != nil {
+		return fmt.Errorf("systemd: can't notify: %v", err)
+	}
+	return nil
+}
+
+// Return service watchdog period, false if watchdog is not enabled
+func Watchdog_interval() (time.Duration, bool) {
+	usec_str := os.Getenv("WATCHDOG_USEC")
+	if usec_str == "" {
+		return 0, false
+	}
+
+	pid_str := os.Getenv("WATCHDOG_PID")
+	if pid_str != "" && pid_str != strconv.Itoa(os.Getpid()) {
+		return 0, false
+	}
+
+	usec, err := strconv.ParseInt(usec_str, 10, 64)
+	if err != nil || usec <= 0 {
+		return 0, false
+	}
+	return time.Duration(usec) * time.Microsecond, true
+}
@@ -0,0 +1,265 @@
+package timers
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log/slog"
+	"mod_io"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Pending relay action
+type Timer struct {
+	Id int
+	Port int
+	State int // state applied when timer expires
+	Due time.Time
+	Pulse bool // timer finishes a relay pulse
+	t *time.Timer
+	gen int // changed on every arm and disarm
+}
+
+type Timers struct {
+	sync.Mutex
+	mio *mod_io.Mod_io
+	state_file string
+	last_id int
+	list map[int]*Timer
+	running sync.WaitGroup // timers being fired
+	stopped bool
+}
+
+func New(mio *mod_io.Mod_io, state_file string) *Timers {
+	ts := new(Timers)
+	ts.mio = mio
+	ts.state_file = state_file
+	ts.list = make(map[int]*Timer)
+	return ts
+}
+
+// Load timers saved before restart. With "restore" policy timers are
+// re-armed and overdue ones are fired at once. With "clear" policy
+// pending pulses are finished immediately and delayed actions dropped
+func (ts *Timers) Restore(policy string) error {
+	if ts.state_file == "" {
+		return nil
+	}
+
+	data, err := ioutil.ReadFile(ts.state_file)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("timers: can't read %s: %v", ts.state_file, err)
+	}
+
+	var saved []*Timer
+	err = json.Unmarshal(data, &saved)
+	if err != nil {
+		return fmt.Errorf("timers: can't parse %s: %v", ts.state_file, err)
+	}
+
+	ts.Lock()
+	defer ts.Unlock()
+	for _, tm := range saved {
+		if tm.Id > ts.last_id {
+			ts.last_id = tm.Id
+		}
+
+		switch policy {
+		case "restore":
+			ts.arm(tm)
+
+		case "clear":
+			if tm.Pulse {
+				go ts.fire(tm)
+			}
+
+		default:
+			return fmt.Errorf("timers: unknown restore policy '%s'", policy)
+		}
+	}
+	ts.save()
+	return nil
+}
+
+// Set relay to active state and switch it back after duration.
+// A pending pulse on the same port is replaced only if relay is
+// switched successfully, otherwise it still releases the relay
+func (ts *Timers) Pulse(request_id int, port int, active int,
+                        duration time.Duration) (int, error) {
+	ts.Lock()
+	var replaced []*Timer
+	for _, tm := range ts.list {
+		if tm.Pulse && tm.Port == port {
+			tm.disarm()
+			replaced = append(replaced, tm)
+		}
+	}
+	ts.Unlock()
+
+	err := ts.mio.Relay_set_state(request_id, port, active)
+
+	ts.Lock()
+	defer ts.Unlock()
+	for _, tm := range replaced {
+		if ts.list[tm.Id] != tm {
+			continue // fired or cancelled meanwhile
+		}
+		if err != nil {
+			ts.arm(tm)
+		} else {
+			delete(ts.list, tm.Id)
+		}
+	}
+	if err != nil {
+		return 0, err
+	}
+	return ts.insert(port, 1 - active, duration, true), nil
+}
+
+// Set relay state after delay
+func (ts *Timers) Set_after(port int, state int, delay time.Duration) int {
+	ts.Lock()
+	defer ts.Unlock()
+	return ts.insert(port, state, delay, false)
+}
+
+// Arm new timer and save list. Must be called with lock held
+func (ts *Timers) insert(port int, state int, delay time.Duration, pulse bool) int {
+	ts.last_id++
+	tm := &Timer{Id: ts.last_id,
+	             Port: port,
+	             State: state,
+	             Due: time.Now().Add(delay),
+	             Pulse: pulse}
+	ts.arm(tm)
+	ts.save()
+	return tm.Id
+}
+
+// Must be called with lock held
+func (ts *Timers) arm(tm *Timer) {
+	ts.list[tm.Id] = tm
+	tm.gen++
+	gen := tm.gen
+	tm.t = time.AfterFunc(time.Until(tm.Due), func() {
+		ts.Lock()
+		if ts.stopped {
+			ts.Unlock()
+			return // kept in state file for restart
+		}
+		if tm.gen != gen {
+			ts.Unlock()
+			return // disarmed or re-armed after callback was started
+		}
+		ok := ts.list[tm.Id] == tm
+		delete(ts.list, tm.Id)
+		ts.save()
+		if ok {
+			ts.running.Add(1)
+		}
+		ts.Unlock()
+		if ok {
+			defer ts.running.Done()
+			ts.fire(tm)
+		}
+	})
+}
+
+// Stop timer so that callback which is already started does nothing.
+// Must be called with lock held
+func (tm *Timer) disarm() {
+	tm.t.Stop()
+	tm.gen++
+}
+
+// Stop firing timers and wait for ones being fired. Pending timers
+// stay in state file and are handled by restore policy after restart
+func (ts *Timers) Stop() {
+	ts.Lock()
+	ts.stopped = true
+	for _, tm := range ts.list {
+		tm.disarm()
+	}
+	ts.Unlock()
+	ts.running.Wait()
+}
+
+func (ts *Timers) fire(tm *Timer) {
+	err := ts.mio.Relay_set_state(ts.mio.New_request_id(), tm.Port, tm.State)
+	if err != nil {
+		slog.Error("can't set relay state", "module", "timers", "timer", tm.Id,
+		           "port", tm.Port, "state", tm.State, "err", err)
+		return
+	}
+	slog.Info("timer fired", "module", "timers", "timer", tm.Id,
+	          "port", tm.Port, "state", tm.State)
+}
+
+// Cancel pending timer. A cancelled pulse is finished at once
+// so the relay is not left switched on
+func (ts *Timers) Cancel(id int) error {
+	ts.Lock()
+	tm, ok := ts.list[id]
+	if !ok {
+		ts.Unlock()
+		return fmt.Errorf("timers: no timer %d", id)
+	}
+	tm.disarm()
+	delete(ts.list, id)
+	ts.save()
+	ts.Unlock()
+
+	if tm.Pulse {
+		ts.fire(tm)
+	}
+	return nil
+}
+
+// Return pending timers sorted by due time
+func (ts *Timers) List() []Timer {
+	ts.Lock()
+	defer ts.Unlock()
+
+	var list []Timer
+	for _, tm := range ts.list {
+		list = append(list, *tm)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Due.Before(list[j].Due)
+	})
+	return list
+}
+
+// Write pending timers to state file. Must be called with lock held
+func (ts *Timers) save() {
+	if ts.state_file == "" {
+		return
+	}
+
+	var list []*Timer
+	for _, tm := range ts.list {
+		list = append(list, tm)
+	}
+
+	data, err := json.Marshal(list)
+	if err != nil {
+		slog.Error("can't encode timers", "module", "timers", "err", err)
+		return
+	}
+
+	tmp := ts.state_file + ".tmp"
+	err = ioutil.WriteFile(tmp, data, 0644)
+	if err == nil {
+		err = os.Rename(tmp, ts.state_file)
+	}
+	if err != nil {
+		slog.Error("can't save timers", "module", "timers",
+		           "file", ts.state_file, "err", err)
+	}
+}
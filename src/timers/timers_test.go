@@ -0,0 +1,250 @@
+package timers
+
+import (
+	"encoding/json"
+	"fake_board"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+const WAIT = 2 * time.Second
+
+func start(t *testing.T, state_file string) (*fake_board.Board, *Timers) {
+	b, mio := fake_board.Start_mod_io(t, nil, nil)
+	ts := New(mio, state_file)
+	t.Cleanup(ts.Stop)
+	return b, ts
+}
+
+func TestPulse(t *testing.T) {
+	b, ts := start(t, "")
+	id, err := ts.Pulse(1, 3, 1, 100 * time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b.Relay(3) != 1 {
+		t.Fatalf("relay is not switched on")
+	}
+	list := ts.List()
+	if len(list) != 1 || list[0].Id != id || list[0].State != 0 || !list[0].Pulse {
+		t.Errorf("unexpected timers %+v", list)
+	}
+	if !b.Wait_relay(3, 0, WAIT) {
+		t.Fatalf("pulse is not finished")
+	}
+	time.Sleep(20 * time.Millisecond)
+	if len(ts.List()) != 0 {
+		t.Errorf("fired timer is still listed")
+	}
+}
+
+func TestPulseInverted(t *testing.T) {
+	b, ts := start(t, "")
+	b.Set_relay(2, 1)
+	_, err := ts.Pulse(1, 2, 0, 50 * time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b.Relay(2) != 0 {
+		t.Fatalf("relay is not switched to active 0")
+	}
+	if !b.Wait_relay(2, 1, WAIT) {
+		t.Errorf("inverted pulse is not released to 1")
+	}
+}
+
+func TestPulseExtended(t *testing.T) {
+	b, ts := start(t, "")
+	_, err := ts.Pulse(1, 3, 1, 100 * time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(50 * time.Millisecond)
+	_, err = ts.Pulse(1, 3, 1, 300 * time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ts.List()) != 1 {
+		t.Errorf("replaced pulse is still pending: %+v", ts.List())
+	}
+
+	time.Sleep(150 * time.Millisecond)
+	if b.Relay(3) != 1 {
+		t.Fatalf("replaced pulse released relay")
+	}
+	if !b.Wait_relay(3, 0, WAIT) {
+		t.Errorf("new pulse is not finished")
+	}
+}
+
+func TestPulseFailed(t *testing.T) {
+	b, ts := start(t, "")
+	id, err := ts.Pulse(1, 3, 1, 2 * time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b.Break_relay(3)
+	_, err = ts.Pulse(1, 3, 1, time.Hour)
+	if err == nil {
+		t.Fatalf("error expected for not answering relay")
+	}
+	list := ts.List()
+	if len(list) != 1 || list[0].Id != id {
+		t.Errorf("pending pulse is lost: %+v", list)
+	}
+}
+
+// Callback which is already waiting for lock when timer is
+// disarmed and armed again must not fire
+func TestStartedCallbackIgnored(t *testing.T) {
+	b, ts := start(t, "")
+	b.Set_relay(3, 1)
+
+	ts.Lock()
+	tm := &Timer{Id: 1, Port: 3, State: 0, Due: time.Now(), Pulse: true}
+	ts.arm(tm)
+	time.Sleep(50 * time.Millisecond) // callback is blocked on lock
+	tm.disarm()
+	tm.Due = time.Now().Add(time.Hour)
+	ts.arm(tm)
+	ts.Unlock()
+
+	time.Sleep(100 * time.Millisecond)
+	if b.Relay(3) != 1 {
+		t.Errorf("stale callback released relay")
+	}
+	if len(ts.List()) != 1 {
+		t.Errorf("re-armed timer is removed")
+	}
+}
+
+func TestSetAfterAndCancel(t *testing.T) {
+	b, ts := start(t, "")
+	ts.Set_after(4, 1, 50 * time.Millisecond)
+	id := ts.Set_after(5, 1, 50 * time.Millisecond)
+	err := ts.Cancel(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !b.Wait_relay(4, 1, WAIT) {
+		t.Fatalf("delayed action is not fired")
+	}
+	time.Sleep(100 * time.Millisecond)
+	if b.Relay(5) != 0 {
+		t.Errorf("cancelled action is fired")
+	}
+	if ts.Cancel(id) == nil {
+		t.Errorf("second cancel must fail")
+	}
+}
+
+func TestCancelPulse(t *testing.T) {
+	b, ts := start(t, "")
+	id, err := ts.Pulse(1, 3, 1, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ts.Cancel(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b.Relay(3) != 0 {
+		t.Errorf("cancelled pulse is not finished")
+	}
+}
+
+func write_state(t *testing.T, list []*Timer) string {
+	path := filepath.Join(t.TempDir(), "timers.json")
+	data, err := json.Marshal(list)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ioutil.WriteFile(path, data, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func saved_timers() []*Timer {
+	now := time.Now()
+	return []*Timer{
+		{Id: 7, Port: 1, State: 0, Due: now.Add(-time.Minute), Pulse: true},
+		{Id: 8, Port: 2, State: 1, Due: now.Add(time.Hour)},
+		{Id: 9, Port: 3, State: 1, Due: now.Add(-time.Second)},
+	}
+}
+
+func TestRestore(t *testing.T) {
+	path := write_state(t, saved_timers())
+	b, ts := start(t, path)
+	b.Set_relay(1, 1)
+	err := ts.Restore("restore")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !b.Wait_relay(1, 0, WAIT) || !b.Wait_relay(3, 1, WAIT) {
+		t.Fatalf("overdue timers are not fired")
+	}
+	time.Sleep(20 * time.Millisecond)
+	list := ts.List()
+	if len(list) != 1 || list[0].Id != 8 {
+		t.Errorf("unexpected pending timers %+v", list)
+	}
+	if id := ts.Set_after(4, 1, time.Hour); id != 10 {
+		t.Errorf("new timer id %d, ids must continue after restored ones", id)
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var saved []*Timer
+	json.Unmarshal(data, &saved)
+	if len(saved) != 2 {
+		t.Errorf("state file has %d timers, want 2", len(saved))
+	}
+}
+
+func TestRestoreClear(t *testing.T) {
+	path := write_state(t, saved_timers())
+	b, ts := start(t, path)
+	b.Set_relay(1, 1)
+	err := ts.Restore("clear")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !b.Wait_relay(1, 0, WAIT) {
+		t.Fatalf("pending pulse is not finished")
+	}
+	time.Sleep(50 * time.Millisecond)
+	if b.Relay(3) != 0 || len(ts.List()) != 0 {
+		t.Errorf("delayed actions are not dropped")
+	}
+}
+
+func TestRestoreUnknownPolicy(t *testing.T) {
+	_, ts := start(t, write_state(t, saved_timers()))
+	if ts.Restore("keep") == nil {
+		t.Errorf("error expected for unknown policy")
+	}
+}
+
+func TestStopKeepsTimers(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "timers.json")
+	b, ts := start(t, path)
+	ts.Set_after(4, 1, 50 * time.Millisecond)
+	ts.Stop()
+	time.Sleep(100 * time.Millisecond)
+	if b.Relay(4) != 0 {
+		t.Errorf("timer fired after stop")
+	}
+	data, _ := ioutil.ReadFile(path)
+	var saved []*Timer
+	json.Unmarshal(data, &saved)
+	if len(saved) != 1 {
+		t.Errorf("pending timer is not kept in state file: %s", data)
+	}
+}
@@ -0,0 +1,205 @@
+package watchdog
+
+import (
+	"conf"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"log/slog"
+	"mod_io"
+	"os"
+	"os/exec"
+	"sync"
+	"time"
+)
+
+type Status struct {
+	Managed bool
+	Healthy bool
+	Failed []string // failed health checks
+	Last_reset time.Time
+	Resets int
+}
+
+// Health check, returns nil if healthy
+type check struct {
+	name string
+	run func() error
+}
+
+type Watchdog struct {
+	sync.Mutex
+	mio *mod_io.Mod_io
+	interval time.Duration
+	checks []check
+	status Status
+	stopped bool
+}
+
+func New(mio *mod_io.Mod_io, wcfg *conf.Watchdog_cfg,
+         sink_check func() error) (*Watchdog, error) {
+	var err error
+	w := new(Watchdog)
+	w.mio = mio
+	w.status.Managed = wcfg.Enabled
+
+	w.interval = 10 * time.Second
+	if wcfg.Interval != "" {
+		w.interval, err = time.ParseDuration(wcfg.Interval)
+		if err != nil {
+			return nil, fmt.Errorf("watchdog: incorrect interval: %v", err)
+		}
+	}
+
+	if wcfg.Uart_max_silence != "" {
+		silence, err := time.ParseDuration(wcfg.Uart_max_silence)
+		if err != nil {
+			return nil, fmt.Errorf("watchdog: incorrect uart_max_silence: %v", err)
+		}
+		w.checks = append(w.checks, check{"uart", func() error {
+			return w.check_uart(silence)
+		}})
+	}
+
+	if wcfg.Check_sink {
+		w.checks = append(w.checks, check{"event_sink", sink_check})
+	}
+
+	for _, dir := range wcfg.Disk_paths {
+		dir := dir
+		w.checks = append(w.checks, check{"disk " + dir, func() error {
+			return check_disk(dir)
+		}})
+	}
+
+	exec_timeout := 5 * time.Second
+	if wcfg.Exec_timeout != "" {
+		exec_timeout, err = time.ParseDuration(wcfg.Exec_timeout)
+		if err != nil {
+			return nil, fmt.Errorf("watchdog: incorrect exec_timeout: %v", err)
+		}
+	}
+	for _, cmd := range wcfg.Exec {
+		cmd := cmd
+		w.checks = append(w.checks, check{"exec " + cmd, func() error {
+			return check_exec(cmd, exec_timeout)
+		}})
+	}
+	return w, nil
+}
+
+// Board must send something within max silence, otherwise it is asked
+// for watchdog state
+func (w *Watchdog) check_uart(max_silence time.Duration) error {
+	if time.Since(w.mio.Last_rx()) <= max_silence {
+		return nil
+	}
+	return w.mio.Wdt_set_state(w.mio.New_request_id(), 1)
+}
+
+func check_disk(dir string) error {
+	file, err := ioutil.TempFile(dir, ".usio_wdt_check")
+	if err != nil {
+		return err
+	}
+	name := file.Name()
+	_, err = file.Write([]byte("ok"))
+	if err == nil {
+		err = file.Sync()
+	}
+	file.Close()
+	os.Remove(name)
+	return err
+}
+
+func check_exec(cmd string, timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	out, err := exec.CommandContext(ctx, "bash", "-c", cmd).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%v: %s", err, out)
+	}
+	return nil
+}
+
+// Keepalive loop. Board watchdog is enabled and reset only while
+// all health checks pass
+func (w *Watchdog) Run() {
+	if !w.status.Managed {
+		return
+	}
+
+	for {
+		w.Lock()
+		if w.stopped {
+			w.Unlock()
+			return
+		}
+		err := w.mio.Wdt_set_state(w.mio.New_request_id(), 1)
+		w.Unlock()
+		if err == nil {
+			break
+		}
+		slog.Error("can't enable board watchdog", "module", "watchdog", "err", err)
+		time.Sleep(w.interval)
+	}
+
+	for {
+		var failed []string
+		for _, c := range w.checks {
+			err := c.run()
+			if err != nil {
+				slog.Warn("health check failed", "module", "watchdog",
+				          "check", c.name, "err", err)
+				failed = append(failed, c.name)
+			}
+		}
+
+		w.Lock()
+		if w.stopped {
+			w.Unlock()
+			return
+		}
+		w.status.Failed = failed
+		w.status.Healthy = len(failed) == 0
+		if !w.status.Healthy {
+			slog.Error("board watchdog is not reset", "module", "watchdog",
+			           "failed", failed)
+		}
+		if w.status.Healthy {
+			w.mio.Wdt_reset(w.mio.New_request_id())
+			w.status.Last_reset = time.Now()
+			w.status.Resets++
+		}
+		w.Unlock()
+
+		time.Sleep(w.interval)
+	}
+}
+
+// Stop keepalive loop and disable board watchdog, so orderly
+// shutdown does not end with host power cycle
+func (w *Watchdog) Stop() {
+	if !w.status.Managed {
+		return
+	}
+	w.Lock()
+	defer w.Unlock()
+	w.stopped = true
+	err := w.mio.Wdt_set_state(w.mio.New_request_id(), 0)
+	if err != nil {
+		slog.Error("can't disable board watchdog", "module", "watchdog", "err", err)
+		return
+	}
+	slog.Info("board watchdog disabled", "module", "watchdog")
+}
+
+func (w *Watchdog) Managed() bool {
+	return w.status.Managed
+}
+
+func (w *Watchdog) Status() Status {
+	w.Lock()
+	defer w.Unlock()
+	return w.status
+}